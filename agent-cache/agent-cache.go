@@ -0,0 +1,403 @@
+package agentcache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/////////
+// Agent cache routines
+/////////
+
+// pluggable cache backend, values expire after their ttl (no expiry when the ttl is 0)
+// implementations must be safe for concurrent use
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// delete all the keys with the prefix, the empty prefix clears the cache
+	Delete(ctx context.Context, prefix string) error
+}
+
+// expiry time for a ttl, zero for none
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+func expired(expires time.Time) bool {
+	return !expires.IsZero() && time.Now().After(expires)
+}
+
+//////////////////
+// in-memory lru cache
+
+// default number of entries in a memory cache
+const defaultMemoryEntries = 1000
+
+type memoryEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// in-memory cache dropping the least recently used entries over its size
+type MemoryCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func NewMemoryCache(size int) *MemoryCache {
+	if size <= 0 {
+		size = defaultMemoryEntries
+	}
+	return &MemoryCache{size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (cache *MemoryCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, exists := cache.entries[key]
+	if !exists {
+		return nil, false, nil
+	}
+	entry := element.Value.(*memoryEntry)
+	if expired(entry.expires) {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return nil, false, nil
+	}
+	cache.order.MoveToFront(element)
+	return append([]byte(nil), entry.value...), true, nil
+}
+
+func (cache *MemoryCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry := &memoryEntry{key: key, value: append([]byte(nil), value...), expires: expiry(ttl)}
+	if element, exists := cache.entries[key]; exists {
+		element.Value = entry
+		cache.order.MoveToFront(element)
+		return nil
+	}
+	cache.entries[key] = cache.order.PushFront(entry)
+	for cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*memoryEntry).key)
+	}
+	return nil
+}
+
+func (cache *MemoryCache) Delete(ctx context.Context, prefix string) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for key, element := range cache.entries {
+		if strings.HasPrefix(key, prefix) {
+			cache.order.Remove(element)
+			delete(cache.entries, key)
+		}
+	}
+	return nil
+}
+
+//////////////////
+// on-disk cache
+
+// on-disk cache, one json file per key named by the key hash
+type DiskCache struct {
+	dir string
+}
+
+type diskEntry struct {
+	Key     string    `json:"key"`
+	Value   []byte    `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+func NewDiskCache(dir string) (*DiskCache, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &DiskCache{dir: dir}, nil
+}
+
+func (cache *DiskCache) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(cache.dir, hex.EncodeToString(hash[:])+".json")
+}
+
+func (cache *DiskCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	dat, err := os.ReadFile(cache.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var entry diskEntry
+	err = json.Unmarshal(dat, &entry)
+	if err != nil || entry.Key != key {
+		return nil, false, err
+	}
+	if expired(entry.Expires) {
+		os.Remove(cache.path(key))
+		return nil, false, nil
+	}
+	return entry.Value, true, nil
+}
+
+func (cache *DiskCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	dat, err := json.Marshal(diskEntry{Key: key, Value: value, Expires: expiry(ttl)})
+	if err != nil {
+		return err
+	}
+	// write then rename so readers never see a partial entry
+	file, err := os.CreateTemp(cache.dir, "entry-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(dat)
+	file.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), cache.path(key))
+}
+
+func (cache *DiskCache) Delete(ctx context.Context, prefix string) error {
+	files, err := filepath.Glob(filepath.Join(cache.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if prefix != "" {
+			dat, err := os.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			var entry diskEntry
+			if json.Unmarshal(dat, &entry) != nil || !strings.HasPrefix(entry.Key, prefix) {
+				continue
+			}
+		}
+		os.Remove(file)
+	}
+	return nil
+}
+
+//////////////////
+// mongo cache
+
+// default mongo cache location
+const (
+	defaultMongoDatabase   = "agentcache"
+	defaultMongoCollection = "entries"
+)
+
+// mongo cache, expired entries are also removed by a ttl index
+type MongoCache struct {
+	coll *mongo.Collection
+}
+
+type mongoEntry struct {
+	Key     string    `bson:"_id"`
+	Value   []byte    `bson:"value"`
+	Expires time.Time `bson:"expires,omitempty"`
+}
+
+func NewMongoCache(ctx context.Context, uri string, database string, collection string) (*MongoCache, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+	coll := client.Database(database).Collection(collection)
+	_, err = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	return &MongoCache{coll: coll}, nil
+}
+
+func (cache *MongoCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	var entry mongoEntry
+	err := cache.coll.FindOne(ctx, bson.D{{Key: "_id", Value: key}}).Decode(&entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	// the ttl index only runs once a minute
+	if expired(entry.Expires) {
+		return nil, false, nil
+	}
+	return entry.Value, true, nil
+}
+
+func (cache *MongoCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := cache.coll.ReplaceOne(ctx, bson.D{{Key: "_id", Value: key}},
+		mongoEntry{Key: key, Value: value, Expires: expiry(ttl)}, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (cache *MongoCache) Delete(ctx context.Context, prefix string) error {
+	filter := bson.D{}
+	if prefix != "" {
+		filter = bson.D{{Key: "_id", Value: bson.D{{Key: "$regex", Value: "^" + regexp.QuoteMeta(prefix)}}}}
+	}
+	_, err := cache.coll.DeleteMany(ctx, filter)
+	return err
+}
+
+//////////////////
+// configured cache
+
+// caches opened by spec, shared within the process
+var cachesMu sync.Mutex
+var caches = map[string]Cache{}
+
+// open the cache for a spec: memory[:<entries>], disk:<dir> or mongo[:<database>] (using MONGODB_URI)
+func Open(ctx context.Context, spec string) (Cache, error) {
+	cachesMu.Lock()
+	defer cachesMu.Unlock()
+	if cache, exists := caches[spec]; exists {
+		return cache, nil
+	}
+
+	backend, arg, _ := strings.Cut(spec, ":")
+	var cache Cache
+	switch backend {
+	case "memory":
+		size := 0
+		if arg != "" {
+			var err error
+			size, err = strconv.Atoi(arg)
+			if err != nil {
+				return nil, errors.New("invalid memory cache size: " + arg)
+			}
+		}
+		cache = NewMemoryCache(size)
+	case "disk":
+		if arg == "" {
+			return nil, errors.New("disk cache needs a directory, disk:<dir>")
+		}
+		diskCache, err := NewDiskCache(arg)
+		if err != nil {
+			return nil, err
+		}
+		cache = diskCache
+	case "mongo":
+		mongodbUri, exists := os.LookupEnv("MONGODB_URI")
+		if !exists {
+			return nil, errors.New("environment variable MONGODB_URI not set")
+		}
+		if arg == "" {
+			arg = defaultMongoDatabase
+		}
+		mongoCache, err := NewMongoCache(ctx, mongodbUri, arg, defaultMongoCollection)
+		if err != nil {
+			return nil, err
+		}
+		cache = mongoCache
+	default:
+		return nil, errors.New("unknown cache backend: " + spec)
+	}
+	caches[spec] = cache
+	return cache, nil
+}
+
+// open the cache set by AGENT_CACHE, nil when caching is off
+func FromEnv(ctx context.Context) (Cache, error) {
+	spec, ok := os.LookupEnv("AGENT_CACHE")
+	if !ok || spec == "" || spec == "off" {
+		return nil, nil
+	}
+	return Open(ctx, spec)
+}
+
+// time to live from an env var in seconds, or the default
+func TTLFromEnv(key string, defaultTTL time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultTTL
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		log.Println("invalid " + key + ": " + value)
+		return defaultTTL
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// clear the configured cache, e.g. after the data it was built from is reloaded
+// only the shared disk and mongo backends are cleared for other processes, see BumpDataVersion
+func Invalidate(ctx context.Context) error {
+	cache, err := FromEnv(ctx)
+	if err != nil || cache == nil {
+		return err
+	}
+	return cache.Delete(ctx, "")
+}
+
+//////////////////
+// shared data version
+
+// the loaders bump the data version in mongodb after a reload, agents that put it in
+// their cache keys stop answering from the entries of the old data in every process
+const versionCollection = "versions"
+
+type dataVersion struct {
+	Version int64     `bson:"version"`
+	Updated time.Time `bson:"updated"`
+}
+
+// bump the data version
+func BumpDataVersion(ctx context.Context, client *mongo.Client) error {
+	coll := client.Database(defaultMongoDatabase).Collection(versionCollection)
+	_, err := coll.UpdateOne(ctx, bson.D{{Key: "_id", Value: "data"}},
+		bson.D{
+			{Key: "$inc", Value: bson.D{{Key: "version", Value: int64(1)}}},
+			{Key: "$set", Value: bson.D{{Key: "updated", Value: time.Now()}}},
+		}, options.Update().SetUpsert(true))
+	return err
+}
+
+// the current data version, empty before the first bump
+func DataVersion(ctx context.Context, client *mongo.Client) (string, error) {
+	var version dataVersion
+	coll := client.Database(defaultMongoDatabase).Collection(versionCollection)
+	err := coll.FindOne(ctx, bson.D{{Key: "_id", Value: "data"}}).Decode(&version)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(version.Version, 10), nil
+}
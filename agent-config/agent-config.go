@@ -0,0 +1,482 @@
+package agentconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+/////////
+// Agent topology configuration
+/////////
+
+// agent names in the config and the prefix of their env vars
+var agentPrefixes = map[string]string{
+	"database":           "DATABASE_AGENT",
+	"quarterlyResults":   "QUARTERLY_RESULTS_AGENT",
+	"dataCombine":        "DATA_COMBINE_AGENT",
+	"stockMarketInfoApp": "STOCK_MARKET_INFO_APP",
+}
+
+// agents called by each agent when the config does not say
+var defaultDownstream = map[string][]string{
+	"dataCombine":        {"database", "quarterlyResults"},
+	"stockMarketInfoApp": {"dataCombine"},
+}
+
+// the whole stack in one file
+type Config struct {
+	// default model for all agents
+	Model    Model            `yaml:"model" toml:"model"`
+	Registry Registry         `yaml:"registry" toml:"registry"`
+	Data     Data             `yaml:"data" toml:"data"`
+	Agents   map[string]Agent `yaml:"agents" toml:"agents"`
+}
+
+// model provider settings, empty fields use the defaults
+type Model struct {
+	// gemini, openai or ollama
+	Provider string `yaml:"provider" toml:"provider"`
+	Name     string `yaml:"name" toml:"name"`
+	BaseURL  string `yaml:"baseUrl" toml:"baseUrl"`
+	// secret, better set with MODEL_API_KEY or GEMINI_API_KEY
+	APIKey string `yaml:"apiKey" toml:"apiKey"`
+}
+
+// agent registry service, or a static registry file when disabled
+type Registry struct {
+	Enabled *bool  `yaml:"enabled" toml:"enabled"`
+	Address string `yaml:"address" toml:"address"`
+	File    string `yaml:"file" toml:"file"`
+}
+
+// data locations
+type Data struct {
+	// secret, better set with MONGODB_URI
+	MongoDBURI string `yaml:"mongodbUri" toml:"mongodbUri"`
+	// read-only user for the model written database commands, secret, better set with MONGODB_READONLY_URI
+	MongoDBReadOnlyURI string `yaml:"mongodbReadOnlyUri" toml:"mongodbReadOnlyUri"`
+	// database agent client settings
+	MongoDBPool MongoDBPool `yaml:"mongodbPool" toml:"mongodbPool"`
+	// caps of the model written database commands
+	CommandLimits CommandLimits `yaml:"commandLimits" toml:"commandLimits"`
+	NasdaqData    string        `yaml:"nasdaqData" toml:"nasdaqData"`
+	ResultsData   string        `yaml:"resultsData" toml:"resultsData"`
+	// ticker symbol metadata csv, loaded with the database and read by resolveTicker when not loaded
+	SymbolsCSV     string `yaml:"symbolsCsv" toml:"symbolsCsv"`
+	AttachmentsDir string `yaml:"attachmentsDir" toml:"attachmentsDir"`
+	// reload the nasdaq database at startup
+	LoadDatabase bool `yaml:"loadDatabase" toml:"loadDatabase"`
+}
+
+// database agent connection pool, unset values keep the uri and driver defaults
+type MongoDBPool struct {
+	MaxPoolSize           int `yaml:"maxPoolSize" toml:"maxPoolSize"`
+	MinPoolSize           int `yaml:"minPoolSize" toml:"minPoolSize"`
+	ConnectTimeoutSeconds int `yaml:"connectTimeoutSeconds" toml:"connectTimeoutSeconds"`
+	// deadline of each query, 30 seconds by default
+	QueryTimeoutSeconds int `yaml:"queryTimeoutSeconds" toml:"queryTimeoutSeconds"`
+	// primary, primaryPreferred, secondary, secondaryPreferred or nearest
+	ReadPreference string `yaml:"readPreference" toml:"readPreference"`
+}
+
+// database command caps, 10 seconds and 1000 results by default
+type CommandLimits struct {
+	MaxTimeMS  int `yaml:"maxTimeMs" toml:"maxTimeMs"`
+	MaxResults int `yaml:"maxResults" toml:"maxResults"`
+}
+
+// a single agent service
+type Agent struct {
+	Enabled *bool `yaml:"enabled" toml:"enabled"`
+	// listen address, <hostname>:<port>
+	Address string `yaml:"address" toml:"address"`
+	// model settings over the default model
+	Model Model `yaml:"model" toml:"model"`
+	// react or plan
+	Mode string `yaml:"mode" toml:"mode"`
+	// agents this agent calls, they must be enabled
+	Downstream []string `yaml:"downstream" toml:"downstream"`
+	// external mcp tool servers, name to command or url
+	MCPServers map[string]string `yaml:"mcpServers" toml:"mcpServers"`
+	// tool policies by tool name, replacing the built-in policy of the tool
+	Tools map[string]Tool `yaml:"tools" toml:"tools"`
+	// registry refresh interval, data combine agent only
+	RefreshSeconds int `yaml:"refreshSeconds" toml:"refreshSeconds"`
+}
+
+// tool policy settings
+type Tool struct {
+	// low or high, high risk calls need a human approval
+	Risk            string `yaml:"risk" toml:"risk" json:"risk,omitempty"`
+	Untrusted       bool   `yaml:"untrusted" toml:"untrusted" json:"untrusted,omitempty"`
+	Cacheable       bool   `yaml:"cacheable" toml:"cacheable" json:"cacheable,omitempty"`
+	CacheTTLSeconds int    `yaml:"cacheTtlSeconds" toml:"cacheTtlSeconds" json:"cacheTtlSeconds,omitempty"`
+}
+
+// load a config file, yaml (.yaml, .yml) or toml (.toml)
+func Load(path string) (*Config, error) {
+	configDat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(strings.NewReader(string(configDat)))
+		decoder.KnownFields(true)
+		err = decoder.Decode(config)
+	case ".toml":
+		var metadata toml.MetaData
+		metadata, err = toml.Decode(string(configDat), config)
+		if err == nil && len(metadata.Undecoded()) > 0 {
+			err = errors.New("unknown field " + metadata.Undecoded()[0].String())
+		}
+	default:
+		return nil, errors.New("unknown config format: " + path + ", expected .yaml, .yml or .toml")
+	}
+	if err != nil {
+		return nil, errors.New("invalid config " + path + ": " + err.Error())
+	}
+	return config, nil
+}
+
+// env var of a config value, set env vars take precedence over the config
+func lookup(env map[string]string, key string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return env[key]
+}
+
+// agent enabled unless set to false
+func (agent Agent) enabled() bool {
+	return agent.Enabled == nil || *agent.Enabled
+}
+
+// check the config, with the env overrides applied, and report every problem found
+func (config *Config) Validate() error {
+	env, err := config.Env()
+	if err != nil {
+		return err
+	}
+	var problems []string
+	addresses := map[string]string{}
+	checkAddress := func(owner string, address string) {
+		if address == ":" {
+			problems = append(problems, owner+": missing address")
+			return
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || host == "" {
+			problems = append(problems, owner+": address must be <hostname>:<port>, got \""+address+"\"")
+			return
+		}
+		number, err := strconv.Atoi(port)
+		if err != nil || number <= 0 || number > 65535 {
+			problems = append(problems, owner+": invalid port in address "+address)
+			return
+		}
+		if other, exists := addresses[address]; exists {
+			problems = append(problems, owner+": address "+address+" is already used by "+other)
+			return
+		}
+		addresses[address] = owner
+	}
+
+	// registry service or file
+	registryEnabled := config.Registry.Enabled == nil || *config.Registry.Enabled
+	if registryEnabled && lookup(env, "AGENT_REGISTRY_FILE") == "" {
+		checkAddress("registry", net.JoinHostPort(lookup(env, "AGENT_REGISTRY_HOSTNAME"), lookup(env, "AGENT_REGISTRY_PORT")))
+	} else if lookup(env, "AGENT_REGISTRY_FILE") == "" {
+		problems = append(problems, "registry: a file is needed when the registry service is disabled")
+	}
+
+	// agents, in a fixed order for stable errors
+	names := make([]string, 0, len(config.Agents))
+	for name := range config.Agents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		agent := config.Agents[name]
+		prefix, known := agentPrefixes[name]
+		if !known {
+			problems = append(problems, "agents: unknown agent \""+name+"\", expected one of "+strings.Join(AgentNames(), ", "))
+			continue
+		}
+		if lookup(env, prefix+"_ENABLED") == "false" {
+			continue
+		}
+		owner := "agents." + name
+		checkAddress(owner, net.JoinHostPort(lookup(env, prefix+"_HOSTNAME"), lookup(env, prefix+"_PORT")))
+
+		// model, the agent settings over the defaults
+		provider := strings.ToLower(firstSet(lookup(env, prefix+"_MODEL_PROVIDER"), lookup(env, "MODEL_PROVIDER"), "gemini"))
+		switch provider {
+		case "gemini":
+			if lookup(env, "GEMINI_API_KEY") == "" {
+				problems = append(problems, owner+": the gemini model provider needs GEMINI_API_KEY")
+			}
+		case "openai", "ollama":
+			if firstSet(lookup(env, prefix+"_MODEL_NAME"), lookup(env, "MODEL_NAME")) == "" {
+				problems = append(problems, owner+": the "+provider+" model provider needs a model name")
+			}
+		default:
+			problems = append(problems, owner+": unknown model provider \""+provider+"\", expected gemini, openai or ollama")
+		}
+
+		mode := lookup(env, prefix+"_MODE")
+		if mode != "" && mode != "react" && mode != "plan" {
+			problems = append(problems, owner+": unknown mode \""+mode+"\", expected react or plan")
+		}
+		for _, downstream := range agent.Downstream {
+			otherPrefix, exists := agentPrefixes[downstream]
+			_, listed := config.Agents[downstream]
+			switch {
+			case !exists || !listed:
+				problems = append(problems, owner+": downstream agent \""+downstream+"\" is not in the config")
+			case lookup(env, otherPrefix+"_ENABLED") == "false":
+				problems = append(problems, owner+": downstream agent \""+downstream+"\" is disabled")
+			case downstream == name:
+				problems = append(problems, owner+": the agent is its own downstream agent")
+			}
+		}
+		for serverName, target := range agent.MCPServers {
+			if strings.ContainsAny(serverName, "=;") || strings.Contains(target, ";") || strings.TrimSpace(target) == "" {
+				problems = append(problems, owner+": invalid mcp server \""+serverName+"\"")
+			}
+		}
+		for toolName, tool := range agent.Tools {
+			if tool.Risk != "" && tool.Risk != "low" && tool.Risk != "high" {
+				problems = append(problems, owner+": tool "+toolName+" has unknown risk \""+tool.Risk+"\", expected low or high")
+			}
+			if tool.CacheTTLSeconds < 0 {
+				problems = append(problems, owner+": tool "+toolName+" has a negative cacheTtlSeconds")
+			}
+		}
+		if agent.RefreshSeconds < 0 {
+			problems = append(problems, owner+": refreshSeconds must be positive")
+		}
+		if agent.RefreshSeconds != 0 && name != "dataCombine" {
+			problems = append(problems, owner+": refreshSeconds is only used by the dataCombine agent")
+		}
+	}
+
+	// data needed by the enabled agents
+	loadDatabase := lookup(env, "LOAD_DB") == "true"
+	if lookup(env, "MONGODB_URI") == "" && (loadDatabase || lookup(env, "DATABASE_AGENT_ENABLED") != "false") {
+		problems = append(problems, "data: mongodbUri (or MONGODB_URI) is needed by the database agent and database loading")
+	}
+	pool := config.Data.MongoDBPool
+	if pool.MaxPoolSize < 0 || pool.MinPoolSize < 0 || pool.ConnectTimeoutSeconds < 0 || pool.QueryTimeoutSeconds < 0 {
+		problems = append(problems, "data: mongodbPool sizes and timeouts must be positive")
+	}
+	if config.Data.CommandLimits.MaxTimeMS < 0 || config.Data.CommandLimits.MaxResults < 0 {
+		problems = append(problems, "data: commandLimits must be positive")
+	}
+	if pool.MaxPoolSize > 0 && pool.MinPoolSize > pool.MaxPoolSize {
+		problems = append(problems, "data: mongodbPool minPoolSize is over maxPoolSize")
+	}
+	switch strings.ToLower(lookup(env, "MONGODB_READ_PREFERENCE")) {
+	case "", "primary", "primarypreferred", "secondary", "secondarypreferred", "nearest":
+	default:
+		problems = append(problems, "data: unknown mongodbPool readPreference \""+lookup(env, "MONGODB_READ_PREFERENCE")+"\", expected primary, primaryPreferred, secondary, secondaryPreferred or nearest")
+	}
+	if loadDatabase && lookup(env, "NASDAQ_DATA") == "" {
+		problems = append(problems, "data: nasdaqData is needed to load the database")
+	}
+	if lookup(env, "QUARTERLY_RESULTS_AGENT_ENABLED") != "false" && lookup(env, "RESULTS_DATA") == "" {
+		problems = append(problems, "data: resultsData is needed by the quarterlyResults agent")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// names of the agents, sorted
+func AgentNames() []string {
+	names := make([]string, 0, len(agentPrefixes))
+	for name := range agentPrefixes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func firstSet(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// the config as the env vars read by the agents
+func (config *Config) Env() (map[string]string, error) {
+	env := map[string]string{}
+	set := func(key string, value string) {
+		if value != "" {
+			env[key] = value
+		}
+	}
+	setModel := func(prefix string, model Model) {
+		set(prefix+"MODEL_PROVIDER", model.Provider)
+		set(prefix+"MODEL_NAME", model.Name)
+		set(prefix+"MODEL_BASE_URL", model.BaseURL)
+		set(prefix+"MODEL_API_KEY", model.APIKey)
+	}
+	setAddress := func(prefix string, address string) error {
+		if address == "" {
+			return nil
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return errors.New("invalid config: " + strings.ToLower(prefix) + " address must be <hostname>:<port>, got \"" + address + "\"")
+		}
+		set(prefix+"_HOSTNAME", host)
+		set(prefix+"_PORT", port)
+		return nil
+	}
+
+	setModel("", config.Model)
+	if strings.ToLower(config.Model.Provider) == "gemini" || config.Model.Provider == "" {
+		set("GEMINI_API_KEY", config.Model.APIKey)
+	}
+
+	err := setAddress("AGENT_REGISTRY", config.Registry.Address)
+	if err != nil {
+		return nil, err
+	}
+	if config.Registry.Enabled != nil && !*config.Registry.Enabled {
+		set("AGENT_REGISTRY_FILE", config.Registry.File)
+	}
+
+	set("MONGODB_URI", config.Data.MongoDBURI)
+	setCount := func(key string, count int) {
+		if count > 0 {
+			set(key, strconv.Itoa(count))
+		}
+	}
+	setCount("MONGODB_MAX_POOL_SIZE", config.Data.MongoDBPool.MaxPoolSize)
+	setCount("MONGODB_MIN_POOL_SIZE", config.Data.MongoDBPool.MinPoolSize)
+	setCount("MONGODB_CONNECT_TIMEOUT_SECONDS", config.Data.MongoDBPool.ConnectTimeoutSeconds)
+	setCount("MONGODB_QUERY_TIMEOUT_SECONDS", config.Data.MongoDBPool.QueryTimeoutSeconds)
+	set("MONGODB_READ_PREFERENCE", config.Data.MongoDBPool.ReadPreference)
+	set("MONGODB_READONLY_URI", config.Data.MongoDBReadOnlyURI)
+	setCount("MONGODB_COMMAND_MAX_TIME_MS", config.Data.CommandLimits.MaxTimeMS)
+	setCount("MONGODB_COMMAND_MAX_RESULTS", config.Data.CommandLimits.MaxResults)
+	set("NASDAQ_DATA", withTrailingSlash(config.Data.NasdaqData))
+	set("RESULTS_DATA", withTrailingSlash(config.Data.ResultsData))
+	set("SYMBOLS_CSV", config.Data.SymbolsCSV)
+	set("AGENT_ATTACHMENTS_DIR", config.Data.AttachmentsDir)
+	set("LOAD_DB", strconv.FormatBool(config.Data.LoadDatabase))
+
+	for name, prefix := range agentPrefixes {
+		// the config describes the whole topology, agents left out are not run
+		agent, exists := config.Agents[name]
+		set(prefix+"_ENABLED", strconv.FormatBool(exists && agent.enabled()))
+		err = setAddress(prefix, agent.Address)
+		if err != nil {
+			return nil, err
+		}
+		setModel(prefix+"_", agent.Model)
+		set(prefix+"_MODE", agent.Mode)
+		set(prefix+"_DOWNSTREAM", strings.Join(agent.Downstream, ","))
+		if agent.RefreshSeconds > 0 {
+			set(prefix+"_REFRESH_SECONDS", strconv.Itoa(agent.RefreshSeconds))
+		}
+
+		// mcp servers in the MCPServersFromEnv form
+		serverNames := make([]string, 0, len(agent.MCPServers))
+		for serverName := range agent.MCPServers {
+			serverNames = append(serverNames, serverName)
+		}
+		sort.Strings(serverNames)
+		var servers []string
+		for _, serverName := range serverNames {
+			servers = append(servers, serverName+"="+agent.MCPServers[serverName])
+		}
+		set(prefix+"_MCP_SERVERS", strings.Join(servers, ";"))
+
+		// tool policies in the ToolPoliciesFromEnv form
+		if len(agent.Tools) > 0 {
+			toolsDat, err := json.Marshal(agent.Tools)
+			if err != nil {
+				return nil, err
+			}
+			set(prefix+"_TOOL_POLICIES", string(toolsDat))
+		}
+	}
+	return env, nil
+}
+
+// the data loaders join the directory and file names directly
+func withTrailingSlash(dir string) string {
+	if dir == "" || strings.HasSuffix(dir, "/") {
+		return dir
+	}
+	return dir + "/"
+}
+
+// validate the config and export it as env vars, env vars that are already set are kept
+// so secrets and per deployment settings can override the file
+func (config *Config) Apply() error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+	env, err := config.Env()
+	if err != nil {
+		return err
+	}
+	for key, value := range env {
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		err = os.Setenv(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// env var prefix of an agent
+func Prefix(name string) (string, bool) {
+	prefix, exists := agentPrefixes[name]
+	return prefix, exists
+}
+
+// agents called by an agent, from <prefix>_DOWNSTREAM or the default topology
+func Downstream(name string) []string {
+	prefix := agentPrefixes[name]
+	downstream, ok := os.LookupEnv(prefix + "_DOWNSTREAM")
+	if !ok {
+		return defaultDownstream[name]
+	}
+	var names []string
+	for _, other := range strings.Split(downstream, ",") {
+		if other = strings.TrimSpace(other); other != "" {
+			names = append(names, other)
+		}
+	}
+	return names
+}
+
+// agent enabled in the environment, agents are enabled unless <prefix>_ENABLED is false
+func Enabled(prefix string) bool {
+	enabled, ok := os.LookupEnv(prefix + "_ENABLED")
+	return !ok || enabled != "false"
+}
@@ -0,0 +1,222 @@
+package agentconfig
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a config file with every agent
+const fullConfig = `
+model:
+  provider: gemini
+  apiKey: test-key
+registry:
+  address: localhost:3300
+data:
+  mongodbUri: mongodb://localhost:27017
+  nasdaqData: /data/nasdaq
+  resultsData: /data/results/
+agents:
+  database:
+    address: localhost:3200
+    tools:
+      commandQueryDatabase: {risk: high, cacheable: true}
+  quarterlyResults:
+    address: localhost:3201
+  dataCombine:
+    address: localhost:3100
+    downstream: [database, quarterlyResults]
+    mode: plan
+    refreshSeconds: 30
+  stockMarketInfoApp:
+    address: localhost:3000
+    model: {provider: openai, name: gpt-4o-mini}
+    downstream: [dataCombine]
+`
+
+// unset the env vars the config is applied as, set env vars take precedence over the file
+// t.Setenv restores them after the test
+func clearEnv(t *testing.T) {
+	config, err := loadConfig(t, "stock-agent.yaml", fullConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := config.Env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"GEMINI_API_KEY", "MODEL_NAME", "AGENT_REGISTRY_FILE", "AGENT_REGISTRY_HOSTNAME", "AGENT_REGISTRY_PORT"}
+	for key := range env {
+		keys = append(keys, key)
+	}
+	for _, prefix := range agentPrefixes {
+		keys = append(keys, prefix+"_HOSTNAME", prefix+"_PORT", prefix+"_MODEL_PROVIDER", prefix+"_MODEL_NAME", prefix+"_MODE")
+	}
+	for _, key := range keys {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+}
+
+func loadConfig(t *testing.T, name string, content string) (*Config, error) {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+func TestValidate(t *testing.T) {
+	clearEnv(t)
+	config, err := loadConfig(t, "stock-agent.yaml", fullConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.Validate()
+	if err != nil {
+		t.Errorf("full config: %v", err)
+	}
+
+	// the same file in toml
+	config, err = loadConfig(t, "stock-agent.toml", `
+[model]
+provider = "ollama"
+name = "llama3.1"
+[registry]
+enabled = false
+file = "registry.json"
+[data]
+mongodbUri = "mongodb://localhost:27017"
+resultsData = "/data/results/"
+[agents.database]
+address = "localhost:3200"
+[agents.quarterlyResults]
+address = "localhost:3201"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.Validate()
+	if err != nil {
+		t.Errorf("toml config: %v", err)
+	}
+}
+
+func TestValidateCollectsProblems(t *testing.T) {
+	clearEnv(t)
+	config, err := loadConfig(t, "stock-agent.yaml", `
+model:
+  provider: anthropic
+registry:
+  address: localhost:3300
+data:
+  loadDatabase: true
+  mongodbPool: {maxPoolSize: 5, minPoolSize: 10, readPreference: closest}
+agents:
+  database:
+    address: localhost:3300
+    mode: think
+    refreshSeconds: 30
+    tools:
+      commandQueryDatabase: {risk: extreme, cacheTtlSeconds: -1}
+  quarterlyResults:
+    address: localhost:99999
+  dataCombine:
+    address: localhost:3100
+    downstream: [database, dataCombine, stockMarketInfoApp]
+    model: {provider: openai}
+  marketWatch:
+    address: localhost:3400
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.Validate()
+	if err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	// every problem is reported at once
+	for _, want := range []string{
+		`agents: unknown agent "marketWatch"`,
+		"agents.database: address localhost:3300 is already used by registry",
+		`agents.database: unknown model provider "anthropic"`,
+		`agents.database: unknown mode "think"`,
+		`agents.database: tool commandQueryDatabase has unknown risk "extreme"`,
+		"agents.database: tool commandQueryDatabase has a negative cacheTtlSeconds",
+		"agents.database: refreshSeconds is only used by the dataCombine agent",
+		"agents.quarterlyResults: invalid port in address localhost:99999",
+		"agents.dataCombine: the openai model provider needs a model name",
+		"agents.dataCombine: the agent is its own downstream agent",
+		`agents.dataCombine: downstream agent "stockMarketInfoApp" is not in the config`,
+		"data: mongodbUri (or MONGODB_URI) is needed",
+		"data: mongodbPool minPoolSize is over maxPoolSize",
+		`data: unknown mongodbPool readPreference "closest"`,
+		"data: nasdaqData is needed to load the database",
+		"data: resultsData is needed by the quarterlyResults agent",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("problems missing %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestValidateEnvPrecedence(t *testing.T) {
+	clearEnv(t)
+	config, err := loadConfig(t, "stock-agent.yaml", strings.Replace(fullConfig, "mode: plan", "mode: think", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.Validate()
+	if err == nil || !strings.Contains(err.Error(), `unknown mode "think"`) {
+		t.Fatalf("err = %v, want the unknown mode", err)
+	}
+
+	// a set env var is checked instead of the file value
+	t.Setenv("DATA_COMBINE_AGENT_MODE", "react")
+	// and fills in what the file leaves out
+	t.Setenv("STOCK_MARKET_INFO_APP_MODEL_PROVIDER", "gemini")
+	err = config.Validate()
+	if err != nil {
+		t.Errorf("with the env overrides: %v", err)
+	}
+
+	// an env var set to a bad value is reported even when the file is right
+	t.Setenv("DATABASE_AGENT_PORT", "http")
+	err = config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "agents.database: invalid port") {
+		t.Errorf("err = %v, want the env port reported", err)
+	}
+}
+
+func TestApplyKeepsSetEnv(t *testing.T) {
+	clearEnv(t)
+	config, err := loadConfig(t, "stock-agent.yaml", fullConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DATABASE_AGENT_PORT", "4200")
+	t.Setenv("GEMINI_API_KEY", "env-key")
+	err = config.Apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"DATABASE_AGENT_PORT":                "4200",
+		"GEMINI_API_KEY":                     "env-key",
+		"DATABASE_AGENT_HOSTNAME":            "localhost",
+		"DATA_COMBINE_AGENT_MODE":            "plan",
+		"DATA_COMBINE_AGENT_DOWNSTREAM":      "database,quarterlyResults",
+		"NASDAQ_DATA":                        "/data/nasdaq/",
+		"STOCK_MARKET_INFO_APP_MODEL_NAME":   "gpt-4o-mini",
+		"DATABASE_AGENT_TOOL_POLICIES":       `{"commandQueryDatabase":{"risk":"high","cacheable":true}}`,
+		"QUARTERLY_RESULTS_AGENT_ENABLED":    "true",
+		"DATA_COMBINE_AGENT_REFRESH_SECONDS": "30",
+	} {
+		if got := os.Getenv(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package agenteval
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	agentassemble "stock-agent/gemini-agent-assemble"
+
+	"gopkg.in/yaml.v3"
+)
+
+/////////
+// Agent evaluation harness
+/////////
+
+// golden question set for an agent
+type Suite struct {
+	Name string `yaml:"name" json:"name"`
+	// agent endpoint (http://<hostname>:<port>), can be overridden when running
+	Endpoint string `yaml:"endpoint" json:"endpoint,omitempty"`
+	Cases    []Case `yaml:"cases" json:"cases"`
+}
+
+// a question and the checks on its answer
+type Case struct {
+	ID    string `yaml:"id" json:"id"`
+	Input string `yaml:"input" json:"input"`
+	// react or plan, empty for the agent default
+	Mode       string      `yaml:"mode" json:"mode,omitempty"`
+	Assertions []Assertion `yaml:"assertions" json:"assertions"`
+}
+
+// load a suite from a yaml file (.yaml, .yml) or a jsonl file of cases (.jsonl)
+// a jsonl suite is named after the file
+func LoadSuite(path string) (*Suite, error) {
+	suiteDat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	suite := &Suite{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(suiteDat, suite)
+		if err != nil {
+			return nil, errors.New("invalid suite " + path + ": " + err.Error())
+		}
+	case ".jsonl":
+		suite.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		scanner := bufio.NewScanner(bytes.NewReader(suiteDat))
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			var evalCase Case
+			err = json.Unmarshal(scanner.Bytes(), &evalCase)
+			if err != nil {
+				return nil, errors.New("invalid suite " + path + " line " + strconv.Itoa(line) + ": " + err.Error())
+			}
+			suite.Cases = append(suite.Cases, evalCase)
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unknown suite format: " + path)
+	}
+	if suite.Name == "" {
+		suite.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return suite, suite.validate()
+}
+
+// check the cases can be run
+func (suite *Suite) validate() error {
+	ids := map[string]bool{}
+	for idx, evalCase := range suite.Cases {
+		if evalCase.ID == "" {
+			evalCase.ID = "case-" + strconv.Itoa(idx+1)
+			suite.Cases[idx].ID = evalCase.ID
+		}
+		if ids[evalCase.ID] {
+			return errors.New("duplicate case id: " + evalCase.ID)
+		}
+		ids[evalCase.ID] = true
+		if evalCase.Input == "" {
+			return errors.New("case " + evalCase.ID + " has no input")
+		}
+		for _, assertion := range evalCase.Assertions {
+			err := assertion.validate()
+			if err != nil {
+				return errors.New("case " + evalCase.ID + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// run settings
+type Options struct {
+	// agent endpoint, the suite endpoint when empty
+	Endpoint string
+	// agent transport, the AGENT_TRANSPORT default when empty
+	Transport string
+	// per case deadline, the AGENT_TIMEOUT_SECONDS default when zero
+	Timeout time.Duration
+	// grader for the judge assertions, a model judge is created when needed
+	Judge Judge
+}
+
+// run every case of the suite against the agent, one at a time so the latencies are comparable
+func Run(ctx context.Context, suite *Suite, options Options) (*Report, error) {
+	endpoint := options.Endpoint
+	if endpoint == "" {
+		endpoint = suite.Endpoint
+	}
+	if endpoint == "" {
+		return nil, errors.New("no agent endpoint for suite " + suite.Name)
+	}
+	transport := options.Transport
+	if transport == "" {
+		transport = agentassemble.AgentTransport()
+	}
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = agentassemble.AgentTimeout()
+	}
+	client, err := agentassemble.NewAgentClient(transport, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// only start a judge model when the suite uses one
+	grader := &grader{judge: options.Judge}
+	defer grader.close()
+
+	report := &Report{
+		Suite:    suite.Name,
+		Endpoint: endpoint,
+		Started:  time.Now(),
+	}
+	for _, evalCase := range suite.Cases {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Println("eval case " + evalCase.ID + ": " + evalCase.Input)
+		result := runCase(ctx, client, evalCase, timeout, grader)
+		log.Println("eval case " + evalCase.ID + " passed: " + strconv.FormatBool(result.Passed))
+		report.Cases = append(report.Cases, result)
+	}
+	report.summarise()
+	return report, nil
+}
+
+// ask the agent the case question and check the answer
+func runCase(ctx context.Context, client agentassemble.AgentClient, evalCase Case, timeout time.Duration, grader *grader) CaseResult {
+	result := CaseResult{ID: evalCase.ID, Input: evalCase.Input, ToolCalls: []string{}}
+
+	caseCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	started := time.Now()
+	response, err := client.AskStream(caseCtx, agentassemble.Request{Input: evalCase.Input, Mode: evalCase.Mode}, func(step agentassemble.Step) {
+		result.ToolCalls = append(result.ToolCalls, step.Tool)
+	})
+	result.LatencyMs = time.Since(started).Milliseconds()
+	if err != nil {
+		log.Println("eval case "+evalCase.ID+" error:", err)
+		result.Error = err.Error()
+		return result
+	}
+	result.Answer = response.Content
+	result.Cached = response.Cached
+	if response.Usage != nil {
+		result.Usage = *response.Usage
+	}
+
+	// every assertion must pass
+	result.Passed = true
+	for _, assertion := range evalCase.Assertions {
+		assertionResult := assertion.check(ctx, evalCase, result, grader)
+		result.Passed = result.Passed && assertionResult.Passed
+		result.Assertions = append(result.Assertions, assertionResult)
+	}
+	return result
+}
@@ -0,0 +1,292 @@
+package agenteval
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	agentassemble "stock-agent/gemini-agent-assemble"
+	stockdata "stock-agent/stock-data"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/////////
+// Answer assertions
+/////////
+
+// assertion types
+const (
+	// the answer contains an exact value, given or computed from the database
+	AssertValue = "value"
+	// the answer matches a regular expression
+	AssertRegex = "regex"
+	// a model grades the answer against a rubric
+	AssertJudge = "judge"
+	// the agent called a tool
+	AssertTool = "tool"
+)
+
+// default tolerance for numeric values, answers are usually rounded to cents
+const defaultTolerance = 0.005
+
+// a check on a case answer
+type Assertion struct {
+	Type string `yaml:"type" json:"type"`
+	// value: the expected value, or the database query computing it
+	Value     string      `yaml:"value" json:"value,omitempty"`
+	Mongo     *MongoValue `yaml:"mongo" json:"mongo,omitempty"`
+	Tolerance float64     `yaml:"tolerance" json:"tolerance,omitempty"`
+	// regex: the pattern the answer must match
+	Pattern string `yaml:"pattern" json:"pattern,omitempty"`
+	// judge: what a correct answer looks like
+	Rubric string `yaml:"rubric" json:"rubric,omitempty"`
+	// tool: the tool the agent must call
+	Tool string `yaml:"tool" json:"tool,omitempty"`
+}
+
+// expected value computed directly from the nasdaq database
+type MongoValue struct {
+	// ticker collection
+	Collection string `yaml:"collection" json:"collection"`
+	// open, high, low or close
+	Field string `yaml:"field" json:"field"`
+	// max, min, first, last, avg, sum or count over the date range
+	Op    string `yaml:"op" json:"op"`
+	Start string `yaml:"start" json:"start"`
+	End   string `yaml:"end" json:"end"`
+}
+
+// outcome of an assertion
+type AssertionResult struct {
+	Type   string `json:"type"`
+	Passed bool   `json:"passed"`
+	// what was expected and why the check failed
+	Detail string `json:"detail,omitempty"`
+}
+
+func (assertion Assertion) validate() error {
+	switch assertion.Type {
+	case AssertValue:
+		if assertion.Value == "" && assertion.Mongo == nil {
+			return errors.New("value assertion needs a value or a mongo query")
+		}
+		if assertion.Mongo != nil {
+			switch assertion.Mongo.Op {
+			case "max", "min", "first", "last", "avg", "sum", "count":
+			default:
+				return errors.New("unknown mongo op: " + assertion.Mongo.Op)
+			}
+			if assertion.Mongo.Collection == "" || (assertion.Mongo.Field == "" && assertion.Mongo.Op != "count") {
+				return errors.New("mongo value needs a collection and field")
+			}
+		}
+	case AssertRegex:
+		_, err := regexp.Compile(assertion.Pattern)
+		if err != nil {
+			return errors.New("invalid regex assertion: " + err.Error())
+		}
+	case AssertJudge:
+		if assertion.Rubric == "" {
+			return errors.New("judge assertion needs a rubric")
+		}
+	case AssertTool:
+		if assertion.Tool == "" {
+			return errors.New("tool assertion needs a tool")
+		}
+	default:
+		return errors.New("unknown assertion type: " + assertion.Type)
+	}
+	return nil
+}
+
+// check the answer of a case
+func (assertion Assertion) check(ctx context.Context, evalCase Case, result CaseResult, grader *grader) AssertionResult {
+	assertionResult := AssertionResult{Type: assertion.Type}
+	switch assertion.Type {
+	case AssertValue:
+		expected := assertion.Value
+		if assertion.Mongo != nil {
+			var err error
+			expected, err = assertion.Mongo.compute(ctx)
+			if err != nil {
+				assertionResult.Detail = "mongo value error: " + err.Error()
+				return assertionResult
+			}
+		}
+		tolerance := assertion.Tolerance
+		if tolerance <= 0 {
+			tolerance = defaultTolerance
+		}
+		assertionResult.Passed = containsValue(result.Answer, expected, tolerance)
+		assertionResult.Detail = "expected " + expected
+	case AssertRegex:
+		assertionResult.Passed = regexp.MustCompile(assertion.Pattern).MatchString(result.Answer)
+		assertionResult.Detail = "pattern " + assertion.Pattern
+	case AssertJudge:
+		passed, reason, err := grader.grade(ctx, assertion.Rubric, evalCase.Input, result.Answer)
+		if err != nil {
+			assertionResult.Detail = "judge error: " + err.Error()
+			return assertionResult
+		}
+		assertionResult.Passed = passed
+		assertionResult.Detail = reason
+	case AssertTool:
+		assertionResult.Passed = slices.Contains(result.ToolCalls, assertion.Tool)
+		assertionResult.Detail = "tool " + assertion.Tool
+	}
+	return assertionResult
+}
+
+// numbers in the text, ignoring currency signs and thousand separators
+var numberPattern = regexp.MustCompile(`-?\d[\d,]*(\.\d+)?`)
+
+func parseNumber(text string) (float64, error) {
+	text = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(text), "$"))
+	return strconv.ParseFloat(strings.ReplaceAll(text, ",", ""), 64)
+}
+
+// check the answer has the expected value, numbers match within the tolerance
+func containsValue(answer string, expected string, tolerance float64) bool {
+	expectedNumber, err := parseNumber(expected)
+	if err != nil {
+		return strings.Contains(strings.ToLower(answer), strings.ToLower(strings.TrimSpace(expected)))
+	}
+	for _, match := range numberPattern.FindAllString(answer, -1) {
+		number, err := parseNumber(match)
+		if err == nil && math.Abs(number-expectedNumber) <= tolerance {
+			return true
+		}
+	}
+	return false
+}
+
+// compute the value over the date range
+func (value *MongoValue) compute(ctx context.Context) (string, error) {
+	mongodbUri, exists := os.LookupEnv("MONGODB_URI")
+	if !exists {
+		return "", errors.New("missing MONGODB_URI in env vars")
+	}
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongodbUri))
+	if err != nil {
+		return "", err
+	}
+	defer client.Disconnect(context.Background())
+
+	lines, err := stockdata.FindLines(ctx, client.Database("nasdaq").Collection(value.Collection), value.Start, value.End)
+	if err != nil {
+		return "", err
+	}
+	if value.Op == "count" {
+		return strconv.Itoa(len(lines)), nil
+	}
+	if len(lines) == 0 {
+		return "", errors.New("no " + value.Collection + " data for the date range")
+	}
+
+	numbers := []float64{}
+	for _, line := range lines {
+		number, err := line.Value(value.Field)
+		if err != nil {
+			return "", err
+		}
+		numbers = append(numbers, number)
+	}
+	var result float64
+	switch value.Op {
+	case "max":
+		result = slices.Max(numbers)
+	case "min":
+		result = slices.Min(numbers)
+	case "first":
+		result = numbers[0]
+	case "last":
+		result = numbers[len(numbers)-1]
+	case "sum", "avg":
+		for _, number := range numbers {
+			result += number
+		}
+		if value.Op == "avg" {
+			result /= float64(len(numbers))
+		}
+	}
+	return strconv.FormatFloat(result, 'f', -1, 64), nil
+}
+
+/////////
+// LLM as judge
+/////////
+
+// grades an answer against a rubric, returning the verdict and the reason for it
+type Judge func(ctx context.Context, rubric string, input string, answer string) (bool, string, error)
+
+const judgeSystem = `
+You are a strict grader of answers from a stock market data assistant.
+You are given a question, the assistant's answer and a rubric describing a correct answer.
+Decide if the answer meets the rubric, and respond with only a JSON object of the form:
+{"pass": true, "reason": "<one sentence>"}
+`
+
+// judge backed by the configured model provider
+func NewModelJudge(ctx context.Context) (Judge, func(), error) {
+	system := judgeSystem
+	// judgements must not be served from the answer cache
+	judge, err := agentassemble.InitAgent(ctx, &system, nil, nil, agentassemble.WithCache(nil))
+	if err != nil {
+		return nil, nil, err
+	}
+	grade := func(ctx context.Context, rubric string, input string, answer string) (bool, string, error) {
+		// each grading starts from an empty history
+		judge.NewSession()
+		response, err := judge.Ask(ctx, agentassemble.Request{
+			Input: "Question:\n" + input + "\n\nAnswer:\n" + answer + "\n\nRubric:\n" + rubric,
+		}, nil)
+		if err != nil {
+			return false, "", err
+		}
+		start, end := strings.Index(response.Content, "{"), strings.LastIndex(response.Content, "}")
+		if start < 0 || end < start {
+			return false, "", errors.New("judge reply is not a json object: " + response.Content)
+		}
+		var verdict struct {
+			Pass   bool   `json:"pass"`
+			Reason string `json:"reason"`
+		}
+		err = json.Unmarshal([]byte(response.Content[start:end+1]), &verdict)
+		if err != nil {
+			return false, "", errors.New("judge reply is not valid json: " + err.Error())
+		}
+		return verdict.Pass, verdict.Reason, nil
+	}
+	return grade, judge.Close, nil
+}
+
+// judge shared by the cases of a run, created on first use
+type grader struct {
+	judge      Judge
+	closeJudge func()
+	err        error
+}
+
+func (grader *grader) grade(ctx context.Context, rubric string, input string, answer string) (bool, string, error) {
+	if grader.judge == nil && grader.err == nil {
+		grader.judge, grader.closeJudge, grader.err = NewModelJudge(ctx)
+	}
+	if grader.err != nil {
+		return false, "", grader.err
+	}
+	return grader.judge(ctx, rubric, input, answer)
+}
+
+func (grader *grader) close() {
+	if grader.closeJudge != nil {
+		grader.closeJudge()
+	}
+}
@@ -0,0 +1,162 @@
+package agenteval
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	agentassemble "stock-agent/gemini-agent-assemble"
+)
+
+/////////
+// Eval reports
+/////////
+
+// results of a suite run, written as json so runs can be compared
+type Report struct {
+	Suite    string       `json:"suite"`
+	Endpoint string       `json:"endpoint"`
+	Started  time.Time    `json:"started"`
+	Summary  Summary      `json:"summary"`
+	Cases    []CaseResult `json:"cases"`
+}
+
+// totals over the cases
+type Summary struct {
+	Cases         int     `json:"cases"`
+	Passed        int     `json:"passed"`
+	Failed        int     `json:"failed"`
+	Errors        int     `json:"errors"`
+	PassRate      float64 `json:"passRate"`
+	MeanLatencyMs int64   `json:"meanLatencyMs"`
+	MaxLatencyMs  int64   `json:"maxLatencyMs"`
+	ToolCalls     int     `json:"toolCalls"`
+	TotalTokens   int32   `json:"totalTokens"`
+}
+
+// outcome of a case
+type CaseResult struct {
+	ID         string              `json:"id"`
+	Input      string              `json:"input"`
+	Answer     string              `json:"answer"`
+	Error      string              `json:"error,omitempty"`
+	Passed     bool                `json:"passed"`
+	Assertions []AssertionResult   `json:"assertions,omitempty"`
+	LatencyMs  int64               `json:"latencyMs"`
+	ToolCalls  []string            `json:"toolCalls"`
+	Usage      agentassemble.Usage `json:"usage"`
+	Cached     bool                `json:"cached,omitempty"`
+}
+
+func (report *Report) summarise() {
+	summary := Summary{Cases: len(report.Cases)}
+	var latency int64
+	for _, result := range report.Cases {
+		switch {
+		case result.Error != "":
+			summary.Errors++
+		case result.Passed:
+			summary.Passed++
+		default:
+			summary.Failed++
+		}
+		latency += result.LatencyMs
+		summary.MaxLatencyMs = max(summary.MaxLatencyMs, result.LatencyMs)
+		summary.ToolCalls += len(result.ToolCalls)
+		summary.TotalTokens += result.Usage.TotalTokens
+	}
+	if summary.Cases > 0 {
+		summary.PassRate = float64(summary.Passed) / float64(summary.Cases)
+		summary.MeanLatencyMs = latency / int64(summary.Cases)
+	}
+	report.Summary = summary
+}
+
+// write the report as indented json
+func (report *Report) Write(path string) error {
+	reportDat, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(reportDat, '\n'), 0644)
+}
+
+// read a report written by Write
+func LoadReport(path string) (*Report, error) {
+	reportDat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{}
+	err = json.Unmarshal(reportDat, report)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// one line summary of the report
+func (report *Report) String() string {
+	return fmt.Sprintf("%s: %d/%d passed (%d errors), mean latency %dms, %d tool calls, %d tokens",
+		report.Suite, report.Summary.Passed, report.Summary.Cases, report.Summary.Errors,
+		report.Summary.MeanLatencyMs, report.Summary.ToolCalls, report.Summary.TotalTokens)
+}
+
+func caseStatus(result CaseResult) string {
+	switch {
+	case result.Error != "":
+		return "error"
+	case result.Passed:
+		return "pass"
+	default:
+		return "fail"
+	}
+}
+
+// compare a run against a baseline run of the same suite
+// lists the totals, the cases that changed status and the per case latency, tool call and token changes
+func Compare(baseline *Report, current *Report) string {
+	var diff strings.Builder
+	fmt.Fprintf(&diff, "baseline %s\ncurrent  %s\n", baseline, current)
+	fmt.Fprintf(&diff, "pass rate %+.1f%%, mean latency %+dms, tool calls %+d, tokens %+d\n",
+		(current.Summary.PassRate-baseline.Summary.PassRate)*100,
+		current.Summary.MeanLatencyMs-baseline.Summary.MeanLatencyMs,
+		current.Summary.ToolCalls-baseline.Summary.ToolCalls,
+		current.Summary.TotalTokens-baseline.Summary.TotalTokens)
+
+	baselineCases := map[string]CaseResult{}
+	for _, result := range baseline.Cases {
+		baselineCases[result.ID] = result
+	}
+	currentIDs := map[string]bool{}
+	for _, result := range current.Cases {
+		currentIDs[result.ID] = true
+		before, exists := baselineCases[result.ID]
+		if !exists {
+			fmt.Fprintf(&diff, "%s: new case, %s\n", result.ID, caseStatus(result))
+			continue
+		}
+		change := caseStatus(before)
+		if caseStatus(before) != caseStatus(result) {
+			change += " -> " + caseStatus(result)
+		}
+		fmt.Fprintf(&diff, "%s: %s, latency %+dms, tool calls %+d, tokens %+d\n", result.ID, change,
+			result.LatencyMs-before.LatencyMs,
+			len(result.ToolCalls)-len(before.ToolCalls),
+			result.Usage.TotalTokens-before.Usage.TotalTokens)
+	}
+	var removed []string
+	for id := range baselineCases {
+		if !currentIDs[id] {
+			removed = append(removed, id)
+		}
+	}
+	sort.Strings(removed)
+	for _, id := range removed {
+		fmt.Fprintf(&diff, "%s: removed case\n", id)
+	}
+	return diff.String()
+}
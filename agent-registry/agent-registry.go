@@ -0,0 +1,340 @@
+package agentregistry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	agentassemble "stock-agent/gemini-agent-assemble"
+)
+
+/////////////////
+// agent registry
+
+// agent layer for the data specific agents
+const DataLayer = "data"
+
+// registrations not renewed within the ttl are dropped, so a crashed agent leaves the registry
+const defaultRegistrationTTL = 60 * time.Second
+
+// registration ttl from AGENT_REGISTRY_TTL_SECONDS, the default when unset or invalid
+func registrationTTL() time.Duration {
+	value, ok := os.LookupEnv("AGENT_REGISTRY_TTL_SECONDS")
+	if !ok {
+		return defaultRegistrationTTL
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		log.Println("invalid AGENT_REGISTRY_TTL_SECONDS " + value + ", using the default")
+		return defaultRegistrationTTL
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// an agent service entry in the registry
+type Registration struct {
+	Endpoint     string                     `json:"endpoint"`
+	Layer        string                     `json:"layer"`
+	Capabilities agentassemble.Capabilities `json:"capabilities"`
+	Registered   time.Time                  `json:"registered"`
+}
+
+// registry of agent services keyed by agent name
+type Registry struct {
+	mu      sync.RWMutex
+	entries map[string]Registration
+	ttl     time.Duration
+}
+
+func NewRegistry() *Registry {
+	return &Registry{entries: map[string]Registration{}, ttl: registrationTTL()}
+}
+
+// check if an entry has not been renewed within the ttl
+func (registry *Registry) expired(registration Registration, now time.Time) bool {
+	return now.Sub(registration.Registered) > registry.ttl
+}
+
+// add or replace an agent entry
+func (registry *Registry) Register(registration Registration) error {
+	if registration.Capabilities.Name == "" {
+		return errors.New("registration is missing the agent name")
+	}
+	if registration.Endpoint == "" {
+		return errors.New("registration is missing the endpoint for " + registration.Capabilities.Name)
+	}
+	registration.Registered = time.Now()
+	registry.mu.Lock()
+	previous, renewed := registry.entries[registration.Capabilities.Name]
+	renewed = renewed && previous.Endpoint == registration.Endpoint && !registry.expired(previous, registration.Registered)
+	registry.entries[registration.Capabilities.Name] = registration
+	// drop the expired entries
+	for name, entry := range registry.entries {
+		if registry.expired(entry, registration.Registered) {
+			log.Println("registration of agent " + name + " at " + entry.Endpoint + " expired")
+			delete(registry.entries, name)
+		}
+	}
+	registry.mu.Unlock()
+	if !renewed {
+		log.Println("registered agent " + registration.Capabilities.Name + " at " + registration.Endpoint)
+	}
+	return nil
+}
+
+// remove an agent entry
+func (registry *Registry) Deregister(name string) bool {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	_, exists := registry.entries[name]
+	delete(registry.entries, name)
+	return exists
+}
+
+// list the live entries for a layer (all layers when empty) sorted by name
+func (registry *Registry) List(layer string) []Registration {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	now := time.Now()
+	registrations := []Registration{}
+	for _, registration := range registry.entries {
+		if registry.expired(registration, now) {
+			continue
+		}
+		if layer == "" || registration.Layer == layer {
+			registrations = append(registrations, registration)
+		}
+	}
+	sort.Slice(registrations, func(i, j int) bool {
+		return registrations[i].Capabilities.Name < registrations[j].Capabilities.Name
+	})
+	return registrations
+}
+
+// registry request handler at /agents
+func (registry *Registry) HandleAgentsRequest(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(registry.List(req.URL.Query().Get("layer")))
+	case "POST":
+		// check for json mime type
+		contentType := req.Header.Get("Content-Type")
+		if contentType == "" || contentType != "application/json" {
+			http.Error(res, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		var registration Registration
+		err := json.NewDecoder(req.Body).Decode(&registration)
+		if err != nil {
+			http.Error(res, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		err = registry.Register(registration)
+		if err != nil {
+			http.Error(res, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		res.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+	}
+}
+
+// registry removal handler at /agents/{name}
+func (registry *Registry) HandleAgentRequest(res http.ResponseWriter, req *http.Request) {
+
+	// check for delete
+	if req.Method != "DELETE" {
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !registry.Deregister(req.PathValue("name")) {
+		http.Error(res, "Not Found", http.StatusNotFound)
+		return
+	}
+}
+
+// registry running handler at /running
+func (registry *Registry) HandleRunningRequest(res http.ResponseWriter, req *http.Request) {
+
+	// check for get
+	if req.Method != "GET" {
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	// return implicit 200 OK
+}
+
+// registry service at <hostname>:<port>/agents
+func (registry *Registry) RunRegistry(hostname string, port string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/agents", registry.HandleAgentsRequest)
+	mux.HandleFunc("/agents/{name}", registry.HandleAgentRequest)
+	mux.HandleFunc("/running", registry.HandleRunningRequest)
+	go http.ListenAndServe(hostname+":"+port, mux)
+	// ping the registry to make sure its ready
+	ready := false
+	for idx := 0; idx < 10 && !ready; idx++ {
+		res, err := http.Get("http://" + hostname + ":" + port + "/running")
+		if err == nil && res.StatusCode == 200 {
+			ready = true
+		}
+		// wait before next poll
+		time.Sleep(50 * time.Millisecond)
+	}
+	// check for falure
+	if !ready {
+		return errors.New("registry not running")
+	}
+	log.Println("registry running at: " + hostname + ":" + port)
+	return nil
+}
+
+//////////////////////////////////////////
+// client tools for agents to use
+
+// registry service url from the env vars, empty if not configured
+func registryURL() string {
+	hostname, ok := os.LookupEnv("AGENT_REGISTRY_HOSTNAME")
+	if !ok {
+		return ""
+	}
+	port, ok := os.LookupEnv("AGENT_REGISTRY_PORT")
+	if !ok {
+		return ""
+	}
+	return "http://" + hostname + ":" + port
+}
+
+// register an agent service with the registry service in the env vars
+func RegisterAgent(layer string, endpoint string, capabilities agentassemble.Capabilities) error {
+	url := registryURL()
+	if url == "" {
+		return errors.New("environment variables AGENT_REGISTRY_HOSTNAME and AGENT_REGISTRY_PORT not set")
+	}
+
+	// build the payload
+	registration := Registration{
+		Endpoint:     endpoint,
+		Layer:        layer,
+		Capabilities: capabilities,
+	}
+	regDat, err := json.Marshal(registration)
+	if err != nil {
+		return err
+	}
+
+	// send the post
+	resp, err := http.Post(url+"/agents", "application/json", bytes.NewBuffer(regDat))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return errors.New("registration of " + capabilities.Name + " failed: " + resp.Status)
+	}
+	return nil
+}
+
+// renew an agent registration until the context is done, well inside the registry ttl
+// also registers the agent again after a registry restart
+func KeepRegistered(ctx context.Context, layer string, endpoint string, capabilities agentassemble.Capabilities) {
+	ticker := time.NewTicker(registrationTTL() / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := RegisterAgent(layer, endpoint, capabilities)
+			if err != nil {
+				// try again on the next tick
+				log.Println("registration renewal error:", err)
+			}
+		}
+	}
+}
+
+// load the registrations from a static json file
+func loadRegistryFile(path string) ([]Registration, error) {
+	fileDat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var registrations []Registration
+	err = json.Unmarshal(fileDat, &registrations)
+	if err != nil {
+		return nil, errors.New("registry file " + path + ": " + err.Error())
+	}
+	return registrations, nil
+}
+
+// fetch the registrations from the registry service
+func fetchRegistrations(url string, layer string) ([]Registration, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url + "/agents?layer=" + layer)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("registry request failed: " + resp.Status)
+	}
+	var registrations []Registration
+	err = json.NewDecoder(resp.Body).Decode(&registrations)
+	if err != nil {
+		return nil, err
+	}
+	return registrations, nil
+}
+
+// find the remote agents for a layer
+// uses the static AGENT_REGISTRY_FILE when set, otherwise the registry service
+func Lookup(layer string) ([]*agentassemble.RemoteAgent, error) {
+	var registrations []Registration
+	var err error
+	if path, ok := os.LookupEnv("AGENT_REGISTRY_FILE"); ok {
+		registrations, err = loadRegistryFile(path)
+	} else if url := registryURL(); url != "" {
+		registrations, err = fetchRegistrations(url, layer)
+	} else {
+		err = errors.New("no agent registry configured, set AGENT_REGISTRY_FILE or AGENT_REGISTRY_HOSTNAME and AGENT_REGISTRY_PORT")
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	// build the clients, discovering any missing capabilities from the agent itself
+	var remotes []*agentassemble.RemoteAgent
+	for _, registration := range registrations {
+		if layer != "" && registration.Layer != layer {
+			continue
+		}
+		if registration.Capabilities.Name == "" {
+			remote, err := agentassemble.DiscoverAgent(registration.Endpoint)
+			if err != nil {
+				log.Println("skipping agent at "+registration.Endpoint+":", err)
+				continue
+			}
+			remotes = append(remotes, remote)
+			continue
+		}
+		remote, err := agentassemble.NewRemoteAgent(registration.Endpoint, registration.Capabilities)
+		if err != nil {
+			return nil, err
+		}
+		remotes = append(remotes, remote)
+	}
+	return remotes, nil
+}
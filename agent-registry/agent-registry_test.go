@@ -0,0 +1,55 @@
+package agentregistry
+
+import (
+	"testing"
+	"time"
+
+	agentassemble "stock-agent/gemini-agent-assemble"
+)
+
+func TestRegistrationExpiry(t *testing.T) {
+	registry := &Registry{entries: map[string]Registration{}, ttl: time.Minute}
+	for _, name := range []string{"databaseAgent", "quarterlyResultsAgent"} {
+		err := registry.Register(Registration{Endpoint: "http://localhost:3200", Layer: DataLayer, Capabilities: agentassemble.Capabilities{Name: name}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a registration not renewed within the ttl is not listed
+	registration := registry.entries["quarterlyResultsAgent"]
+	registration.Registered = time.Now().Add(-2 * time.Minute)
+	registry.entries["quarterlyResultsAgent"] = registration
+	registrations := registry.List(DataLayer)
+	if len(registrations) != 1 || registrations[0].Capabilities.Name != "databaseAgent" {
+		t.Errorf("registrations = %+v, want only databaseAgent", registrations)
+	}
+
+	// and is dropped on the next registration, while a renewal keeps it
+	err := registry.Register(Registration{Endpoint: "http://localhost:3200", Layer: DataLayer, Capabilities: agentassemble.Capabilities{Name: "databaseAgent"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := registry.entries["quarterlyResultsAgent"]; exists {
+		t.Error("expired registration kept")
+	}
+	if len(registry.List("")) != 1 {
+		t.Errorf("renewed registration dropped")
+	}
+}
+
+func TestRegistrationTTL(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"30", 30 * time.Second},
+		{"0", defaultRegistrationTTL},
+		{"soon", defaultRegistrationTTL},
+	} {
+		t.Setenv("AGENT_REGISTRY_TTL_SECONDS", test.value)
+		if got := registrationTTL(); got != test.want {
+			t.Errorf("registrationTTL(%s) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
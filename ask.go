@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	agentconfig "stock-agent/agent-config"
+	agentassemble "stock-agent/gemini-agent-assemble"
+)
+
+// send a question to an agent and print the answer
+func runAsk(args []string) error {
+	flags := flag.NewFlagSet("ask", flag.ContinueOnError)
+	agentName := flags.String("agent", "stockMarketInfoApp", "agent to ask: "+strings.Join(agentconfig.AgentNames(), ", "))
+	endpoint := flags.String("endpoint", "", "agent endpoint (http://<hostname>:<port>), overrides -agent")
+	transport := flags.String("transport", agentassemble.AgentTransport(), "http or grpc")
+	timeout := flags.Duration("timeout", agentassemble.AgentTimeout(), "request deadline")
+	mode := flags.String("mode", "", "react or plan, the agent default when empty")
+	stream := flags.Bool("stream", false, "print each tool step to stderr as it completes")
+	var attachments []agentassemble.Attachment
+	flags.Func("attach", "file to attach to the question, can be repeated", func(path string) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		attachments = append(attachments, agentassemble.Attachment{Name: filepath.Base(path), Data: data})
+		return nil
+	})
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: stock-agent ask [flags] <question>, or the question on stdin")
+		flags.PrintDefaults()
+	}
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	// the question from the args or stdin
+	question := strings.Join(flags.Args(), " ")
+	if question == "" || question == "-" {
+		input, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		question = strings.TrimSpace(string(input))
+	}
+	if question == "" {
+		return usageError{errors.New("missing question")}
+	}
+
+	if *endpoint == "" {
+		if _, known := agentconfig.Prefix(*agentName); !known {
+			return usageError{errors.New("unknown agent: " + *agentName)}
+		}
+		hostname, port, err := agentAddress(*agentName)
+		if err != nil {
+			return err
+		}
+		*endpoint = "http://" + hostname + ":" + port
+	}
+	client, err := agentassemble.NewAgentClient(*transport, *endpoint)
+	if err != nil {
+		return usageError{err}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	request := agentassemble.Request{Input: question, Attachments: attachments, Mode: *mode}
+	var response *agentassemble.Response
+	if *stream {
+		response, err = client.AskStream(ctx, request, printStep)
+	} else {
+		response, err = client.Ask(ctx, request)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(response.Content)
+	return nil
+}
+
+// report a tool step on stderr
+func printStep(step agentassemble.Step) {
+	argsDat, _ := json.Marshal(step.Args)
+	line := "[" + step.Tool + "] " + string(argsDat)
+	if step.PlanStep != "" {
+		line = "[" + step.PlanStep + "] " + line
+	}
+	switch {
+	case step.Error != "":
+		line += " error: " + step.Error
+	case step.Cached:
+		line += " (cached)"
+	}
+	fmt.Fprintf(os.Stderr, "%s %dms\n", line, step.DurationMs)
+}
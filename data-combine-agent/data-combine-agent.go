@@ -1,18 +1,17 @@
 package datacombineagent
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
-	"io"
 	"log"
-	"net/http"
 	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
 
-	databaseagent "stock-agent/database-agent"
+	agentregistry "stock-agent/agent-registry"
 	agentassemble "stock-agent/gemini-agent-assemble"
-	quarterlyresultsagent "stock-agent/quarterly-results-agent"
 
 	"github.com/google/generative-ai-go/genai"
 )
@@ -20,79 +19,142 @@ import (
 /////////////////
 // data combine agent
 
-// client agent tools descriptions from the agents
-var dataCombineTools = &genai.Tool{
-	FunctionDeclarations: []*genai.FunctionDeclaration{
-		quarterlyresultsagent.CallQuarterlyResultsAgentTool.FunctionDeclarations[0],
-		databaseagent.CallDatabaseAgentTool.FunctionDeclarations[0],
-	},
+// downstream data agents from the registry, keyed by tool name
+var dataAgentsMu sync.RWMutex
+var dataAgents = map[string]*agentassemble.RemoteAgent{}
+
+// default registry refresh interval
+const defaultRefreshSeconds = 60
+
+// build the toolset from the data agents in the registry
+func loadDataCombineTools() ([]*genai.Tool, error) {
+	remotes, err := agentregistry.Lookup(agentregistry.DataLayer)
+	if err != nil {
+		return nil, err
+	}
+
+	agents := map[string]*agentassemble.RemoteAgent{}
+	dataCombineTools := &genai.Tool{}
+	for _, remote := range remotes {
+		agents[remote.Declaration.Name] = remote
+		dataCombineTools.FunctionDeclarations = append(dataCombineTools.FunctionDeclarations, remote.Declaration)
+	}
+	dataAgentsMu.Lock()
+	dataAgents = agents
+	dataAgentsMu.Unlock()
+
+	if len(dataCombineTools.FunctionDeclarations) == 0 {
+		log.Println("no data agents in the registry")
+		return nil, nil
+	}
+	return []*genai.Tool{dataCombineTools}, nil
+}
+
+// reload the toolset from the registry until the context is done
+func refreshDataCombineTools(ctx context.Context, agent *agentassemble.Agent, current []*genai.Tool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tools, err := loadDataCombineTools()
+			if err != nil {
+				// keep the current toolset
+				log.Println("data agent refresh error:", err)
+				continue
+			}
+			// only swap the toolset when the registry changed
+			if reflect.DeepEqual(tools, current) {
+				continue
+			}
+			agent.SetTools(tools)
+			current = tools
+		}
+	}
 }
 
 // agent initialization
 func InitDataCombineAgent(ctx context.Context) (*agentassemble.Agent, error) {
 	system := `
 You are an AI agent that can process and answer requests on nasdaq companies.
-You have access to underlying agent tools that can perform the following actions:
-* Get the daily nasdaq stock market data for open, close, high, low.
-* Get a company quarterly results release with their financial data.
+You have access to underlying data agent tools, each tool description explains the data the agent can access and the actions it can perform.
 Based on the request, think about how to approach this problem, then act by performing necessary actions (like calling tools), and finally observe the results to refine your understanding and provide a final answer
 You can call the tools multiple times to get the answer to the request.
 You can call the same tool multiple times to get the answer to the request.
 When you know the final answer, you must start the response with the words 'Final Answer:'
 `
+	// build the toolset from the registry
+	tools, err := loadDataCombineTools()
+	if err != nil {
+		log.Println("Error loading the data agents")
+		return nil, err
+	}
+
 	// initialize the agent
-	var tools = []*genai.Tool{dataCombineTools}
-	agentDataCombine, err := agentassemble.InitAgent(ctx, &system, tools, callDataCombineTool)
+	agentDataCombine, err := agentassemble.InitAgent(ctx, &system, tools, callDataCombineTool, agentassemble.WithEnvSettings("DATA_COMBINE_AGENT"))
 	if err != nil {
-		log.Println("Error initializing the database agent")
+		log.Println("Error initializing the data combine agent")
 		return nil, err
 	}
 
+	// publish what the agent can do
+	agentDataCombine.SetCapabilities(agentassemble.Capabilities{
+		Name:        "dataCombineAgent",
+		Description: "Make a request to the data combine agent. The agent will process a complex compound query over nasdaq daily stock data and company quarterly results using the agents it can access and return the combined result.",
+		Examples: []string{
+			"Get Apple's close price for all of November 2024 and summarize the same years Q4 results",
+		},
+	})
+
+	// replies from the data agents are free text from outside the agent
+	agentDataCombine.SetDefaultToolPolicy(agentassemble.ToolPolicy{Untrusted: true})
+
+	// keep the toolset in step with the registry
+	refreshSeconds := defaultRefreshSeconds
+	if refresh, ok := os.LookupEnv("DATA_COMBINE_AGENT_REFRESH_SECONDS"); ok {
+		refreshSeconds, err = strconv.Atoi(refresh)
+		if err != nil || refreshSeconds <= 0 {
+			err := errors.New("invalid DATA_COMBINE_AGENT_REFRESH_SECONDS: " + refresh)
+			log.Println(err)
+			agentDataCombine.Close()
+			return nil, err
+		}
+	}
+	go refreshDataCombineTools(ctx, agentDataCombine, tools, time.Duration(refreshSeconds)*time.Second)
+
 	// always start a new session
 	agentDataCombine.NewSession()
 
-	return agentDataCombine, err
+	return agentDataCombine, nil
 }
 
 // tool call handler
-func callDataCombineTool(funcall genai.FunctionCall) (string, error) {
-	result := ""
-	var err error
-	// find the function to call - all tool calls come here
-	if funcall.Name == dataCombineTools.FunctionDeclarations[0].Name {
-		// check the params are populated
-		message, exists := funcall.Args["message"]
-		if !exists {
-			err := errors.New("missing arg: message")
-			log.Println(err)
-			return err.Error(), err
-		}
-		// call the query database tool
-		result, err = quarterlyresultsagent.CallQuarterlyResultsAgent(message.(string))
-		if err != nil {
-			log.Println("CallQuarterlyResultsAgent():", err)
-			return err.Error(), err
-		}
-		log.Println("call quarterly results result: " + result)
-	} else if funcall.Name == dataCombineTools.FunctionDeclarations[1].Name {
-		// check the params are populated
-		message, exists := funcall.Args["message"]
-		if !exists {
-			err := errors.New("missing arg: message")
-			log.Println(err)
-			return err.Error(), err
-		}
-		// call the query command
-		result, err = databaseagent.CallDatabaseAgent(message.(string))
-		if err != nil {
-			log.Println("CallDatabaseAgent():", err)
-			return err.Error(), err
-		}
-		log.Println("call database result: " + result)
-	} else {
+func callDataCombineTool(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+	// find the data agent to call - all tool calls come here
+	dataAgentsMu.RLock()
+	remote, exists := dataAgents[funcall.Name]
+	dataAgentsMu.RUnlock()
+	if !exists {
 		log.Println("unhandled function name: " + funcall.Name)
 		return "", errors.New("unhandled function name: " + funcall.Name)
 	}
+
+	// check the params are populated
+	message, ok := funcall.Args["message"].(string)
+	if !ok {
+		err := errors.New("missing arg: message")
+		log.Println(err)
+		return err.Error(), err
+	}
+	// call the data agent
+	result, err := remote.Call(ctx, message)
+	if err != nil {
+		log.Println(funcall.Name+"():", err)
+		return err.Error(), err
+	}
+	log.Println(funcall.Name + " result: " + result)
 	return result, nil
 }
 
@@ -118,7 +180,7 @@ var CallDataCombineAgentTool = &genai.Tool{
 }
 
 // client tool for the data combine agent
-func CallDataCombineAgent(message string) (string, error) {
+func CallDataCombineAgent(ctx context.Context, message string) (string, error) {
 	log.Println("running CallDataCombineAgent tool for :" + message)
 
 	// get the agent endpoint
@@ -135,40 +197,6 @@ func CallDataCombineAgent(message string) (string, error) {
 		return "", err
 	}
 
-	// build the payload
-	request := agentassemble.Request{
-		Input: message,
-	}
-	reqDat, err := json.Marshal(request)
-	if err != nil {
-		return "", err
-	}
-
-	// repare the request
-	req, err := http.NewRequest("POST", "http://"+hostname+":"+port+"/agent", bytes.NewBuffer(reqDat))
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	// send the post
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	// extract and decode the reply
-	response := agentassemble.Response{}
-	respDat, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	err = json.Unmarshal(respDat, &response)
-	if err != nil {
-		return "", err
-	}
-
-	return response.Content, nil
+	// send the request with the configured transport
+	return agentassemble.CallAgentEndpoint(ctx, "http://"+hostname+":"+port, message)
 }
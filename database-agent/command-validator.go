@@ -0,0 +1,205 @@
+package databaseagent
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/////////
+// Read-only command validation
+/////////
+
+// commands the model may run, all of them read only
+var readCommands = map[string]bool{
+	"find":            true,
+	"aggregate":       true,
+	"count":           true,
+	"distinct":        true,
+	"listCollections": true,
+	"collStats":       true,
+}
+
+// operators that write data or run server side javascript, anywhere in the command
+var forbiddenOperators = map[string]string{
+	"$out":         "writes the results to a collection",
+	"$merge":       "writes the results to a collection",
+	"$where":       "runs javascript on the server",
+	"$function":    "runs javascript on the server",
+	"$accumulator": "runs javascript on the server",
+}
+
+// run time and result caps of model commands
+const (
+	defaultCommandMaxTime    = 10 * time.Second
+	defaultCommandMaxResults = 1000
+)
+
+// caps applied to every command
+type commandLimits struct {
+	maxTime    time.Duration
+	maxResults int
+}
+
+// limits of the database agent, set by InitDatabaseAgent
+var databaseCommandLimits = commandLimits{maxTime: defaultCommandMaxTime, maxResults: defaultCommandMaxResults}
+
+// limits from MONGODB_COMMAND_MAX_TIME_MS and MONGODB_COMMAND_MAX_RESULTS
+func commandLimitsFromEnv() (commandLimits, error) {
+	limits := commandLimits{maxTime: defaultCommandMaxTime, maxResults: defaultCommandMaxResults}
+	maxTime, ok, err := envInt("MONGODB_COMMAND_MAX_TIME_MS")
+	if err != nil {
+		return limits, err
+	}
+	if ok && maxTime > 0 {
+		limits.maxTime = time.Duration(maxTime) * time.Millisecond
+	}
+	maxResults, ok, err := envInt("MONGODB_COMMAND_MAX_RESULTS")
+	if err != nil {
+		return limits, err
+	}
+	if ok && maxResults > 0 {
+		limits.maxResults = maxResults
+	}
+	return limits, nil
+}
+
+// names of the allowed commands, sorted for the rejection message
+func readCommandNames() string {
+	names := make([]string, 0, len(readCommands))
+	for name := range readCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// parse a model written command, as relaxed extended json so the {"$date": "2024-11-01T00:00:00Z"}
+// dates of the tool description are accepted as well as the canonical forms
+func parseCommand(command string) (bson.D, error) {
+	var commandBsonD bson.D
+	err := bson.UnmarshalExtJSON([]byte(command), false, &commandBsonD)
+	return commandBsonD, err
+}
+
+// check the command only reads, and cap its run time and results
+// the error explains the rejection to the model
+func validateCommand(command bson.D, limits commandLimits) (bson.D, error) {
+	if len(command) == 0 {
+		return nil, errors.New("the command is empty")
+	}
+	name := command[0].Key
+	if !readCommands[name] {
+		return nil, errors.New("the " + name + " command is not allowed, only the read commands " + readCommandNames() + " can be run")
+	}
+	for _, element := range command[1:] {
+		if strings.HasPrefix(element.Key, "$") {
+			return nil, errors.New("the " + element.Key + " field is not allowed")
+		}
+	}
+	err := checkOperators(command)
+	if err != nil {
+		return nil, err
+	}
+
+	// work on a copy, the caps replace larger values from the model
+	command = append(bson.D{}, command...)
+	maxTimeMS := int64(limits.maxTime / time.Millisecond)
+	maxResults := int64(limits.maxResults)
+	switch name {
+	case "find":
+		limit := capped(command, "limit", maxResults)
+		command = setField(command, "limit", limit)
+		// all the results in the first batch, without a cursor left open
+		command = setField(command, "batchSize", limit)
+		command = setField(command, "singleBatch", true)
+		command = setField(command, "maxTimeMS", capped(command, "maxTimeMS", maxTimeMS))
+	case "aggregate":
+		pipeline, ok := field(command, "pipeline").(bson.A)
+		if !ok {
+			return nil, errors.New("the aggregate command needs a pipeline array")
+		}
+		pipeline = append(append(bson.A{}, pipeline...), bson.D{{Key: "$limit", Value: maxResults}})
+		command = setField(command, "pipeline", pipeline)
+		command = setField(command, "cursor", bson.D{{Key: "batchSize", Value: maxResults}})
+		command = setField(command, "maxTimeMS", capped(command, "maxTimeMS", maxTimeMS))
+	case "count", "distinct":
+		command = setField(command, "maxTimeMS", capped(command, "maxTimeMS", maxTimeMS))
+	}
+	return command, nil
+}
+
+// reject the forbidden operators in any nested document or array
+func checkOperators(value interface{}) error {
+	switch value := value.(type) {
+	case bson.D:
+		for _, element := range value {
+			if reason, forbidden := forbiddenOperators[element.Key]; forbidden {
+				return errors.New("the " + element.Key + " operator is not allowed as it " + reason)
+			}
+			err := checkOperators(element.Value)
+			if err != nil {
+				return err
+			}
+		}
+	case bson.M:
+		for key, element := range value {
+			if reason, forbidden := forbiddenOperators[key]; forbidden {
+				return errors.New("the " + key + " operator is not allowed as it " + reason)
+			}
+			err := checkOperators(element)
+			if err != nil {
+				return err
+			}
+		}
+	case bson.A:
+		for _, element := range value {
+			err := checkOperators(element)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// value of a command field, nil when missing
+func field(command bson.D, key string) interface{} {
+	for _, element := range command {
+		if element.Key == key {
+			return element.Value
+		}
+	}
+	return nil
+}
+
+// replace or add a command field
+func setField(command bson.D, key string, value interface{}) bson.D {
+	for idx, element := range command {
+		if element.Key == key {
+			command[idx].Value = value
+			return command
+		}
+	}
+	return append(command, bson.E{Key: key, Value: value})
+}
+
+// the number in the field when positive and under the cap, else the cap
+func capped(command bson.D, key string, max int64) int64 {
+	var number int64
+	switch value := field(command, key).(type) {
+	case int32:
+		number = int64(value)
+	case int64:
+		number = value
+	case float64:
+		number = int64(value)
+	}
+	if number <= 0 || number > max {
+		return max
+	}
+	return number
+}
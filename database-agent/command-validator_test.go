@@ -0,0 +1,188 @@
+package databaseagent
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// the date filter of a command as a time
+func filterDate(t *testing.T, command bson.D, operator string) time.Time {
+	t.Helper()
+	filter, ok := field(command, "filter").(bson.D)
+	if !ok {
+		t.Fatalf("filter = %v, want a document", field(command, "filter"))
+	}
+	date, ok := field(filter, "date").(bson.D)
+	if !ok {
+		t.Fatalf("date = %v, want a document", field(filter, "date"))
+	}
+	value, ok := field(date, operator).(primitive.DateTime)
+	if !ok {
+		t.Fatalf("%s = %#v, want a bson date", operator, field(date, operator))
+	}
+	return value.Time().UTC()
+}
+
+func TestParseCommandDates(t *testing.T) {
+	want := time.Date(2024, time.November, 1, 0, 0, 0, 0, time.UTC)
+	// the date form of the commandQueryDatabase description, and the canonical form
+	for _, command := range []string{
+		`{"find": "aapl", "filter": {"date": {"$gte": {"$date": "2024-11-01T00:00:00Z"}}}}`,
+		`{"find": "aapl", "filter": {"date": {"$gte": {"$date": {"$numberLong": "1730419200000"}}}}}`,
+	} {
+		parsed, err := parseCommand(command)
+		if err != nil {
+			t.Fatalf("parseCommand(%s): %v", command, err)
+		}
+		if date := filterDate(t, parsed, "$gte"); !date.Equal(want) {
+			t.Errorf("parseCommand(%s) date = %v, want %v", command, date, want)
+		}
+	}
+}
+
+func TestParseCommandValidates(t *testing.T) {
+	parsed, err := parseCommand(`{"find": "aapl", "filter": {"date": {"$lt": {"$date": "2024-12-01T00:00:00Z"}}}, "limit": 5}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := commandLimits{maxTime: 10 * time.Second, maxResults: 100}
+	validated, err := validateCommand(parsed, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit := field(validated, "limit"); limit != int64(5) {
+		t.Errorf("limit = %#v, want 5", limit)
+	}
+	if date := filterDate(t, validated, "$lt"); !date.Equal(time.Date(2024, time.December, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("date = %v, want 2024-12-01", date)
+	}
+
+	if _, err := parseCommand(`{"find": "aapl", "filter": {"date": {"$date": "not a date"}}}`); err == nil {
+		t.Error("parseCommand accepted an invalid date")
+	}
+}
+
+// parse and validate a command with 100 results and 10 seconds caps
+func validate(t *testing.T, command string) (bson.D, error) {
+	t.Helper()
+	parsed, err := parseCommand(command)
+	if err != nil {
+		t.Fatalf("parseCommand(%s): %v", command, err)
+	}
+	return validateCommand(parsed, commandLimits{maxTime: 10 * time.Second, maxResults: 100})
+}
+
+func TestValidateCommandRejects(t *testing.T) {
+	for _, test := range []struct {
+		command string
+		want    string
+	}{
+		// commands outside the allowlist
+		{`{"dropDatabase": 1}`, "dropDatabase command is not allowed"},
+		{`{"delete": "aapl", "deletes": [{"q": {}, "limit": 0}]}`, "delete command is not allowed"},
+		{`{"insert": "aapl", "documents": [{"close": 1}]}`, "insert command is not allowed"},
+		{`{"update": "aapl", "updates": [{"q": {}, "u": {"$set": {"close": 0}}}]}`, "update command is not allowed"},
+		{`{"findAndModify": "aapl", "query": {}, "remove": true}`, "findAndModify command is not allowed"},
+		{`{}`, "empty"},
+		// top level operators
+		{`{"find": "aapl", "$db": "admin"}`, "$db field is not allowed"},
+		// writes and javascript at the top of a pipeline
+		{`{"aggregate": "aapl", "pipeline": [{"$out": "copy"}], "cursor": {}}`, "$out operator"},
+		{`{"aggregate": "aapl", "pipeline": [{"$merge": {"into": "copy"}}], "cursor": {}}`, "$merge operator"},
+		// nested in lookup and facet sub-pipelines
+		{`{"aggregate": "aapl", "pipeline": [{"$lookup": {"from": "msft", "as": "m", "pipeline": [{"$out": "copy"}]}}], "cursor": {}}`, "$out operator"},
+		{`{"aggregate": "aapl", "pipeline": [{"$lookup": {"from": "msft", "as": "m", "pipeline": [{"$match": {"$expr": {"$function": {"body": "return true", "args": [], "lang": "js"}}}}]}}], "cursor": {}}`, "$function operator"},
+		{`{"aggregate": "aapl", "pipeline": [{"$facet": {"a": [{"$match": {}}], "b": [{"$merge": {"into": "copy"}}]}}], "cursor": {}}`, "$merge operator"},
+		{`{"aggregate": "aapl", "pipeline": [{"$facet": {"totals": [{"$group": {"_id": null, "sum": {"$accumulator": {"init": "function() {}", "accumulate": "function() {}", "accumulateArgs": [], "merge": "function() {}", "lang": "js"}}}}]}}], "cursor": {}}`, "$accumulator operator"},
+		// and in filter expressions
+		{`{"find": "aapl", "filter": {"$where": "this.close > 100"}}`, "$where operator"},
+		{`{"find": "aapl", "filter": {"$or": [{"close": {"$gt": 1}}, {"$where": "sleep(1000)"}]}}`, "$where operator"},
+		{`{"count": "aapl", "query": {"$expr": {"$function": {"body": "return true", "args": [], "lang": "js"}}}}`, "$function operator"},
+		{`{"distinct": "aapl", "key": "close", "query": {"$and": [{"$where": "true"}]}}`, "$where operator"},
+		{`{"aggregate": "aapl", "pipeline": {"$match": {}}}`, "needs a pipeline array"},
+	} {
+		_, err := validate(t, test.command)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("validate(%s) err = %v, want %q", test.command, err, test.want)
+		}
+	}
+}
+
+func TestValidateCommandFindCaps(t *testing.T) {
+	for _, test := range []struct {
+		command   string
+		limit     int64
+		maxTimeMS int64
+	}{
+		// missing values get the caps
+		{`{"find": "aapl"}`, 100, 10000},
+		// smaller values are kept
+		{`{"find": "aapl", "limit": 5, "maxTimeMS": 2000}`, 5, 2000},
+		{`{"find": "aapl", "limit": {"$numberLong": "7"}, "maxTimeMS": 2500.0}`, 7, 2500},
+		// larger, zero and negative values are capped
+		{`{"find": "aapl", "limit": 100000, "maxTimeMS": 600000}`, 100, 10000},
+		{`{"find": "aapl", "limit": 0, "maxTimeMS": 0}`, 100, 10000},
+		{`{"find": "aapl", "limit": -5, "batchSize": 100000}`, 100, 10000},
+	} {
+		validated, err := validate(t, test.command)
+		if err != nil {
+			t.Fatalf("validate(%s): %v", test.command, err)
+		}
+		if limit := field(validated, "limit"); limit != test.limit {
+			t.Errorf("validate(%s) limit = %#v, want %d", test.command, limit, test.limit)
+		}
+		// all the results in one batch, without a cursor left open
+		if batchSize := field(validated, "batchSize"); batchSize != test.limit {
+			t.Errorf("validate(%s) batchSize = %#v, want %d", test.command, batchSize, test.limit)
+		}
+		if singleBatch := field(validated, "singleBatch"); singleBatch != true {
+			t.Errorf("validate(%s) singleBatch = %#v, want true", test.command, singleBatch)
+		}
+		if maxTimeMS := field(validated, "maxTimeMS"); maxTimeMS != test.maxTimeMS {
+			t.Errorf("validate(%s) maxTimeMS = %#v, want %d", test.command, maxTimeMS, test.maxTimeMS)
+		}
+	}
+}
+
+func TestValidateCommandAggregateLimit(t *testing.T) {
+	parsed, err := parseCommand(`{"aggregate": "aapl", "pipeline": [{"$match": {"close": {"$gt": 100}}}, {"$limit": 100000}], "cursor": {"batchSize": 100000}, "maxTimeMS": 600000}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validated, err := validateCommand(parsed, commandLimits{maxTime: 10 * time.Second, maxResults: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, ok := field(validated, "pipeline").(bson.A)
+	if !ok || len(pipeline) != 3 {
+		t.Fatalf("pipeline = %v, want the two stages and the limit", field(validated, "pipeline"))
+	}
+	// the cap is the last stage, so the model stages can't raise it
+	if last := pipeline[2]; !reflect.DeepEqual(last, bson.D{{Key: "$limit", Value: int64(100)}}) {
+		t.Errorf("last stage = %v, want {$limit: 100}", last)
+	}
+	if cursor := field(validated, "cursor"); !reflect.DeepEqual(cursor, bson.D{{Key: "batchSize", Value: int64(100)}}) {
+		t.Errorf("cursor = %v, want a batchSize of 100", cursor)
+	}
+	if maxTimeMS := field(validated, "maxTimeMS"); maxTimeMS != int64(10000) {
+		t.Errorf("maxTimeMS = %#v, want 10000", maxTimeMS)
+	}
+	// the parsed command is left as it was
+	if original := field(parsed, "pipeline").(bson.A); len(original) != 2 {
+		t.Errorf("parsed pipeline changed to %v", original)
+	}
+
+	// count and distinct only get the time cap
+	validated, err = validate(t, `{"count": "aapl", "query": {}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxTimeMS := field(validated, "maxTimeMS"); maxTimeMS != int64(10000) || field(validated, "limit") != nil {
+		t.Errorf("count = %v, want only maxTimeMS 10000 added", validated)
+	}
+}
@@ -1,32 +1,22 @@
 package databaseagent
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
-	"io"
 	"log"
-	"net/http"
 	"os"
+	"strings"
 
 	agentassemble "stock-agent/gemini-agent-assemble"
+	stockdata "stock-agent/stock-data"
+	tickersymbols "stock-agent/ticker-symbols"
 
 	"github.com/google/generative-ai-go/genai"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// database schema for each ticker collection
-type tickerLine struct {
-	Date  string `bson:"date" json:"date"`
-	Open  string `bson:"open" json:"open"`
-	High  string `bson:"high" json:"high"`
-	Low   string `bson:"low" json:"low"`
-	Close string `bson:"close" json:"close"`
-}
-
 /////////////////
 // database agent
 
@@ -57,7 +47,7 @@ var databaseTools = &genai.Tool{
 	},
 		{
 			Name:        "commandQueryDatabase",
-			Description: "Run the supplied MongoDB command on the nasdaq database. The command MUST be a valid MongoDB JSON command",
+			Description: "Run the supplied MongoDB read command on the nasdaq database. Dates are BSON dates, written as {\"$date\": \"2024-11-01T00:00:00Z\"}, and prices are doubles. The command MUST be a valid MongoDB extended JSON command, and one of find, aggregate (without $out or $merge), count, distinct, listCollections or collStats. Results are limited, use a narrow filter or an aggregation for large ranges",
 			Parameters: &genai.Schema{
 				Type: genai.TypeObject,
 				Properties: map[string]*genai.Schema{
@@ -69,47 +59,30 @@ var databaseTools = &genai.Tool{
 				Required: []string{"command"},
 			},
 		},
+		priceStatisticsDeclaration,
+		technicalIndicatorsDeclaration,
+		resamplePricesDeclaration,
+		tickersymbols.ResolveTickerDeclaration,
 	},
 }
 
 // specific data range query database tool
-func queryDatabase(ticker string, startDate string, endDate string) string {
+func queryDatabase(ctx context.Context, ticker string, startDate string, endDate string) string {
 	log.Println("running queryDatabase tool for " + ticker + " with date range " + startDate + " - " + endDate)
 
-	// connect a client to the database
-	mongodbUri, exists := os.LookupEnv("MONGODB_URI")
-	if !exists {
-		log.Println("missing datbase URI in env vars")
-		return "missing datbase URI in env vars, cannot continue"
-	}
-	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(mongodbUri))
-	if err != nil {
-		log.Println("mongo connect() error:", err)
-		return "mongo connect() error:" + err.Error()
-	}
-	defer client.Disconnect(context.TODO())
-
-	// get the collection
-	coll := client.Database("nasdaq").Collection(ticker)
-	if coll == nil {
-		log.Println("empty collection for ticker: " + ticker)
-		return "empty collection for ticker: " + ticker + ", cannot continue"
-	}
-
-	// prep the filter and find
-	filter := bson.D{{"date", bson.D{{"$gte", startDate}, {"$lte", endDate}}}}
-	cursor, err := coll.Find(context.TODO(), filter)
+	// typed lines in date order
+	var results []stockdata.TickerLine
+	err := databasePool.run(ctx, "nasdaq", func(ctx context.Context, db *mongo.Database) error {
+		var err error
+		results, err = stockdata.FindLines(ctx, db.Collection(ticker), startDate, endDate)
+		return err
+	})
 	if err != nil {
-		log.Println("coll.Find() error:", err)
-		return "coll.Find() error:" + err.Error()
+		log.Println("query error:", err)
+		return "query error:" + err.Error()
 	}
 
-	// unpack the cursor into a slice and then a string
-	var results []tickerLine
-	if err = cursor.All(context.TODO(), &results); err != nil {
-		log.Println("cursor.All() error:", err)
-		return "cursor.All() error:" + err.Error()
-	}
+	// convert to a string
 	resultsStr, err := json.Marshal(results)
 	if err != nil {
 		log.Println("json.Marshal() error:", err)
@@ -120,40 +93,28 @@ func queryDatabase(ticker string, startDate string, endDate string) string {
 }
 
 // open command query query database tool
-func commandQueryDatabase(command string) string {
+func commandQueryDatabase(ctx context.Context, command string) string {
 	log.Println("running commandQueryDatabase tool for " + command)
 
-	// connect a client to the database
-	mongodbUri, exists := os.LookupEnv("MONGODB_URI")
-	if !exists {
-		log.Println("missing datbase URI in env vars")
-		return "missing datbase URI in env vars, cannot continue"
-	}
-	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(mongodbUri))
-	if err != nil {
-		log.Println("mongo connect() error:", err)
-		return "mongo connect() error:" + err.Error()
-	}
-	defer client.Disconnect(context.TODO())
-
-	// get the nasdaq db
-	db := client.Database("nasdaq")
-	if db == nil {
-		log.Println("empty database")
-		return "empty database, cannot continue"
-	}
-
 	// convert to bson
-	var commandBsonD interface{}
-	commandDat := []byte(command)
-	err = bson.UnmarshalExtJSON(commandDat, true, &commandBsonD)
+	commandBsonD, err := parseCommand(command)
 	if err != nil {
 		log.Println("bson.UnmarshalExtJSON error:", err)
 		return "bson.UnmarshalExtJSON error:" + err.Error()
 	}
-	var result bson.D
+
+	// only read commands, capped in time and results, the model can fix a rejected command
+	commandBsonD, err = validateCommand(commandBsonD, databaseCommandLimits)
+	if err != nil {
+		log.Println("command rejected:", err)
+		return "command rejected: " + err.Error()
+	}
+
 	// run the command
-	err = db.RunCommand(context.TODO(), commandBsonD).Decode(&result)
+	var result bson.D
+	err = commandPool.run(ctx, "nasdaq", func(ctx context.Context, db *mongo.Database) error {
+		return db.RunCommand(ctx, commandBsonD).Decode(&result)
+	})
 	if err != nil {
 		log.Println("runcommand error:", err)
 		return "runcommand error:" + err.Error()
@@ -181,19 +142,78 @@ func InitDatabaseAgent(ctx context.Context) (*agentassemble.Agent, error) {
 	system := `
 You are an AI agent that can perform MongoDB database queries.
 You have access to the underlying database through the query and command tools.
-The database contains daily nasdaq stock market data.
+The database contains daily nasdaq stock market data, in a collection per lower case ticker.
+Each document has a date (a BSON date at midnight UTC), the open, high, low and close prices (doubles) and the volume (a long, when known).
 You must use the tools to help answer the request and retrun the result.
+Use the resolveTicker tool to find the ticker of a company named in the request rather than guessing it. When the result is ambiguous, pick the candidate the request means or say which candidates there are.
+Use the priceStatistics tool for highest, lowest, average, median and change questions rather than fetching and reading the daily rows.
+Use the technicalIndicators tool for moving averages, rsi, macd, bollinger bands, atr and volatility rather than computing them from the daily rows.
+Use the resamplePrices tool for weekly, monthly, quarterly or yearly prices over long ranges rather than fetching the daily rows.
 You can call the tools multiple times to get the answer to the request.
 You can call the same tool multiple times to get the answer to the request.
 When you know the final answer, you must start the response with the words 'Final Answer:'
 `
+	// limits of the model written commands
+	var err error
+	databaseCommandLimits, err = commandLimitsFromEnv()
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	// connect the shared database client with the pool settings
+	err = databasePool.open(ctx)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	// model written commands run as the read-only user when there is one
+	commandPool = databasePool
+	if _, ok := os.LookupEnv("MONGODB_READONLY_URI"); ok {
+		commandPool = &mongoPool{uriKey: "MONGODB_READONLY_URI", queryTimeout: defaultQueryTimeout}
+		err = commandPool.open(ctx)
+		if err != nil {
+			log.Println(err)
+			databasePool.close()
+			return nil, err
+		}
+	}
+
 	// initialize the agent
 	var tools = []*genai.Tool{databaseTools}
-	agentDatabase, err := agentassemble.InitAgent(ctx, &system, tools, callDatabaseTool)
+	agentDatabase, err := agentassemble.InitAgent(ctx, &system, tools, callDatabaseTool, agentassemble.WithEnvSettings("DATABASE_AGENT"), agentassemble.WithDataVersion(currentDataVersion))
 	if err != nil {
 		log.Println("Error initializing the database agent")
+		databasePool.close()
+		commandPool.close()
 		return nil, err
 	}
+	agentDatabase.OnClose(databasePool.close)
+	agentDatabase.OnClose(commandPool.close)
+
+	// the symbols are read with the pooled client
+	tickersymbols.SetMongoClient(databasePool.get)
+	agentDatabase.OnClose(func() { tickersymbols.SetMongoClient(nil) })
+
+	// publish what the agent can do
+	agentDatabase.SetCapabilities(agentassemble.Capabilities{
+		Name:        "databaseAgent",
+		Description: "Make a request to the database agent. The agent will perform the requested query over the daily nasdaq stock market data (open, close, high, low) and return the result.",
+		Examples: []string{
+			"what was Apple's highest close price in November 2024",
+			"how many collections are there",
+		},
+	})
+
+	// price queries only change when the database is reloaded
+	agentDatabase.SetToolPolicy(databaseTools.FunctionDeclarations[0].Name, agentassemble.ToolPolicy{Cacheable: true})
+	agentDatabase.SetToolPolicy(databaseTools.FunctionDeclarations[2].Name, agentassemble.ToolPolicy{Cacheable: true})
+	agentDatabase.SetToolPolicy(databaseTools.FunctionDeclarations[3].Name, agentassemble.ToolPolicy{Cacheable: true})
+	agentDatabase.SetToolPolicy(databaseTools.FunctionDeclarations[4].Name, agentassemble.ToolPolicy{Cacheable: true})
+	agentDatabase.SetToolPolicy(databaseTools.FunctionDeclarations[5].Name, agentassemble.ToolPolicy{Cacheable: true, CacheTTL: tickersymbols.SymbolsTTL})
+
+	// raw database commands written by the model need a human approval
+	agentDatabase.SetToolPolicy(databaseTools.FunctionDeclarations[1].Name, agentassemble.ToolPolicy{Risk: agentassemble.RiskHigh, Cacheable: true})
 
 	// always start a new session
 	agentDatabase.NewSession()
@@ -202,42 +222,71 @@ When you know the final answer, you must start the response with the words 'Fina
 }
 
 // tool call handler
-func callDatabaseTool(funcall genai.FunctionCall) (string, error) {
+func callDatabaseTool(ctx context.Context, funcall genai.FunctionCall) (string, error) {
 
 	result := ""
 	// find the function to call - all tool calls come here
 	if funcall.Name == databaseTools.FunctionDeclarations[0].Name {
 		// check the params are populated
-		ticker, exists := funcall.Args["ticker"]
+		ticker, exists := funcall.Args["ticker"].(string)
 		if !exists {
 			err := errors.New("missing arg: ticker")
 			log.Println(err)
 			return err.Error(), err
 		}
-		startDate, exists := funcall.Args["startDate"]
+		startDate, exists := funcall.Args["startDate"].(string)
 		if !exists {
 			err := errors.New("missing arg: start date")
 			log.Println(err)
 			return err.Error(), err
 		}
-		endDate, exists := funcall.Args["endDate"]
+		endDate, exists := funcall.Args["endDate"].(string)
 		if !exists {
 			err := errors.New("missing arg: end date")
 			log.Println(err)
 			return err.Error(), err
 		}
 		// call the query database tool
-		result = queryDatabase(ticker.(string), startDate.(string), endDate.(string))
+		result = queryDatabase(ctx, ticker, startDate, endDate)
+		// failures come back as plain text, only cache the json results
+		if !json.Valid([]byte(result)) {
+			agentassemble.SkipCache(ctx)
+		}
 		log.Println("query database result: " + result)
 	} else if funcall.Name == databaseTools.FunctionDeclarations[1].Name {
 		// check the params are populated
-		command, exists := funcall.Args["command"]
+		command, exists := funcall.Args["command"].(string)
 		if !exists {
-			log.Fatalln("Missing command")
+			err := errors.New("missing arg: command")
+			log.Println(err)
+			return err.Error(), err
 		}
 		// call the query command
-		result = commandQueryDatabase(command.(string))
+		result = commandQueryDatabase(ctx, command)
 		log.Println("command query database result: " + result)
+	} else if funcall.Name == databaseTools.FunctionDeclarations[2].Name {
+		result, err := callPriceStatistics(ctx, funcall)
+		if err != nil {
+			return result, err
+		}
+		log.Println("price statistics result: " + result)
+		return result, nil
+	} else if funcall.Name == databaseTools.FunctionDeclarations[3].Name {
+		result, err := callTechnicalIndicators(ctx, funcall)
+		if err != nil {
+			return result, err
+		}
+		log.Println("technical indicators result: " + result)
+		return result, nil
+	} else if funcall.Name == databaseTools.FunctionDeclarations[4].Name {
+		result, err := callResamplePrices(ctx, funcall)
+		if err != nil {
+			return result, err
+		}
+		log.Println("resample prices result: " + result)
+		return result, nil
+	} else if funcall.Name == databaseTools.FunctionDeclarations[5].Name {
+		return tickersymbols.CallResolveTicker(ctx, funcall)
 	} else {
 		log.Println("unhandled function name: " + funcall.Name)
 		return "", errors.New("unhandled function name: " + funcall.Name)
@@ -245,6 +294,41 @@ func callDatabaseTool(funcall genai.FunctionCall) (string, error) {
 	return result, nil
 }
 
+// json reply of an analysis tool, an error goes back to the model as text so it can fix
+// the args, and is kept out of the cache
+func toolReply(ctx context.Context, tool string, value interface{}, err error) (string, error) {
+	if err != nil {
+		log.Println(tool+" error:", err)
+		agentassemble.SkipCache(ctx)
+		return tool + " error: " + err.Error(), nil
+	}
+	valueDat, err := json.Marshal(value)
+	if err != nil {
+		log.Println("json.Marshal() error:", err)
+		return "", err
+	}
+	return string(valueDat), nil
+}
+
+// an integer arg, json numbers arrive as floats
+func intArg(funcall genai.FunctionCall, name string) (int, bool) {
+	value, ok := funcall.Args[name].(float64)
+	return int(value), ok
+}
+
+// the strings of an array arg in lower case
+func lowerStringsArg(funcall genai.FunctionCall, name string) []string {
+	var values []string
+	if items, ok := funcall.Args[name].([]interface{}); ok {
+		for _, item := range items {
+			if value, ok := item.(string); ok {
+				values = append(values, strings.ToLower(value))
+			}
+		}
+	}
+	return values
+}
+
 //////////////////////////////////////////
 // client tools for external agents to use
 
@@ -267,7 +351,7 @@ var CallDatabaseAgentTool = &genai.Tool{
 }
 
 // client tool for the database agent
-func CallDatabaseAgent(message string) (string, error) {
+func CallDatabaseAgent(ctx context.Context, message string) (string, error) {
 	log.Println("running CallDatabaseAgent tool for :" + message)
 
 	// get the agent endpoint
@@ -284,40 +368,6 @@ func CallDatabaseAgent(message string) (string, error) {
 		return "", err
 	}
 
-	// build the payload
-	request := agentassemble.Request{
-		Input: message,
-	}
-	reqDat, err := json.Marshal(request)
-	if err != nil {
-		return "", err
-	}
-
-	// repare the request
-	req, err := http.NewRequest("POST", "http://"+hostname+":"+port+"/agent", bytes.NewBuffer(reqDat))
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	// send the post
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	// extract and decode the reply
-	response := agentassemble.Response{}
-	respDat, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	err = json.Unmarshal(respDat, &response)
-	if err != nil {
-		return "", err
-	}
-
-	return response.Content, nil
+	// send the request with the configured transport
+	return agentassemble.CallAgentEndpoint(ctx, "http://"+hostname+":"+port, message)
 }
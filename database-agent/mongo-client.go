@@ -0,0 +1,236 @@
+package databaseagent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	agentcache "stock-agent/agent-cache"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+/////////
+// Shared MongoDB client
+/////////
+
+// default deadline of a tool query
+const defaultQueryTimeout = 30 * time.Second
+
+// long-lived client shared by the tool calls, the driver pools the connections
+// and reconnects to the servers by itself
+type mongoPool struct {
+	// env var of the connection uri
+	uriKey       string
+	mu           sync.Mutex
+	client       *mongo.Client
+	options      *options.ClientOptions
+	queryTimeout time.Duration
+}
+
+// the database agent pool, opened by InitDatabaseAgent
+var databasePool = &mongoPool{uriKey: "MONGODB_URI", queryTimeout: defaultQueryTimeout}
+
+// pool of the model written commands, a read-only user when MONGODB_READONLY_URI is set
+var commandPool = databasePool
+
+// positive whole number env var, ok is false when not set
+func envInt(key string) (int, bool, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return 0, false, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return 0, false, errors.New("invalid " + key + ": " + value)
+	}
+	return number, true, nil
+}
+
+// client options from the uri and MONGODB_* env vars, unset values keep the uri and driver defaults
+func mongoOptionsFromEnv(uriKey string) (*options.ClientOptions, time.Duration, error) {
+	mongodbUri, exists := os.LookupEnv(uriKey)
+	if !exists {
+		return nil, 0, errors.New("missing " + uriKey + " in env vars")
+	}
+	clientOptions := options.Client().ApplyURI(mongodbUri).SetRetryReads(true)
+
+	maxPoolSize, ok, err := envInt("MONGODB_MAX_POOL_SIZE")
+	if err != nil {
+		return nil, 0, err
+	}
+	if ok {
+		clientOptions.SetMaxPoolSize(uint64(maxPoolSize))
+	}
+	minPoolSize, ok, err := envInt("MONGODB_MIN_POOL_SIZE")
+	if err != nil {
+		return nil, 0, err
+	}
+	if ok {
+		clientOptions.SetMinPoolSize(uint64(minPoolSize))
+	}
+	connectTimeout, ok, err := envInt("MONGODB_CONNECT_TIMEOUT_SECONDS")
+	if err != nil {
+		return nil, 0, err
+	}
+	if ok {
+		// also bounds the wait for a reachable server when reconnecting
+		clientOptions.SetConnectTimeout(time.Duration(connectTimeout) * time.Second)
+		clientOptions.SetServerSelectionTimeout(time.Duration(connectTimeout) * time.Second)
+	}
+	queryTimeout := defaultQueryTimeout
+	querySeconds, ok, err := envInt("MONGODB_QUERY_TIMEOUT_SECONDS")
+	if err != nil {
+		return nil, 0, err
+	}
+	if ok {
+		queryTimeout = time.Duration(querySeconds) * time.Second
+	}
+	if mode, ok := os.LookupEnv("MONGODB_READ_PREFERENCE"); ok {
+		readMode, err := readpref.ModeFromString(mode)
+		if err != nil {
+			return nil, 0, errors.New("invalid MONGODB_READ_PREFERENCE: " + mode)
+		}
+		readPreference, err := readpref.New(readMode)
+		if err != nil {
+			return nil, 0, err
+		}
+		clientOptions.SetReadPreference(readPreference)
+	}
+
+	err = clientOptions.Validate()
+	if err != nil {
+		return nil, 0, err
+	}
+	return clientOptions, queryTimeout, nil
+}
+
+// configure and connect the pool, an unreachable server is reported but not fatal
+// as the driver connects once it is back
+func (pool *mongoPool) open(ctx context.Context) error {
+	clientOptions, queryTimeout, err := mongoOptionsFromEnv(pool.uriKey)
+	if err != nil {
+		return err
+	}
+	pool.mu.Lock()
+	pool.options = clientOptions
+	pool.queryTimeout = queryTimeout
+	pool.mu.Unlock()
+
+	client, err := pool.get()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, pool.queryTimeout)
+	defer cancel()
+	err = client.Ping(ctx, nil)
+	if err != nil {
+		log.Println("mongo ping error, continuing:", err)
+	}
+	return nil
+}
+
+// the shared client, connected on first use and again after a close
+func (pool *mongoPool) get() (*mongo.Client, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.client != nil {
+		return pool.client, nil
+	}
+	if pool.options == nil {
+		clientOptions, queryTimeout, err := mongoOptionsFromEnv(pool.uriKey)
+		if err != nil {
+			return nil, err
+		}
+		pool.options = clientOptions
+		pool.queryTimeout = queryTimeout
+	}
+	client, err := mongo.Connect(context.Background(), pool.options)
+	if err != nil {
+		return nil, err
+	}
+	pool.client = client
+	return client, nil
+}
+
+// run a database operation on the shared client with the query deadline
+// a disconnected client is replaced and the operation retried once
+func (pool *mongoPool) run(ctx context.Context, database string, operation func(ctx context.Context, db *mongo.Database) error) error {
+	for attempt := 0; ; attempt++ {
+		client, err := pool.get()
+		if err != nil {
+			return err
+		}
+		opCtx, cancel := context.WithTimeout(ctx, pool.queryTimeout)
+		err = operation(opCtx, client.Database(database))
+		cancel()
+		if !errors.Is(err, mongo.ErrClientDisconnected) || attempt > 0 {
+			return err
+		}
+		log.Println("mongo client disconnected, reconnecting")
+		pool.drop(client)
+	}
+}
+
+// forget the client if it is still the shared one
+func (pool *mongoPool) drop(client *mongo.Client) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.client == client {
+		pool.client = nil
+	}
+}
+
+// disconnect the shared client, waiting for the in use connections up to the deadline
+func (pool *mongoPool) close() {
+	pool.mu.Lock()
+	client := pool.client
+	pool.client = nil
+	pool.mu.Unlock()
+	if client == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := client.Disconnect(ctx)
+	if err != nil {
+		log.Println("mongo disconnect error:", err)
+	}
+}
+
+// the data version is read at most this often, a reload shows in the cache keys within it
+const dataVersionRefresh = 5 * time.Second
+
+var (
+	dataVersionMu   sync.Mutex
+	dataVersion     string
+	dataVersionRead time.Time
+)
+
+// the data version bumped by the loaders, the last one read is kept when mongo is unreachable
+func currentDataVersion(ctx context.Context) string {
+	dataVersionMu.Lock()
+	defer dataVersionMu.Unlock()
+	if time.Since(dataVersionRead) < dataVersionRefresh {
+		return dataVersion
+	}
+	err := databasePool.run(ctx, "nasdaq", func(ctx context.Context, db *mongo.Database) error {
+		version, err := agentcache.DataVersion(ctx, db.Client())
+		if err != nil {
+			return err
+		}
+		dataVersion = version
+		return nil
+	})
+	if err != nil {
+		log.Println("data version read error:", err)
+	}
+	dataVersionRead = time.Now()
+	return dataVersion
+}
@@ -0,0 +1,238 @@
+package databaseagent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	stockdata "stock-agent/stock-data"
+
+	"github.com/google/generative-ai-go/genai"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/////////
+// Price statistics tool
+/////////
+
+// price statistics tool description
+var priceStatisticsDeclaration = &genai.FunctionDeclaration{
+	Name:        "priceStatistics",
+	Description: "Compute exact statistics of a ticker's daily prices over a date range: the min and max with their dates, the mean, the median, the first and last values, and the absolute and percentage change. Use this for highest, lowest, average and change questions instead of fetching the rows",
+	Parameters: &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"ticker": {
+				Type:        genai.TypeString,
+				Description: "The ticker code of the company",
+			},
+			"startDate": {
+				Type:        genai.TypeString,
+				Description: "The start date of the range in the format yyyy-mm-dd",
+			},
+			"endDate": {
+				Type:        genai.TypeString,
+				Description: "The end date of the range in the format yyyy-mm-dd",
+			},
+			"fields": {
+				Type:        genai.TypeArray,
+				Description: "The price fields to compute, any of open, high, low and close, all of them when not given",
+				Items:       &genai.Schema{Type: genai.TypeString},
+			},
+		},
+		Required: []string{"ticker", "startDate", "endDate"},
+	},
+}
+
+// statistics of a price field over the range
+type FieldStatistics struct {
+	Min     float64 `json:"min"`
+	MinDate string  `json:"minDate"`
+	Max     float64 `json:"max"`
+	MaxDate string  `json:"maxDate"`
+	Mean    float64 `json:"mean"`
+	Median  float64 `json:"median"`
+	First   float64 `json:"first"`
+	Last    float64 `json:"last"`
+	// last - first, and as a percentage of first
+	Change        float64 `json:"change"`
+	ChangePercent float64 `json:"changePercent"`
+}
+
+// statistics of a ticker over the trading days in the range
+type PriceStatistics struct {
+	Ticker string `json:"ticker"`
+	// first and last trading days found in the range
+	StartDate string                     `json:"startDate"`
+	EndDate   string                     `json:"endDate"`
+	Days      int                        `json:"days"`
+	Fields    map[string]FieldStatistics `json:"fields"`
+}
+
+// aggregation results, the json statistics are built from these
+type fieldAggregate struct {
+	Min     float64   `bson:"min"`
+	MinDate time.Time `bson:"minDate"`
+	Max     float64   `bson:"max"`
+	MaxDate time.Time `bson:"maxDate"`
+	Mean    float64   `bson:"mean"`
+	Median  float64   `bson:"median"`
+	First   float64   `bson:"first"`
+	Last    float64   `bson:"last"`
+}
+type statisticsAggregate struct {
+	Days      int                       `bson:"days"`
+	FirstDate time.Time                 `bson:"firstDate"`
+	LastDate  time.Time                 `bson:"lastDate"`
+	Fields    map[string]fieldAggregate `bson:"fields"`
+}
+
+// exact median of a sorted array of count values, e.g. from $sortArray
+func medianExpression(sorted interface{}, count string) bson.D {
+	half := bson.D{{Key: "$floor", Value: bson.D{{Key: "$divide", Value: bson.A{count, 2}}}}}
+	return bson.D{{Key: "$cond", Value: bson.A{
+		bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$mod", Value: bson.A{count, 2}}}, 1}}},
+		bson.D{{Key: "$arrayElemAt", Value: bson.A{sorted, half}}},
+		bson.D{{Key: "$avg", Value: bson.A{
+			bson.D{{Key: "$arrayElemAt", Value: bson.A{sorted, bson.D{{Key: "$subtract", Value: bson.A{half, 1}}}}}},
+			bson.D{{Key: "$arrayElemAt", Value: bson.A{sorted, half}}},
+		}}},
+	}}}
+}
+
+// pipeline grouping the range into one document of statistics per field
+// $top and $sortArray need MongoDB 5.2 or later
+func statisticsPipeline(filter bson.D, fields []string) bson.A {
+	group := bson.D{
+		{Key: "_id", Value: nil},
+		{Key: "days", Value: bson.D{{Key: "$sum", Value: 1}}},
+		{Key: "firstDate", Value: bson.D{{Key: "$first", Value: "$date"}}},
+		{Key: "lastDate", Value: bson.D{{Key: "$last", Value: "$date"}}},
+	}
+	project := bson.D{
+		{Key: "_id", Value: 0},
+		{Key: "days", Value: 1},
+		{Key: "firstDate", Value: 1},
+		{Key: "lastDate", Value: 1},
+	}
+	for _, field := range fields {
+		// the earliest day of each extreme
+		extreme := func(order int) bson.D {
+			return bson.D{{Key: "$top", Value: bson.D{
+				{Key: "sortBy", Value: bson.D{{Key: field, Value: order}, {Key: "date", Value: 1}}},
+				{Key: "output", Value: bson.D{{Key: "value", Value: "$" + field}, {Key: "date", Value: "$date"}}},
+			}}}
+		}
+		group = append(group,
+			bson.E{Key: field + "Min", Value: extreme(1)},
+			bson.E{Key: field + "Max", Value: extreme(-1)},
+			bson.E{Key: field + "Mean", Value: bson.D{{Key: "$avg", Value: "$" + field}}},
+			bson.E{Key: field + "First", Value: bson.D{{Key: "$first", Value: "$" + field}}},
+			bson.E{Key: field + "Last", Value: bson.D{{Key: "$last", Value: "$" + field}}},
+			bson.E{Key: field + "Values", Value: bson.D{{Key: "$push", Value: "$" + field}}},
+		)
+		sorted := bson.D{{Key: "$sortArray", Value: bson.D{{Key: "input", Value: "$" + field + "Values"}, {Key: "sortBy", Value: 1}}}}
+		project = append(project, bson.E{Key: "fields." + field, Value: bson.D{
+			{Key: "min", Value: "$" + field + "Min.value"},
+			{Key: "minDate", Value: "$" + field + "Min.date"},
+			{Key: "max", Value: "$" + field + "Max.value"},
+			{Key: "maxDate", Value: "$" + field + "Max.date"},
+			{Key: "mean", Value: "$" + field + "Mean"},
+			{Key: "median", Value: medianExpression(sorted, "$days")},
+			{Key: "first", Value: "$" + field + "First"},
+			{Key: "last", Value: "$" + field + "Last"},
+		}})
+	}
+	return bson.A{
+		bson.D{{Key: "$match", Value: filter}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "date", Value: 1}}}},
+		bson.D{{Key: "$group", Value: group}},
+		bson.D{{Key: "$project", Value: project}},
+	}
+}
+
+// round away the float noise of the computed values
+func round(value float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(value*scale) / scale
+}
+
+// compute the statistics of the fields over the range with one aggregation
+func priceStatistics(ctx context.Context, ticker string, startDate string, endDate string, fields []string) (*PriceStatistics, error) {
+	if len(fields) == 0 {
+		fields = stockdata.PriceFields
+	}
+	for _, field := range fields {
+		if !slices.Contains(stockdata.PriceFields, field) {
+			return nil, errors.New("unknown field " + field + ", expected " + strings.Join(stockdata.PriceFields, ", "))
+		}
+	}
+	filter, err := stockdata.DateFilter(startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+
+	var aggregates []statisticsAggregate
+	err = databasePool.run(ctx, "nasdaq", func(ctx context.Context, db *mongo.Database) error {
+		cursor, err := db.Collection(ticker).Aggregate(ctx, statisticsPipeline(filter, fields))
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, &aggregates)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(aggregates) == 0 {
+		return nil, errors.New("no " + ticker + " data between " + startDate + " and " + endDate)
+	}
+
+	aggregate := aggregates[0]
+	statistics := &PriceStatistics{
+		Ticker:    ticker,
+		StartDate: aggregate.FirstDate.UTC().Format(stockdata.DateLayout),
+		EndDate:   aggregate.LastDate.UTC().Format(stockdata.DateLayout),
+		Days:      aggregate.Days,
+		Fields:    map[string]FieldStatistics{},
+	}
+	for field, values := range aggregate.Fields {
+		fieldStatistics := FieldStatistics{
+			Min:     values.Min,
+			MinDate: values.MinDate.UTC().Format(stockdata.DateLayout),
+			Max:     values.Max,
+			MaxDate: values.MaxDate.UTC().Format(stockdata.DateLayout),
+			Mean:    round(values.Mean, 4),
+			Median:  round(values.Median, 4),
+			First:   values.First,
+			Last:    values.Last,
+			Change:  round(values.Last-values.First, 4),
+		}
+		if values.First != 0 {
+			fieldStatistics.ChangePercent = round((values.Last-values.First)/values.First*100, 2)
+		}
+		statistics.Fields[field] = fieldStatistics
+	}
+	return statistics, nil
+}
+
+// tool call handler for the price statistics
+func callPriceStatistics(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+	ticker, tickerOk := funcall.Args["ticker"].(string)
+	startDate, startOk := funcall.Args["startDate"].(string)
+	endDate, endOk := funcall.Args["endDate"].(string)
+	if !tickerOk || !startOk || !endOk {
+		err := errors.New("missing arg: ticker, startDate and endDate are required")
+		log.Println(err)
+		return err.Error(), err
+	}
+	fields := lowerStringsArg(funcall, "fields")
+	log.Println("running priceStatistics tool for " + ticker + " with date range " + startDate + " - " + endDate)
+
+	statistics, err := priceStatistics(ctx, ticker, startDate, endDate, fields)
+	return toolReply(ctx, "price statistics", statistics, err)
+}
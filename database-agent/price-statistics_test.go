@@ -0,0 +1,147 @@
+package databaseagent
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// evaluate the aggregation operators used by medianExpression, with the field paths in vars
+func evaluate(t *testing.T, expression interface{}, vars map[string]interface{}) interface{} {
+	t.Helper()
+	switch expression := expression.(type) {
+	case string:
+		value, exists := vars[expression]
+		if !exists {
+			t.Fatalf("unknown field path %s", expression)
+		}
+		return value
+	case int:
+		return float64(expression)
+	case bson.A:
+		values := bson.A{}
+		for _, item := range expression {
+			values = append(values, evaluate(t, item, vars))
+		}
+		return values
+	case bson.D:
+		if len(expression) != 1 {
+			t.Fatalf("expression %v has %d operators, want 1", expression, len(expression))
+		}
+		operator := expression[0].Key
+		args, ok := expression[0].Value.(bson.A)
+		if !ok {
+			// single argument operators
+			args = bson.A{expression[0].Value}
+		}
+		if operator == "$cond" {
+			if evaluate(t, args[0], vars).(bool) {
+				return evaluate(t, args[1], vars)
+			}
+			return evaluate(t, args[2], vars)
+		}
+		values := evaluate(t, args, vars).(bson.A)
+		number := func(idx int) float64 { return values[idx].(float64) }
+		switch operator {
+		case "$eq":
+			return values[0] == values[1]
+		case "$mod":
+			return math.Mod(number(0), number(1))
+		case "$divide":
+			return number(0) / number(1)
+		case "$subtract":
+			return number(0) - number(1)
+		case "$floor":
+			return math.Floor(number(0))
+		case "$arrayElemAt":
+			return values[0].([]float64)[int(number(1))]
+		case "$avg":
+			return (number(0) + number(1)) / 2
+		}
+		t.Fatalf("unknown operator %s", operator)
+	}
+	t.Fatalf("unknown expression %#v", expression)
+	return nil
+}
+
+func TestMedianExpression(t *testing.T) {
+	for _, test := range []struct {
+		sorted []float64
+		want   float64
+	}{
+		{[]float64{4}, 4},
+		{[]float64{1, 3}, 2},
+		{[]float64{1, 2, 9}, 2},
+		{[]float64{1, 2, 3, 10}, 2.5},
+		{[]float64{228.02, 229, 229.87, 234.93, 237.33}, 229.87},
+	} {
+		vars := map[string]interface{}{"$sorted": test.sorted, "$days": float64(len(test.sorted))}
+		if got := evaluate(t, medianExpression("$sorted", "$days"), vars); got != test.want {
+			t.Errorf("median of %v = %v, want %v", test.sorted, got, test.want)
+		}
+	}
+}
+
+func TestStatisticsPipeline(t *testing.T) {
+	filter := bson.D{{Key: "date", Value: bson.D{{Key: "$gte", Value: "2024-11-01"}}}}
+	pipeline := statisticsPipeline(filter, []string{"close"})
+
+	// match the range, in date order, into one group, projected per field
+	var stages []string
+	for _, stage := range pipeline {
+		stages = append(stages, stage.(bson.D)[0].Key)
+	}
+	if !reflect.DeepEqual(stages, []string{"$match", "$sort", "$group", "$project"}) {
+		t.Fatalf("stages = %v", stages)
+	}
+	if match := pipeline[0].(bson.D)[0].Value; !reflect.DeepEqual(match, filter) {
+		t.Errorf("match = %v, want the filter", match)
+	}
+	// the first and last of each field rely on the date order
+	if sort := pipeline[1].(bson.D)[0].Value; !reflect.DeepEqual(sort, bson.D{{Key: "date", Value: 1}}) {
+		t.Errorf("sort = %v, want by date", sort)
+	}
+
+	group := pipeline[2].(bson.D)[0].Value.(bson.D)
+	var keys []string
+	for _, element := range group {
+		keys = append(keys, element.Key)
+	}
+	wantKeys := []string{"_id", "days", "firstDate", "lastDate", "closeMin", "closeMax", "closeMean", "closeFirst", "closeLast", "closeValues"}
+	if !reflect.DeepEqual(keys, wantKeys) {
+		t.Errorf("group keys = %v, want %v", keys, wantKeys)
+	}
+	// extremes take the earliest day on a tie
+	wantMax := bson.D{{Key: "$top", Value: bson.D{
+		{Key: "sortBy", Value: bson.D{{Key: "close", Value: -1}, {Key: "date", Value: 1}}},
+		{Key: "output", Value: bson.D{{Key: "value", Value: "$close"}, {Key: "date", Value: "$date"}}},
+	}}}
+	if closeMax := field(group, "closeMax"); !reflect.DeepEqual(closeMax, wantMax) {
+		t.Errorf("closeMax = %v, want %v", closeMax, wantMax)
+	}
+	if closeMin := field(group, "closeMin").(bson.D)[0].Value.(bson.D); !reflect.DeepEqual(field(closeMin, "sortBy"), bson.D{{Key: "close", Value: 1}, {Key: "date", Value: 1}}) {
+		t.Errorf("closeMin sort = %v, want ascending close then date", field(closeMin, "sortBy"))
+	}
+
+	project := pipeline[3].(bson.D)[0].Value.(bson.D)
+	closeStats, ok := field(project, "fields.close").(bson.D)
+	if !ok {
+		t.Fatalf("project = %v, want fields.close", project)
+	}
+	sorted := bson.D{{Key: "$sortArray", Value: bson.D{{Key: "input", Value: "$closeValues"}, {Key: "sortBy", Value: 1}}}}
+	want := bson.D{
+		{Key: "min", Value: "$closeMin.value"},
+		{Key: "minDate", Value: "$closeMin.date"},
+		{Key: "max", Value: "$closeMax.value"},
+		{Key: "maxDate", Value: "$closeMax.date"},
+		{Key: "mean", Value: "$closeMean"},
+		{Key: "median", Value: medianExpression(sorted, "$days")},
+		{Key: "first", Value: "$closeFirst"},
+		{Key: "last", Value: "$closeLast"},
+	}
+	if !reflect.DeepEqual(closeStats, want) {
+		t.Errorf("fields.close = %v, want %v", closeStats, want)
+	}
+}
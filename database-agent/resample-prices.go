@@ -0,0 +1,105 @@
+package databaseagent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	stockdata "stock-agent/stock-data"
+
+	"github.com/google/generative-ai-go/genai"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/////////
+// Resampled prices tool
+/////////
+
+// resampled prices tool description
+var resamplePricesDeclaration = &genai.FunctionDeclaration{
+	Name:        "resamplePrices",
+	Description: "Aggregate a ticker's daily prices over a date range into weekly, monthly, quarterly or yearly bars, each with the first open, the highest high, the lowest low, the last close, the total volume and the first and last trading days. Use this for monthly closes or yearly ranges instead of fetching the daily rows",
+	Parameters: &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"ticker": {
+				Type:        genai.TypeString,
+				Description: "The ticker code of the company",
+			},
+			"startDate": {
+				Type:        genai.TypeString,
+				Description: "The start date of the range in the format yyyy-mm-dd",
+			},
+			"endDate": {
+				Type:        genai.TypeString,
+				Description: "The end date of the range in the format yyyy-mm-dd",
+			},
+			"period": {
+				Type:        genai.TypeString,
+				Description: "The bar period, one of weekly, monthly, quarterly or yearly",
+			},
+			"fiscalYearStartMonth": {
+				Type:        genai.TypeInteger,
+				Description: "The month the company's fiscal year starts, 1 to 12, for fiscal quarters and years, e.g. 10 for Apple. Calendar periods when not given",
+			},
+		},
+		Required: []string{"ticker", "startDate", "endDate", "period"},
+	},
+}
+
+// bars of a ticker over the range
+type ResampledPrices struct {
+	Ticker string          `json:"ticker"`
+	Period string          `json:"period"`
+	Bars   []stockdata.Bar `json:"bars"`
+}
+
+// resample the daily lines of the range
+func resamplePrices(ctx context.Context, ticker string, startDate string, endDate string, period stockdata.Period, yearStart time.Month) (*ResampledPrices, error) {
+	period, err := stockdata.ParsePeriod(string(period))
+	if err != nil {
+		return nil, err
+	}
+	if yearStart < time.January || yearStart > time.December {
+		return nil, errors.New("invalid fiscalYearStartMonth, expected 1 to 12")
+	}
+
+	var lines []stockdata.TickerLine
+	err = databasePool.run(ctx, "nasdaq", func(ctx context.Context, db *mongo.Database) error {
+		lines, err = stockdata.FindLines(ctx, db.Collection(ticker), startDate, endDate)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("no " + ticker + " data between " + startDate + " and " + endDate)
+	}
+	bars, err := stockdata.Resample(lines, period, yearStart)
+	if err != nil {
+		return nil, err
+	}
+	return &ResampledPrices{Ticker: ticker, Period: string(period), Bars: bars}, nil
+}
+
+// tool call handler for the resampled prices
+func callResamplePrices(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+	ticker, tickerOk := funcall.Args["ticker"].(string)
+	startDate, startOk := funcall.Args["startDate"].(string)
+	endDate, endOk := funcall.Args["endDate"].(string)
+	period, periodOk := funcall.Args["period"].(string)
+	if !tickerOk || !startOk || !endOk || !periodOk {
+		err := errors.New("missing arg: ticker, startDate, endDate and period are required")
+		log.Println(err)
+		return err.Error(), err
+	}
+	yearStart := time.January
+	if month, ok := intArg(funcall, "fiscalYearStartMonth"); ok {
+		yearStart = time.Month(month)
+	}
+	log.Println("running resamplePrices tool for " + ticker + " " + period + " with date range " + startDate + " - " + endDate)
+
+	resampled, err := resamplePrices(ctx, ticker, startDate, endDate, stockdata.Period(period), yearStart)
+	return toolReply(ctx, "resample prices", resampled, err)
+}
@@ -0,0 +1,242 @@
+package databaseagent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	stockdata "stock-agent/stock-data"
+	technicalindicators "stock-agent/technical-indicators"
+
+	"github.com/google/generative-ai-go/genai"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/////////
+// Technical indicators tool
+/////////
+
+// indicators of the tool and their default windows, macd is always 12, 26, 9
+var indicatorWindows = map[string]int{
+	"sma":        20,
+	"ema":        20,
+	"rsi":        14,
+	"macd":       macdSlow,
+	"bollinger":  20,
+	"atr":        14,
+	"volatility": 20,
+}
+
+// indicator names for the messages
+var indicatorNames = []string{"sma", "ema", "rsi", "macd", "bollinger", "atr", "volatility"}
+
+// macd periods and bollinger band width
+const (
+	macdFast            = 12
+	macdSlow            = 26
+	macdSignal          = 9
+	bollingerDeviations = 2
+	maxIndicatorWindow  = 250
+)
+
+// technical indicators tool description
+var technicalIndicatorsDeclaration = &genai.FunctionDeclaration{
+	Name:        "technicalIndicators",
+	Description: "Compute technical indicators of a ticker's daily prices for each trading day of a date range: sma and ema (moving averages of the close), rsi (Wilder's relative strength index), macd (12, 26 and 9 day macd, signal and histogram), bollinger (bands 2 standard deviations around the sma), atr (Wilder's average true range) and volatility (annualised standard deviation of the daily log returns). The days before the range are used to fill the window",
+	Parameters: &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"ticker": {
+				Type:        genai.TypeString,
+				Description: "The ticker code of the company",
+			},
+			"startDate": {
+				Type:        genai.TypeString,
+				Description: "The start date of the range in the format yyyy-mm-dd",
+			},
+			"endDate": {
+				Type:        genai.TypeString,
+				Description: "The end date of the range in the format yyyy-mm-dd",
+			},
+			"indicators": {
+				Type:        genai.TypeArray,
+				Description: "The indicators to compute, any of sma, ema, rsi, macd, bollinger, atr and volatility",
+				Items:       &genai.Schema{Type: genai.TypeString},
+			},
+			"window": {
+				Type:        genai.TypeInteger,
+				Description: "The window in trading days, when not given 20 for sma, ema, bollinger and volatility and 14 for rsi and atr. The macd periods are fixed",
+			},
+		},
+		Required: []string{"ticker", "startDate", "endDate", "indicators"},
+	},
+}
+
+// a trading day of the indicators, a value is left out until its window has filled
+type IndicatorRow struct {
+	Date            string   `json:"date"`
+	Close           float64  `json:"close"`
+	SMA             *float64 `json:"sma,omitempty"`
+	EMA             *float64 `json:"ema,omitempty"`
+	RSI             *float64 `json:"rsi,omitempty"`
+	MACD            *float64 `json:"macd,omitempty"`
+	MACDSignal      *float64 `json:"macdSignal,omitempty"`
+	MACDHistogram   *float64 `json:"macdHistogram,omitempty"`
+	BollingerUpper  *float64 `json:"bollingerUpper,omitempty"`
+	BollingerMiddle *float64 `json:"bollingerMiddle,omitempty"`
+	BollingerLower  *float64 `json:"bollingerLower,omitempty"`
+	ATR             *float64 `json:"atr,omitempty"`
+	Volatility      *float64 `json:"volatility,omitempty"`
+}
+
+// indicators of a ticker over the range
+type TechnicalIndicators struct {
+	Ticker string `json:"ticker"`
+	// window of each requested indicator
+	Windows map[string]int `json:"windows"`
+	Rows    []IndicatorRow `json:"rows"`
+}
+
+// a rounded value, nil when undefined
+func indicatorValue(value float64) *float64 {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	value = round(value, 4)
+	return &value
+}
+
+// calendar days to read before the range so the windows are filled, the ema based
+// indicators are given three windows to settle
+func warmUpDays(windows map[string]int) int {
+	longest := 0
+	for name, window := range windows {
+		if name == "macd" {
+			window = macdSlow + macdSignal
+		}
+		longest = max(longest, window)
+	}
+	// trading days to calendar days, with room for the holidays
+	return longest*3*7/5 + 10
+}
+
+// compute the indicators for the trading days of the range
+func technicalIndicators(ctx context.Context, ticker string, startDate string, endDate string, names []string, window int) (*TechnicalIndicators, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no indicators requested, expected any of " + strings.Join(indicatorNames, ", "))
+	}
+	if window != 0 && (window < 2 || window > maxIndicatorWindow) {
+		return nil, errors.New("invalid window " + strconv.Itoa(window) + ", expected 2 to " + strconv.Itoa(maxIndicatorWindow) + " trading days")
+	}
+	windows := map[string]int{}
+	for _, name := range names {
+		defaultWindow, ok := indicatorWindows[name]
+		if !ok {
+			return nil, errors.New("unknown indicator " + name + ", expected any of " + strings.Join(indicatorNames, ", "))
+		}
+		windows[name] = defaultWindow
+		if window != 0 && name != "macd" {
+			windows[name] = window
+		}
+	}
+	start, err := stockdata.ParseDate(startDate)
+	if err != nil {
+		return nil, err
+	}
+	_, err = stockdata.ParseDate(endDate)
+	if err != nil {
+		return nil, err
+	}
+
+	// read from before the range to fill the windows
+	warmUpStart := start.AddDate(0, 0, -warmUpDays(windows)).Format(stockdata.DateLayout)
+	var lines []stockdata.TickerLine
+	err = databasePool.run(ctx, "nasdaq", func(ctx context.Context, db *mongo.Database) error {
+		lines, err = stockdata.FindLines(ctx, db.Collection(ticker), warmUpStart, endDate)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	first, _ := slices.BinarySearchFunc(lines, start, func(line stockdata.TickerLine, start time.Time) int {
+		return line.Date.Compare(start)
+	})
+	if first == len(lines) {
+		return nil, errors.New("no " + ticker + " data between " + startDate + " and " + endDate)
+	}
+
+	closes := make([]float64, len(lines))
+	highs := make([]float64, len(lines))
+	lows := make([]float64, len(lines))
+	for idx, line := range lines {
+		closes[idx] = line.Close
+		highs[idx] = line.High
+		lows[idx] = line.Low
+	}
+	rows := make([]IndicatorRow, len(lines))
+	for idx, line := range lines {
+		rows[idx] = IndicatorRow{Date: line.Date.UTC().Format(stockdata.DateLayout), Close: line.Close}
+	}
+	for name, window := range windows {
+		switch name {
+		case "sma":
+			for idx, value := range technicalindicators.SMA(closes, window) {
+				rows[idx].SMA = indicatorValue(value)
+			}
+		case "ema":
+			for idx, value := range technicalindicators.EMA(closes, window) {
+				rows[idx].EMA = indicatorValue(value)
+			}
+		case "rsi":
+			for idx, value := range technicalindicators.RSI(closes, window) {
+				rows[idx].RSI = indicatorValue(value)
+			}
+		case "macd":
+			macd, signal, histogram := technicalindicators.MACD(closes, macdFast, macdSlow, macdSignal)
+			for idx := range rows {
+				rows[idx].MACD = indicatorValue(macd[idx])
+				rows[idx].MACDSignal = indicatorValue(signal[idx])
+				rows[idx].MACDHistogram = indicatorValue(histogram[idx])
+			}
+		case "bollinger":
+			middle, upper, lower := technicalindicators.Bollinger(closes, window, bollingerDeviations)
+			for idx := range rows {
+				rows[idx].BollingerUpper = indicatorValue(upper[idx])
+				rows[idx].BollingerMiddle = indicatorValue(middle[idx])
+				rows[idx].BollingerLower = indicatorValue(lower[idx])
+			}
+		case "atr":
+			for idx, value := range technicalindicators.ATR(highs, lows, closes, window) {
+				rows[idx].ATR = indicatorValue(value)
+			}
+		case "volatility":
+			for idx, value := range technicalindicators.Volatility(closes, window) {
+				rows[idx].Volatility = indicatorValue(value)
+			}
+		}
+	}
+	return &TechnicalIndicators{Ticker: ticker, Windows: windows, Rows: rows[first:]}, nil
+}
+
+// tool call handler for the technical indicators
+func callTechnicalIndicators(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+	ticker, tickerOk := funcall.Args["ticker"].(string)
+	startDate, startOk := funcall.Args["startDate"].(string)
+	endDate, endOk := funcall.Args["endDate"].(string)
+	if !tickerOk || !startOk || !endOk {
+		err := errors.New("missing arg: ticker, startDate and endDate are required")
+		log.Println(err)
+		return err.Error(), err
+	}
+	names := lowerStringsArg(funcall, "indicators")
+	window, _ := intArg(funcall, "window")
+	log.Println("running technicalIndicators tool for " + ticker + " with date range " + startDate + " - " + endDate)
+
+	indicators, err := technicalIndicators(ctx, ticker, startDate, endDate, names, window)
+	return toolReply(ctx, "technical indicators", indicators, err)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+
+	agenteval "stock-agent/agent-eval"
+)
+
+// run an eval suite and write the report, comparing it to a baseline report if given
+// fails when a case does not pass
+func runEval(args []string) error {
+	flags := flag.NewFlagSet("eval", flag.ContinueOnError)
+	suitePath := flags.String("suite", "", "suite file (.yaml, .yml or .jsonl)")
+	endpoint := flags.String("endpoint", "", "agent endpoint, overrides the suite endpoint")
+	reportPath := flags.String("out", "", "report file, defaults to <suite>-<time>.json")
+	baselinePath := flags.String("baseline", "", "report of an earlier run to compare with")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if *suitePath == "" {
+		return usageError{errors.New("missing -suite")}
+	}
+
+	suite, err := agenteval.LoadSuite(*suitePath)
+	if err != nil {
+		return err
+	}
+	report, err := agenteval.Run(context.Background(), suite, agenteval.Options{Endpoint: *endpoint})
+	if err != nil {
+		return err
+	}
+	if *reportPath == "" {
+		*reportPath = suite.Name + "-" + report.Started.Format("20060102-150405") + ".json"
+	}
+	err = report.Write(*reportPath)
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
+	fmt.Println("report written to " + *reportPath)
+
+	if *baselinePath != "" {
+		baseline, err := agenteval.LoadReport(*baselinePath)
+		if err != nil {
+			return err
+		}
+		fmt.Print(agenteval.Compare(baseline, report))
+	}
+	if report.Summary.Passed < report.Summary.Cases {
+		return errors.New(strconv.Itoa(report.Summary.Cases-report.Summary.Passed) + " of " + strconv.Itoa(report.Summary.Cases) + " eval cases did not pass")
+	}
+	return nil
+}
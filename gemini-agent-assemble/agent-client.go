@@ -0,0 +1,192 @@
+package geminiagentassemble
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////////////////////////////////////////
+// transport independent agent clients
+
+// client for a remote agent service
+type AgentClient interface {
+	// send a request and wait for the final answer
+	Ask(ctx context.Context, request Request) (*Response, error)
+	// send a request, reporting each tool step to the observer before the final answer
+	AskStream(ctx context.Context, request Request, observer func(Step)) (*Response, error)
+	Capabilities(ctx context.Context) (*Capabilities, error)
+	Health(ctx context.Context) error
+}
+
+// agent client transports
+const (
+	TransportHTTP = "http"
+	TransportGRPC = "grpc"
+)
+
+// default deadline for a downstream agent request
+const defaultAgentTimeout = 5 * time.Minute
+
+// transport for downstream agent calls from AGENT_TRANSPORT, http by default
+func AgentTransport() string {
+	transport, ok := os.LookupEnv("AGENT_TRANSPORT")
+	if !ok || transport == "" {
+		return TransportHTTP
+	}
+	return strings.ToLower(transport)
+}
+
+// deadline for downstream agent calls from AGENT_TIMEOUT_SECONDS
+func AgentTimeout() time.Duration {
+	timeout, ok := os.LookupEnv("AGENT_TIMEOUT_SECONDS")
+	if !ok {
+		return defaultAgentTimeout
+	}
+	seconds, err := strconv.Atoi(timeout)
+	if err != nil || seconds <= 0 {
+		log.Println("invalid AGENT_TIMEOUT_SECONDS, using the default:", timeout)
+		return defaultAgentTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// client for the agent at the endpoint (http://<hostname>:<port>) using the transport
+func NewAgentClient(transport string, endpoint string) (AgentClient, error) {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	switch transport {
+	case TransportHTTP:
+		return &httpAgentClient{endpoint: endpoint}, nil
+	case TransportGRPC:
+		return newGRPCAgentClient(strings.TrimPrefix(strings.TrimPrefix(endpoint, "http://"), "https://"))
+	default:
+		return nil, errors.New("unknown agent transport: " + transport)
+	}
+}
+
+// send a request to the agent service at the endpoint with the configured transport and deadline
+// attachments of the request in the context are forwarded
+func CallAgentEndpoint(ctx context.Context, endpoint string, message string) (string, error) {
+	client, err := NewAgentClient(AgentTransport(), endpoint)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, AgentTimeout())
+	defer cancel()
+	response, err := client.Ask(ctx, Request{Input: message, Attachments: AttachmentsFromContext(ctx)})
+	if err != nil {
+		return "", err
+	}
+	return response.Content, nil
+}
+
+// http agent client
+type httpAgentClient struct {
+	endpoint string
+}
+
+// send a json request and decode the json reply
+func (client *httpAgentClient) do(ctx context.Context, method string, path string, body any, reply any) error {
+	var reqBody io.Reader
+	if body != nil {
+		reqDat, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewBuffer(reqDat)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, client.endpoint+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// extract and decode the reply
+	respDat, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(method + " " + client.endpoint + path + " failed: " + resp.Status + " " + strings.TrimSpace(string(respDat)))
+	}
+	if reply == nil {
+		return nil
+	}
+	return json.Unmarshal(respDat, reply)
+}
+
+func (client *httpAgentClient) Ask(ctx context.Context, request Request) (*Response, error) {
+	response := &Response{}
+	err := client.do(ctx, "POST", "/agent", request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// run the request as an async job and poll it for the steps
+func (client *httpAgentClient) AskStream(ctx context.Context, request Request, observer func(Step)) (*Response, error) {
+	job := &Job{}
+	err := client.do(ctx, "POST", "/jobs", JobRequest{Request: request}, job)
+	if err != nil {
+		return nil, err
+	}
+	seen := 0
+	for {
+		select {
+		case <-ctx.Done():
+			// stop the remote job too
+			client.do(context.Background(), "DELETE", "/jobs/"+job.ID, nil, nil)
+			return nil, ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+		err = client.do(ctx, "GET", "/jobs/"+job.ID, nil, job)
+		if err != nil {
+			return nil, err
+		}
+		for ; seen < len(job.Steps); seen++ {
+			if observer != nil {
+				observer(job.Steps[seen])
+			}
+		}
+		switch job.Status {
+		case JobCompleted:
+			response := &Response{}
+			err = client.do(ctx, "GET", "/jobs/"+job.ID+"/result", nil, response)
+			if err != nil {
+				return nil, err
+			}
+			return response, nil
+		case JobFailed, JobCancelled:
+			return nil, errors.New("agent job " + string(job.Status) + ": " + job.Error)
+		}
+	}
+}
+
+func (client *httpAgentClient) Capabilities(ctx context.Context) (*Capabilities, error) {
+	capabilities := &Capabilities{}
+	err := client.do(ctx, "GET", "/capabilities", nil, capabilities)
+	if err != nil {
+		return nil, err
+	}
+	return capabilities, nil
+}
+
+func (client *httpAgentClient) Health(ctx context.Context) error {
+	return client.do(ctx, "GET", "/running", nil, nil)
+}
@@ -0,0 +1,4 @@
+// Package agentpb holds the protobuf agent service used for agent-to-agent calls over gRPC.
+package agentpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative agent.proto
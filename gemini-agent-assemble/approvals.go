@@ -0,0 +1,326 @@
+package geminiagentassemble
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Tool policy and approval routines
+/////////
+
+// tool risk levels, high risk calls need a human approval before they run
+type ToolRisk string
+
+const (
+	RiskLow  ToolRisk = "low"
+	RiskHigh ToolRisk = "high"
+)
+
+// how the agent treats calls to a tool
+// untrusted tools return outside content (documents, downstream agent text) that is passed to the model as data only
+// cacheable tools are deterministic for their args, their results are cached for CacheTTL (or the agent tool ttl)
+type ToolPolicy struct {
+	Risk      ToolRisk      `json:"risk"`
+	Untrusted bool          `json:"untrusted,omitempty"`
+	Cacheable bool          `json:"cacheable,omitempty"`
+	CacheTTL  time.Duration `json:"cacheTtl,omitempty"`
+}
+
+// set the policy for a tool by name, tools without a policy are low risk
+// a policy configured in the env is kept, see WithEnvSettings
+func (agent *Agent) SetToolPolicy(name string, policy ToolPolicy) {
+	agent.toolsMu.Lock()
+	defer agent.toolsMu.Unlock()
+	if _, configured := agent.configuredPolicies[name]; configured {
+		return
+	}
+	if agent.toolPolicies == nil {
+		agent.toolPolicies = map[string]ToolPolicy{}
+	}
+	agent.toolPolicies[name] = policy
+}
+
+// set the policy for tools without their own, e.g. when the tools change at runtime
+func (agent *Agent) SetDefaultToolPolicy(policy ToolPolicy) {
+	agent.toolsMu.Lock()
+	defer agent.toolsMu.Unlock()
+	agent.defaultToolPolicy = policy
+}
+
+// get the policy for a tool
+func (agent *Agent) ToolPolicy(name string) ToolPolicy {
+	agent.toolsMu.RLock()
+	defer agent.toolsMu.RUnlock()
+	policy, exists := agent.toolPolicies[name]
+	if !exists {
+		policy = agent.defaultToolPolicy
+	}
+	if policy.Risk == "" {
+		policy.Risk = RiskLow
+	}
+	return policy
+}
+
+// parse tool policies from an env var holding a json object keyed by tool name, e.g.
+// {"queryDatabase": {"cacheable": true, "cacheTtlSeconds": 600}, "commandQueryDatabase": {"risk": "high"}}
+func ToolPoliciesFromEnv(key string) (map[string]ToolPolicy, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var settings map[string]struct {
+		Risk            ToolRisk `json:"risk"`
+		Untrusted       bool     `json:"untrusted"`
+		Cacheable       bool     `json:"cacheable"`
+		CacheTTLSeconds int      `json:"cacheTtlSeconds"`
+	}
+	err := json.Unmarshal([]byte(value), &settings)
+	if err != nil {
+		return nil, errors.New("invalid " + key + ": " + err.Error())
+	}
+	policies := map[string]ToolPolicy{}
+	for name, setting := range settings {
+		if setting.Risk != "" && setting.Risk != RiskLow && setting.Risk != RiskHigh {
+			return nil, errors.New("invalid " + key + ": unknown risk " + string(setting.Risk) + " for " + name)
+		}
+		if setting.CacheTTLSeconds < 0 {
+			return nil, errors.New("invalid " + key + ": negative cacheTtlSeconds for " + name)
+		}
+		policies[name] = ToolPolicy{
+			Risk:      setting.Risk,
+			Untrusted: setting.Untrusted,
+			Cacheable: setting.Cacheable,
+			CacheTTL:  time.Duration(setting.CacheTTLSeconds) * time.Second,
+		}
+	}
+	return policies, nil
+}
+
+// approval states
+type ApprovalStatus string
+
+const (
+	ApprovalPending  ApprovalStatus = "pending"
+	ApprovalApproved ApprovalStatus = "approved"
+	ApprovalDenied   ApprovalStatus = "denied"
+	ApprovalExpired  ApprovalStatus = "expired"
+)
+
+// request for a human decision on a high risk tool call, with the exact arguments
+type Approval struct {
+	ID      string         `json:"id"`
+	JobID   string         `json:"jobId,omitempty"`
+	Agent   string         `json:"agent,omitempty"`
+	Tool    string         `json:"tool"`
+	Args    map[string]any `json:"args"`
+	Status  ApprovalStatus `json:"status"`
+	Reason  string         `json:"reason,omitempty"`
+	Created time.Time      `json:"created"`
+	Expires time.Time      `json:"expires"`
+}
+
+// the human decision posted to /approvals/{id}
+type ApprovalDecision struct {
+	Approved bool   `json:"approved"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// approval waiting for its decision
+type pendingApproval struct {
+	approval Approval
+	decision chan ApprovalDecision
+}
+
+// approval lookup failure
+var ErrApprovalNotFound = errors.New("approval not found")
+
+// time to wait for a decision, set by APPROVAL_TIMEOUT_SECONDS (default 300), then the call is denied
+func approvalTimeout() time.Duration {
+	timeout := 300
+	if value, ok := os.LookupEnv("APPROVAL_TIMEOUT_SECONDS"); ok {
+		seconds, err := strconv.Atoi(value)
+		if err == nil && seconds > 0 {
+			timeout = seconds
+		}
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// hold the tool call until a human approves or denies it, a timeout denies
+// the request is published on the job (if running as one), at /approvals and to APPROVAL_CALLBACK_URL
+func (agent *Agent) requestApproval(ctx context.Context, funcall genai.FunctionCall) (bool, string, error) {
+	id, err := newJobID()
+	if err != nil {
+		return false, "", err
+	}
+	now := time.Now()
+	pending := &pendingApproval{
+		approval: Approval{
+			ID:      id,
+			JobID:   jobIDFromContext(ctx),
+			Agent:   agent.capabilities.Name,
+			Tool:    funcall.Name,
+			Args:    funcall.Args,
+			Status:  ApprovalPending,
+			Created: now,
+			Expires: now.Add(approvalTimeout()),
+		},
+		decision: make(chan ApprovalDecision, 1),
+	}
+	approval := pending.approval
+
+	agent.approvalsMu.Lock()
+	if agent.approvals == nil {
+		agent.approvals = map[string]*pendingApproval{}
+	}
+	agent.approvals[id] = pending
+	agent.approvalsMu.Unlock()
+	defer func() {
+		agent.approvalsMu.Lock()
+		delete(agent.approvals, id)
+		agent.approvalsMu.Unlock()
+	}()
+
+	// publish the request
+	argsDat, _ := json.Marshal(funcall.Args)
+	log.Println("approval " + id + " requested for " + funcall.Name + " with args " + string(argsDat))
+	if approval.JobID != "" {
+		agent.updateJob(approval.JobID, func(job *Job) {
+			job.Status = JobAwaitingApproval
+			job.Approval = &approval
+		})
+		defer agent.updateJob(approval.JobID, func(job *Job) {
+			if job.Status == JobAwaitingApproval {
+				job.Status = JobRunning
+			}
+			job.Approval = nil
+		})
+	}
+	if callback, ok := os.LookupEnv("APPROVAL_CALLBACK_URL"); ok && callback != "" {
+		go postApprovalCallback(callback, approval)
+	}
+
+	// wait for the decision
+	timer := time.NewTimer(time.Until(approval.Expires))
+	defer timer.Stop()
+	select {
+	case decision := <-pending.decision:
+		log.Println("approval " + id + " approved: " + strconv.FormatBool(decision.Approved))
+		reason := decision.Reason
+		if !decision.Approved && reason == "" {
+			reason = "denied by the reviewer"
+		}
+		return decision.Approved, reason, nil
+	case <-timer.C:
+		log.Println("approval " + id + " expired")
+		return false, "no approval decision before the timeout", nil
+	case <-ctx.Done():
+		return false, "", ctx.Err()
+	}
+}
+
+// decide a pending approval
+func (agent *Agent) DecideApproval(id string, decision ApprovalDecision) error {
+	agent.approvalsMu.Lock()
+	defer agent.approvalsMu.Unlock()
+	pending, exists := agent.approvals[id]
+	if !exists || pending.approval.Status != ApprovalPending {
+		return ErrApprovalNotFound
+	}
+	pending.approval.Status = ApprovalDenied
+	if decision.Approved {
+		pending.approval.Status = ApprovalApproved
+	}
+	pending.approval.Reason = decision.Reason
+	pending.decision <- decision
+	return nil
+}
+
+// the approvals waiting for a decision, oldest first
+func (agent *Agent) PendingApprovals() []Approval {
+	agent.approvalsMu.Lock()
+	defer agent.approvalsMu.Unlock()
+	approvals := []Approval{}
+	for _, pending := range agent.approvals {
+		if pending.approval.Status == ApprovalPending {
+			approvals = append(approvals, pending.approval)
+		}
+	}
+	sort.Slice(approvals, func(i, j int) bool {
+		return approvals[i].Created.Before(approvals[j].Created)
+	})
+	return approvals
+}
+
+// post the approval request to the callback url
+func postApprovalCallback(callback string, approval Approval) {
+	approvalDat, err := json.Marshal(approval)
+	if err != nil {
+		log.Println("approval callback marshal error:", err)
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(callback, "application/json", bytes.NewBuffer(approvalDat))
+	if err != nil {
+		log.Println("approval callback error:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Println("approval callback status:", resp.Status)
+	}
+}
+
+// pending approvals handler at /approvals
+func (agent *Agent) HandleApprovalsRequest(res http.ResponseWriter, req *http.Request) {
+
+	// check for get
+	if req.Method != "GET" {
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	writeJSON(res, http.StatusOK, agent.PendingApprovals())
+}
+
+// approval decision handler at /approvals/{id}
+func (agent *Agent) HandleApprovalRequest(res http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+
+	switch req.Method {
+	case "GET":
+		for _, approval := range agent.PendingApprovals() {
+			if approval.ID == id {
+				writeJSON(res, http.StatusOK, approval)
+				return
+			}
+		}
+		http.Error(res, "Not Found", http.StatusNotFound)
+	case "POST":
+		var decision ApprovalDecision
+		err := json.NewDecoder(req.Body).Decode(&decision)
+		if err != nil {
+			http.Error(res, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		err = agent.DecideApproval(id, decision)
+		if err != nil {
+			http.Error(res, "Not Found", http.StatusNotFound)
+			return
+		}
+		res.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,123 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Request attachment routines
+/////////
+
+// file attached to a request, either inline data or a file reference
+// file references are paths under AGENT_ATTACHMENTS_DIR
+type Attachment struct {
+	Name     string `json:"name,omitempty"`
+	MIMEType string `json:"mimeType,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+	File     string `json:"file,omitempty"`
+}
+
+// inline request data limit of the model api
+const maxAttachmentBytes = 20 * 1024 * 1024
+
+// load file references and fill in missing mime types
+func resolveAttachments(attachments []Attachment) ([]Attachment, error) {
+	var resolved []Attachment
+	total := 0
+	for idx, attachment := range attachments {
+		if attachment.File != "" {
+			dat, err := readAttachmentFile(attachment.File)
+			if err != nil {
+				return nil, err
+			}
+			attachment.Data = dat
+			if attachment.Name == "" {
+				attachment.Name = filepath.Base(attachment.File)
+			}
+			attachment.File = ""
+		}
+		if len(attachment.Data) == 0 {
+			return nil, errors.New("attachment " + strconv.Itoa(idx) + " has no data or file")
+		}
+		total += len(attachment.Data)
+		if total > maxAttachmentBytes {
+			return nil, errors.New("attachments exceed " + strconv.Itoa(maxAttachmentBytes) + " bytes")
+		}
+		if attachment.MIMEType == "" {
+			attachment.MIMEType = mime.TypeByExtension(filepath.Ext(attachment.Name))
+		}
+		if attachment.MIMEType == "" {
+			attachment.MIMEType = http.DetectContentType(attachment.Data)
+		}
+		// drop any parameters, e.g. "; charset=utf-8"
+		attachment.MIMEType, _, _ = strings.Cut(attachment.MIMEType, ";")
+		resolved = append(resolved, attachment)
+	}
+	return resolved, nil
+}
+
+// read a file reference, which must stay inside the attachments directory
+func readAttachmentFile(file string) ([]byte, error) {
+	root, ok := os.LookupEnv("AGENT_ATTACHMENTS_DIR")
+	if !ok || root == "" {
+		return nil, errors.New("file attachments are disabled, AGENT_ATTACHMENTS_DIR not set")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(root, filepath.Clean("/"+file))
+	// follow any links before checking the path is still under the root
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, errors.New("attachment file not found: " + file)
+	}
+	rel, err := filepath.Rel(realRoot, realPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, errors.New("attachment file outside the attachments directory: " + file)
+	}
+	info, err := os.Stat(realPath)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > maxAttachmentBytes {
+		return nil, errors.New("attachment file too large: " + file)
+	}
+	return os.ReadFile(realPath)
+}
+
+// the model parts for the request text and its attachments
+func requestParts(input string, attachments []Attachment) []genai.Part {
+	parts := []genai.Part{genai.Text(input)}
+	for _, attachment := range attachments {
+		parts = append(parts, genai.Blob{MIMEType: attachment.MIMEType, Data: attachment.Data})
+	}
+	return parts
+}
+
+// context key for the attachments of the request being answered
+type attachmentsKey struct{}
+
+// carry the request attachments to the tool handlers
+func ContextWithAttachments(ctx context.Context, attachments []Attachment) context.Context {
+	return context.WithValue(ctx, attachmentsKey{}, attachments)
+}
+
+// the attachments of the request being answered, for forwarding to downstream agents
+func AttachmentsFromContext(ctx context.Context) []Attachment {
+	attachments, _ := ctx.Value(attachmentsKey{}).([]Attachment)
+	return attachments
+}
@@ -0,0 +1,233 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	agentcache "stock-agent/agent-cache"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Response and tool result caching routines
+/////////
+
+// default cache lifetimes, set by AGENT_CACHE_RESPONSE_TTL_SECONDS and AGENT_CACHE_TOOL_TTL_SECONDS
+const (
+	defaultResponseTTL = 10 * time.Minute
+	defaultToolTTL     = time.Hour
+)
+
+// cache the agent responses and cacheable tool results, a nil cache turns caching off
+// InitAgent uses the AGENT_CACHE backend by default
+func WithCache(cache agentcache.Cache) Option {
+	return func(agent *Agent) error {
+		agent.cache = cache
+		return nil
+	}
+}
+
+// put the version of the data behind the answers in the cache keys, so a reload made by
+// another process moves the agent onto new entries, e.g. agentcache.DataVersion
+func WithDataVersion(version func(ctx context.Context) string) Option {
+	return func(agent *Agent) error {
+		agent.dataVersion = version
+		return nil
+	}
+}
+
+// the data version for the keys, empty without one
+func (agent *Agent) currentDataVersion(ctx context.Context) []byte {
+	if agent.dataVersion == nil {
+		return nil
+	}
+	return []byte(agent.dataVersion(ctx))
+}
+
+// key prefixes for the agent entries
+func (agent *Agent) responseKeyPrefix() string {
+	return "response:" + agent.mcpAgentToolName() + ":"
+}
+func (agent *Agent) toolKeyPrefix() string {
+	return "tool:" + agent.mcpAgentToolName() + ":"
+}
+
+func hashKey(parts ...[]byte) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write(part)
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// normalise an input so trivially different questions share an entry
+func normaliseInput(input string) string {
+	input = strings.ToLower(strings.Join(strings.Fields(input), " "))
+	return strings.TrimRight(input, " ?.!")
+}
+
+// response key from the normalised input, request mode, resolved attachments, agent version,
+// data version and system prompt so a changed prompt does not answer from the entries of the old one
+func (agent *Agent) responseKey(ctx context.Context, input string, mode string, attachments []Attachment) string {
+	system := ""
+	if agent.system != nil {
+		system = *agent.system
+	}
+	parts := [][]byte{[]byte(agent.capabilities.Version), agent.currentDataVersion(ctx), []byte(system), []byte(mode), []byte(normaliseInput(input))}
+	for _, attachment := range attachments {
+		parts = append(parts, []byte(attachment.Name), []byte(attachment.MIMEType), attachment.Data)
+	}
+	return agent.responseKeyPrefix() + hashKey(parts...)
+}
+
+// trim the string args, map keys are sorted by the json encoding
+func normaliseArgs(value any) any {
+	switch value := value.(type) {
+	case string:
+		return strings.TrimSpace(value)
+	case map[string]any:
+		normalised := map[string]any{}
+		for key, item := range value {
+			normalised[key] = normaliseArgs(item)
+		}
+		return normalised
+	case []any:
+		normalised := []any{}
+		for _, item := range value {
+			normalised = append(normalised, normaliseArgs(item))
+		}
+		return normalised
+	default:
+		return value
+	}
+}
+
+// tool key from the tool name, normalised args and data version
+func (agent *Agent) toolKey(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+	argsDat, err := json.Marshal(normaliseArgs(funcall.Args))
+	if err != nil {
+		return "", err
+	}
+	return agent.toolKeyPrefix() + funcall.Name + ":" + hashKey(argsDat, agent.currentDataVersion(ctx)), nil
+}
+
+// cached response for the request key, if any
+func (agent *Agent) cachedResponse(ctx context.Context, key string, input string) *Response {
+	if agent.cache == nil || agent.responseTTL <= 0 {
+		return nil
+	}
+	dat, hit, err := agent.cache.Get(ctx, key)
+	if err != nil {
+		log.Println("cache get error:", err)
+		return nil
+	}
+	if !hit {
+		return nil
+	}
+	var response Response
+	err = json.Unmarshal(dat, &response)
+	if err != nil {
+		return nil
+	}
+	log.Println("response cache hit for: " + input)
+	return &Response{Content: response.Content, Cached: true}
+}
+
+func (agent *Agent) cacheResponse(ctx context.Context, key string, response *Response) {
+	if agent.cache == nil || agent.responseTTL <= 0 {
+		return
+	}
+	dat, err := json.Marshal(Response{Content: response.Content})
+	if err != nil {
+		return
+	}
+	err = agent.cache.Set(ctx, key, dat, agent.responseTTL)
+	if err != nil {
+		log.Println("cache set error:", err)
+	}
+}
+
+// context key for the skip cache flag of a tool call
+type skipCacheKey struct{}
+
+// keep the result of the current tool call out of the cache, e.g. when it reports a failure
+func SkipCache(ctx context.Context) {
+	if skip, ok := ctx.Value(skipCacheKey{}).(*bool); ok {
+		*skip = true
+	}
+}
+
+// run the tool call, using the cache for cacheable tools
+func (agent *Agent) runTool(ctx context.Context, funcall genai.FunctionCall) (string, bool, error) {
+	policy := agent.ToolPolicy(funcall.Name)
+	if agent.cache == nil || !policy.Cacheable {
+		result, err := agent.callTool(ctx, funcall)
+		return result, false, err
+	}
+	ttl := policy.CacheTTL
+	if ttl <= 0 {
+		ttl = agent.toolTTL
+	}
+
+	key, err := agent.toolKey(ctx, funcall)
+	if err != nil {
+		result, err := agent.callTool(ctx, funcall)
+		return result, false, err
+	}
+	dat, hit, err := agent.cache.Get(ctx, key)
+	if err != nil {
+		log.Println("cache get error:", err)
+	}
+	if hit {
+		log.Println("tool cache hit for: " + funcall.Name)
+		return string(dat), true, nil
+	}
+
+	skip := false
+	result, err := agent.callTool(context.WithValue(ctx, skipCacheKey{}, &skip), funcall)
+	if err != nil || skip {
+		return result, false, err
+	}
+	err = agent.cache.Set(ctx, key, []byte(result), ttl)
+	if err != nil {
+		log.Println("cache set error:", err)
+	}
+	return result, false, nil
+}
+
+// drop the agent responses and tool results from the cache
+func (agent *Agent) InvalidateCache(ctx context.Context) error {
+	if agent.cache == nil {
+		return nil
+	}
+	err := agent.cache.Delete(ctx, agent.responseKeyPrefix())
+	if err != nil {
+		return err
+	}
+	return agent.cache.Delete(ctx, agent.toolKeyPrefix())
+}
+
+// cache invalidation handler at /cache
+func (agent *Agent) HandleCacheRequest(res http.ResponseWriter, req *http.Request) {
+
+	// check for delete
+	if req.Method != "DELETE" {
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	err := agent.InvalidateCache(req.Context())
+	if err != nil {
+		log.Println("InvalidateCache():", err)
+		http.Error(res, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
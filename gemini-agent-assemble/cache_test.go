@@ -0,0 +1,38 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestCacheKeysDataVersion(t *testing.T) {
+	version := "1"
+	agent := &Agent{dataVersion: func(ctx context.Context) string { return version }}
+	ctx := context.Background()
+	funcall := genai.FunctionCall{Name: "queryDatabase", Args: map[string]any{"ticker": " aapl"}}
+
+	response := agent.responseKey(ctx, "Apple's close price?", ModeReAct, nil)
+	tool, err := agent.toolKey(ctx, funcall)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// trivially different requests share the entries
+	if again := agent.responseKey(ctx, "  apple's CLOSE price", ModeReAct, nil); again != response {
+		t.Errorf("normalised input key %s, want %s", again, response)
+	}
+
+	// a reload in another process moves onto new entries
+	version = "2"
+	if agent.responseKey(ctx, "Apple's close price?", ModeReAct, nil) == response {
+		t.Error("response key kept over a data version bump")
+	}
+	bumped, err := agent.toolKey(ctx, funcall)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bumped == tool {
+		t.Error("tool key kept over a data version bump")
+	}
+}
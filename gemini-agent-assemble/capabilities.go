@@ -0,0 +1,198 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Capability discovery routines
+/////////
+
+// published description of what an agent service can do
+type Capabilities struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Version     string         `json:"version"`
+	InputSchema map[string]any `json:"inputSchema"`
+	Examples    []string       `json:"examples,omitempty"`
+}
+
+// version of the agent services, published in the capabilities and part of the response cache key
+// set at build time with -ldflags "-X stock-agent/gemini-agent-assemble.Version=<version>"
+var Version = "1.0.0"
+
+// json schema of the base agent request
+var requestInputSchema = map[string]any{
+	"type": "object",
+	"properties": map[string]any{
+		"input": map[string]any{
+			"type":        "string",
+			"description": "The natural language request message for the agent",
+		},
+		"attachments": map[string]any{
+			"type":        "array",
+			"description": "Images or documents for the request, as base64 data or a file under the agent attachments directory",
+			"items": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"name":     map[string]any{"type": "string"},
+					"mimeType": map[string]any{"type": "string"},
+					"data":     map[string]any{"type": "string", "contentEncoding": "base64"},
+					"file":     map[string]any{"type": "string"},
+				},
+			},
+		},
+		"mode": map[string]any{
+			"type":        "string",
+			"enum":        []string{ModeReAct, ModePlan},
+			"description": "How the agent orchestrates its tools, the agent default when not set",
+		},
+		"sessionId": map[string]any{
+			"type":        "string",
+			"description": "Conversation to continue across requests",
+		},
+	},
+	"required": []string{"input"},
+}
+
+// set the capabilities published at /capabilities, the build Version when none is given
+func (agent *Agent) SetCapabilities(capabilities Capabilities) {
+	if capabilities.Version == "" {
+		capabilities.Version = Version
+	}
+	if capabilities.InputSchema == nil {
+		capabilities.InputSchema = requestInputSchema
+	}
+	agent.capabilities = capabilities
+}
+
+// get the published capabilities
+func (agent *Agent) Capabilities() Capabilities {
+	return agent.capabilities
+}
+
+// capabilities handler at /capabilities
+func (agent *Agent) HandleCapabilitiesRequest(res http.ResponseWriter, req *http.Request) {
+
+	// check for get
+	if req.Method != "GET" {
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if agent.capabilities.Name == "" {
+		http.Error(res, "Not Found", http.StatusNotFound)
+		return
+	}
+	writeJSON(res, http.StatusOK, agent.capabilities)
+}
+
+//////////////////////////////////////////
+// runtime client tools for remote agents
+
+// remote agent service with its generated client tool description
+type RemoteAgent struct {
+	Endpoint     string
+	Capabilities Capabilities
+	Declaration  *genai.FunctionDeclaration
+	Client       AgentClient
+}
+
+// fetch the capabilities of the agent at the endpoint (http://<hostname>:<port>) and build its client
+func DiscoverAgent(endpoint string) (*RemoteAgent, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(endpoint, "/") + "/capabilities")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("capabilities request to " + endpoint + " failed: " + resp.Status)
+	}
+
+	var capabilities Capabilities
+	err = json.NewDecoder(resp.Body).Decode(&capabilities)
+	if err != nil {
+		return nil, err
+	}
+	if capabilities.Name == "" {
+		return nil, errors.New("capabilities from " + endpoint + " have no name")
+	}
+
+	return NewRemoteAgent(endpoint, capabilities)
+}
+
+// build the client for an agent with known capabilities, using the AGENT_TRANSPORT transport
+func NewRemoteAgent(endpoint string, capabilities Capabilities) (*RemoteAgent, error) {
+	client, err := NewAgentClient(AgentTransport(), endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	description := capabilities.Description
+	if len(capabilities.Examples) > 0 {
+		description += " Example requests: " + strings.Join(capabilities.Examples, "; ")
+	}
+
+	return &RemoteAgent{
+		Endpoint:     strings.TrimSuffix(endpoint, "/"),
+		Capabilities: capabilities,
+		Client:       client,
+		Declaration: &genai.FunctionDeclaration{
+			Name:        remoteToolName(capabilities.Name),
+			Description: description,
+			Parameters: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"message": {
+						Type:        genai.TypeString,
+						Description: "The natural language request message for the " + capabilities.Name,
+					},
+				},
+				Required: []string{"message"},
+			},
+		},
+	}, nil
+}
+
+// function name for a remote agent, e.g. databaseAgent -> callDatabaseAgent
+func remoteToolName(name string) string {
+	var builder strings.Builder
+	upper := true
+	for _, char := range name {
+		isLetter := (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+		isDigit := char >= '0' && char <= '9'
+		if !isLetter && !isDigit {
+			// drop separators and capitalize the next word
+			upper = true
+			continue
+		}
+		if upper {
+			builder.WriteString(strings.ToUpper(string(char)))
+			upper = false
+		} else {
+			builder.WriteRune(char)
+		}
+	}
+	return "call" + builder.String()
+}
+
+// client tool for the remote agent, forwarding the attachments of the request in the context
+func (remote *RemoteAgent) Call(ctx context.Context, message string) (string, error) {
+	log.Println("running " + remote.Declaration.Name + " tool for :" + message)
+
+	ctx, cancel := context.WithTimeout(ctx, AgentTimeout())
+	defer cancel()
+	response, err := remote.Client.Ask(ctx, Request{Input: message, Attachments: AttachmentsFromContext(ctx)})
+	if err != nil {
+		return "", err
+	}
+	return response.Content, nil
+}
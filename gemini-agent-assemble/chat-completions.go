@@ -0,0 +1,376 @@
+package geminiagentassemble
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/////////
+// OpenAI compatible chat completions routines
+/////////
+
+// chat completions request and message
+type chatCompletionRequest struct {
+	Model         string        `json:"model"`
+	Messages      []chatMessage `json:"messages"`
+	Stream        bool          `json:"stream"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options,omitempty"`
+}
+type chatMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// chat completions response, also used for the stream chunks
+type chatCompletion struct {
+	ID      string       `json:"id"`
+	Object  string       `json:"object"`
+	Created int64        `json:"created"`
+	Model   string       `json:"model"`
+	Choices []chatChoice `json:"choices"`
+	Usage   *chatUsage   `json:"usage,omitempty"`
+}
+type chatChoice struct {
+	Index        int          `json:"index"`
+	Message      *chatContent `json:"message,omitempty"`
+	Delta        *chatContent `json:"delta,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+type chatContent struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+type chatUsage struct {
+	PromptTokens     int32 `json:"prompt_tokens"`
+	CompletionTokens int32 `json:"completion_tokens"`
+	TotalTokens      int32 `json:"total_tokens"`
+}
+
+// size of the content pieces in a streamed reply
+const chatStreamChunk = 64
+
+// interval of the keep-alive comments while a streamed reply is worked on
+const chatKeepAlive = 15 * time.Second
+
+// serve another agent (or this one under another name) as a chat completions model
+func (agent *Agent) AddChatModel(name string, target *Agent) {
+	if agent.chatModels == nil {
+		agent.chatModels = map[string]*Agent{}
+	}
+	agent.chatModels[name] = target
+}
+
+// find the agent for a model name, this agent serves its own name and the empty name
+func (agent *Agent) chatModel(name string) (*Agent, string) {
+	if target, exists := agent.chatModels[name]; exists {
+		return target, name
+	}
+	if name == "" || name == agent.capabilities.Name {
+		return agent, agent.mcpAgentToolName()
+	}
+	return nil, name
+}
+
+// write an openai style error
+func writeChatError(res http.ResponseWriter, status int, errType string, message string) {
+	writeJSON(res, status, map[string]any{
+		"error": map[string]any{
+			"message": message,
+			"type":    errType,
+			"code":    nil,
+		},
+	})
+}
+
+// text of a message content, either a string or a list of typed parts
+func chatMessageText(content json.RawMessage) string {
+	var text string
+	if json.Unmarshal(content, &text) == nil {
+		return text
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	json.Unmarshal(content, &parts)
+	var texts []string
+	for _, part := range parts {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// images and files sent inline as data urls in the user messages
+func chatAttachments(messages []chatMessage) ([]Attachment, error) {
+	var attachments []Attachment
+	for _, message := range messages {
+		if message.Role != "user" {
+			continue
+		}
+		var parts []struct {
+			Type     string `json:"type"`
+			ImageURL struct {
+				URL string `json:"url"`
+			} `json:"image_url"`
+			File struct {
+				Filename string `json:"filename"`
+				FileData string `json:"file_data"`
+			} `json:"file"`
+		}
+		if json.Unmarshal(message.Content, &parts) != nil {
+			continue
+		}
+		for _, part := range parts {
+			var name, url string
+			switch part.Type {
+			case "image_url":
+				url = part.ImageURL.URL
+			case "file":
+				name, url = part.File.Filename, part.File.FileData
+			default:
+				continue
+			}
+			mimeType, data, err := parseDataURL(url)
+			if err != nil {
+				return nil, err
+			}
+			attachments = append(attachments, Attachment{Name: name, MIMEType: mimeType, Data: data})
+		}
+	}
+	return attachments, nil
+}
+
+// decode a data:<mime type>;base64,<data> url, remote urls are not fetched
+func parseDataURL(url string) (string, []byte, error) {
+	header, encoded, found := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	if !strings.HasPrefix(url, "data:") || !found || !strings.HasSuffix(header, ";base64") {
+		return "", nil, errors.New("only base64 data urls are supported for attachments")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.TrimSuffix(header, ";base64"), data, nil
+}
+
+// fold the chat history into a single agent input
+func chatInput(messages []chatMessage) string {
+	var instructions []string
+	var turns []chatMessage
+	for _, message := range messages {
+		if message.Role == "system" || message.Role == "developer" {
+			instructions = append(instructions, chatMessageText(message.Content))
+		} else {
+			turns = append(turns, message)
+		}
+	}
+
+	// a lone user message is passed as is
+	var input strings.Builder
+	if len(instructions) > 0 {
+		input.WriteString("Instructions: " + strings.Join(instructions, "\n") + "\n\n")
+	}
+	if len(turns) == 1 {
+		input.WriteString(chatMessageText(turns[0].Content))
+		return input.String()
+	}
+	input.WriteString("Conversation so far:\n")
+	for _, turn := range turns {
+		input.WriteString(turn.Role + ": " + chatMessageText(turn.Content) + "\n")
+	}
+	input.WriteString("\nRespond to the last user message.")
+	return input.String()
+}
+
+// model list handler at /v1/models
+func (agent *Agent) HandleModelsRequest(res http.ResponseWriter, req *http.Request) {
+
+	// check for get
+	if req.Method != "GET" {
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	names := []string{agent.mcpAgentToolName()}
+	for name := range agent.chatModels {
+		if name != names[0] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	models := []map[string]any{}
+	for _, name := range names {
+		models = append(models, map[string]any{
+			"id":       name,
+			"object":   "model",
+			"created":  0,
+			"owned_by": "stock-agent",
+		})
+	}
+	writeJSON(res, http.StatusOK, map[string]any{"object": "list", "data": models})
+}
+
+// chat completions handler at /v1/chat/completions
+func (agent *Agent) HandleChatCompletionsRequest(res http.ResponseWriter, req *http.Request) {
+
+	// check for post
+	if req.Method != "POST" {
+		writeChatError(res, http.StatusMethodNotAllowed, "invalid_request_error", "only POST is supported")
+		return
+	}
+	// decode the body
+	var reqBody chatCompletionRequest
+	err := json.NewDecoder(req.Body).Decode(&reqBody)
+	if err != nil {
+		writeChatError(res, http.StatusBadRequest, "invalid_request_error", "invalid json body")
+		return
+	}
+	if len(reqBody.Messages) == 0 {
+		writeChatError(res, http.StatusBadRequest, "invalid_request_error", "messages must not be empty")
+		return
+	}
+	target, model := agent.chatModel(reqBody.Model)
+	if target == nil {
+		writeChatError(res, http.StatusNotFound, "invalid_request_error", "the model '"+reqBody.Model+"' does not exist")
+		return
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		writeChatError(res, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	completion := chatCompletion{
+		ID:      "chatcmpl-" + id,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+	}
+	attachments, err := chatAttachments(reqBody.Messages)
+	if err != nil {
+		writeChatError(res, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	// the messages carry the whole conversation, so each request gets a session of its own
+	request := Request{Input: chatInput(reqBody.Messages), Attachments: attachments, SessionID: ephemeralSessionPrefix + completion.ID}
+
+	if reqBody.Stream {
+		includeUsage := reqBody.StreamOptions != nil && reqBody.StreamOptions.IncludeUsage
+		target.streamChatCompletion(res, req, completion, request, includeUsage)
+		return
+	}
+
+	// call the agent
+	response, err := target.Ask(req.Context(), request, nil)
+	if err != nil {
+		log.Println("chat completion error:", err)
+		writeChatError(res, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	stop := "stop"
+	completion.Choices = []chatChoice{{
+		Message:      &chatContent{Role: "assistant", Content: response.Content},
+		FinishReason: &stop,
+	}}
+	completion.Usage = toChatUsage(response.Usage)
+	writeJSON(res, http.StatusOK, completion)
+}
+
+func toChatUsage(usage *Usage) *chatUsage {
+	if usage == nil {
+		return &chatUsage{}
+	}
+	return &chatUsage{
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+	}
+}
+
+// run the request and send the reply as server sent event chunks
+// the answer is only sent once the agent is done, until then the tool steps and
+// keep-alives are sent as sse comments to hold the connection open
+func (agent *Agent) streamChatCompletion(res http.ResponseWriter, req *http.Request, completion chatCompletion, request Request, includeUsage bool) {
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		writeChatError(res, http.StatusInternalServerError, "server_error", "streaming not supported")
+		return
+	}
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	completion.Object = "chat.completion.chunk"
+
+	// the steps and keep-alives are written from other goroutines
+	var writeMu sync.Mutex
+	comment := func(text string) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		res.Write([]byte(": " + text + "\n\n"))
+		flusher.Flush()
+	}
+	send := func(choices []chatChoice, usage *chatUsage) {
+		chunk := completion
+		chunk.Choices = choices
+		chunk.Usage = usage
+		chunkDat, _ := json.Marshal(chunk)
+		res.Write([]byte("data: " + string(chunkDat) + "\n\n"))
+		flusher.Flush()
+	}
+
+	// open with the role
+	send([]chatChoice{{Delta: &chatContent{Role: "assistant"}}}, nil)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(chatKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				comment("keep-alive")
+			}
+		}
+	}()
+	response, err := agent.Ask(req.Context(), request, func(step Step) {
+		comment("tool " + step.Tool)
+	})
+	close(done)
+	<-stopped
+	if err != nil {
+		log.Println("chat completion error:", err)
+		errDat, _ := json.Marshal(map[string]any{"error": map[string]any{"message": err.Error(), "type": "server_error"}})
+		res.Write([]byte("data: " + string(errDat) + "\n\n"))
+		res.Write([]byte("data: [DONE]\n\n"))
+		flusher.Flush()
+		return
+	}
+
+	// the content in pieces, keeping multi-byte characters whole
+	content := []rune(response.Content)
+	for start := 0; start < len(content); start += chatStreamChunk {
+		end := min(start+chatStreamChunk, len(content))
+		send([]chatChoice{{Delta: &chatContent{Content: string(content[start:end])}}}, nil)
+	}
+	stop := "stop"
+	send([]chatChoice{{Delta: &chatContent{}, FinishReason: &stop}}, nil)
+	if includeUsage {
+		send([]chatChoice{}, toChatUsage(response.Usage))
+	}
+	res.Write([]byte("data: [DONE]\n\n"))
+	flusher.Flush()
+}
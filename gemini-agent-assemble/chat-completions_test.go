@@ -0,0 +1,66 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// agent on the openai adapter against the stub model, with the default session started
+func stubAgent(t *testing.T, stub *stubModel) *Agent {
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	t.Setenv("AGENT_CACHE", "")
+	t.Setenv("MODEL_PROVIDER", ProviderOpenAI)
+	t.Setenv("MODEL_NAME", "stub-model")
+	t.Setenv("MODEL_BASE_URL", server.URL)
+	t.Setenv("MODEL_API_KEY", "test-key")
+	system := "be brief"
+	agent, err := InitAgent(context.Background(), &system, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { agent.Close() })
+	agent.NewSession()
+	return agent
+}
+
+func TestChatCompletionsSessions(t *testing.T) {
+	stub := &stubModel{t: t, replies: []string{
+		`{"choices": [{"message": {"role": "assistant", "content": "Final Answer: first"}}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Final Answer: second"}}]}`,
+	}}
+	agent := stubAgent(t, stub)
+
+	for idx, question := range []string{"what did apple close at", "what did msft close at"} {
+		body := `{"model": "", "messages": [{"role": "user", "content": "` + question + `"}]}`
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		res := httptest.NewRecorder()
+		agent.HandleChatCompletionsRequest(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("status = %d, body %s", res.Code, res.Body)
+		}
+		var completion chatCompletion
+		err := json.Unmarshal(res.Body.Bytes(), &completion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(completion.Choices) != 1 || !strings.Contains(completion.Choices[0].Message.Content, []string{"first", "second"}[idx]) {
+			t.Errorf("choices = %+v, want the model answer", completion.Choices)
+		}
+	}
+
+	// each request starts its own conversation, rather than continuing the last caller's
+	for idx, request := range stub.requests {
+		if len(request.Messages) != 2 || request.Messages[0].Role != "system" || request.Messages[1].Role != "user" {
+			t.Errorf("request %d messages = %+v, want the system instruction and one user message", idx, request.Messages)
+		}
+	}
+	// and the one request sessions are dropped
+	if len(agent.sessions) != 0 {
+		t.Errorf("got %d sessions kept, want none", len(agent.sessions))
+	}
+}
@@ -4,12 +4,19 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
+	agentcache "stock-agent/agent-cache"
+
 	"github.com/google/generative-ai-go/genai"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/api/option"
 )
 
@@ -19,32 +26,145 @@ import (
 
 // agent context handle
 type Agent struct {
-	ctx      context.Context
-	Client   *genai.Client
-	model    *genai.GenerativeModel
-	session  *genai.ChatSession
-	system   *string
-	tools    []*genai.Tool
-	toolCall func(funcall genai.FunctionCall) (string, error)
+	ctx     context.Context
+	Client  *genai.Client
+	model   *genai.GenerativeModel
+	session chatSession
+	// copy of the model used by the chat session, see sessionModel
+	sessionModel *genai.GenerativeModel
+	provider     *modelProvider
+	// agent specific model variables, see WithEnvSettings
+	modelEnvPrefix string
+	system         *string
+	tools          []*genai.Tool
+	toolCall       func(ctx context.Context, funcall genai.FunctionCall) (string, error)
+	// serializes use of the chat session across requests
+	mu sync.Mutex
+	// conversations by session id
+	sessionsMu sync.Mutex
+	sessions   map[string]*conversation
+	// guards the tools and their policies for readers outside of a request
+	toolsMu           sync.RWMutex
+	toolPolicies      map[string]ToolPolicy
+	defaultToolPolicy ToolPolicy
+	// policies from the env, see WithEnvSettings
+	configuredPolicies map[string]ToolPolicy
+	// high risk tool calls waiting for a human decision
+	approvalsMu sync.Mutex
+	approvals   map[string]*pendingApproval
+	// published description of the agent service
+	capabilities Capabilities
+	// agents served as chat completion models by name
+	chatModels map[string]*Agent
+	// tools from external mcp servers
+	mcpConns   []mcpConn
+	mcpRoutes  map[string]mcpRoute
+	mcpToolset *genai.Tool
+	// default request mode
+	mode string
+	// response and tool result cache, nil when caching is off
+	cache       agentcache.Cache
+	responseTTL time.Duration
+	toolTTL     time.Duration
+	// version of the data behind the entries, see WithDataVersion
+	dataVersion func(ctx context.Context) string
+	// async job state and the cancel handles of running jobs
+	jobs       JobStore
+	jobsMu     sync.Mutex
+	jobCancels map[string]context.CancelFunc
+	// agent specific resources released by Close
+	closers []func()
+}
+
+// optional agent configuration applied by InitAgent
+type Option func(agent *Agent) error
+
+// agent option to configure the agent from its env vars, for a prefix such as DATABASE_AGENT:
+// <PREFIX>_MODEL_PROVIDER, _MODEL_NAME, _MODEL_BASE_URL and _MODEL_API_KEY model settings, over the MODEL_* ones
+// <PREFIX>_MCP_SERVERS external mcp tool servers, see MCPServersFromEnv
+// <PREFIX>_TOOL_POLICIES tool policies, kept over the built-in ones, see ToolPoliciesFromEnv
+// <PREFIX>_MODE the mode for requests that do not set one, react or plan
+func WithEnvSettings(prefix string) Option {
+	return func(agent *Agent) error {
+		agent.modelEnvPrefix = prefix
+
+		servers, err := MCPServersFromEnv(prefix + "_MCP_SERVERS")
+		if err != nil {
+			return err
+		}
+		err = WithMCPServers(servers...)(agent)
+		if err != nil {
+			return err
+		}
+
+		policies, err := ToolPoliciesFromEnv(prefix + "_TOOL_POLICIES")
+		if err != nil {
+			return err
+		}
+		for name, policy := range policies {
+			agent.SetToolPolicy(name, policy)
+		}
+		agent.configuredPolicies = policies
+
+		if mode, ok := os.LookupEnv(prefix + "_MODE"); ok {
+			return agent.SetMode(mode)
+		}
+		return nil
+	}
 }
 
 // initializer
-func InitAgent(ctx context.Context, system *string, tools []*genai.Tool, toolCall func(funcall genai.FunctionCall) (string, error)) (*Agent, error) {
+// the tool call context carries the request attachments for forwarding to downstream agents
+func InitAgent(ctx context.Context, system *string, tools []*genai.Tool, toolCall func(ctx context.Context, funcall genai.FunctionCall) (string, error), options ...Option) (*Agent, error) {
 
-	// get the api key
-	apiKey, ok := os.LookupEnv("GEMINI_API_KEY")
-	if !ok {
-		return nil, errors.New("environment variable GEMINI_API_KEY not set")
+	// get the cache backend, off unless AGENT_CACHE is set
+	cache, err := agentcache.FromEnv(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// populate the agent
+	agent := Agent{
+		ctx:      ctx,
+		system:   system,
+		tools:    tools,
+		toolCall: toolCall,
+		jobs:     NewMemoryJobStore(),
+		// caching
+		cache:       cache,
+		responseTTL: agentcache.TTLFromEnv("AGENT_CACHE_RESPONSE_TTL_SECONDS", defaultResponseTTL),
+		toolTTL:     agentcache.TTLFromEnv("AGENT_CACHE_TOOL_TTL_SECONDS", defaultToolTTL),
+	}
+
+	// apply the options
+	for _, option := range options {
+		err = option(&agent)
+		if err != nil {
+			agent.Close()
+			return nil, err
+		}
 	}
 
-	// create a new genai client
-	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	// get the model provider, gemini unless MODEL_PROVIDER is set
+	agent.provider, err = modelProviderFromEnv(agent.modelEnvPrefix)
 	if err != nil {
+		agent.Close()
 		return nil, err
 	}
 
-	// select the model and configure to be a NL text agent
-	model := client.GenerativeModel("gemini-2.0-flash-exp")
+	// create a new genai client, other providers only use the model settings
+	agent.model = &genai.GenerativeModel{}
+	if agent.provider.name == ProviderGemini {
+		agent.Client, err = genai.NewClient(ctx, option.WithAPIKey(agent.provider.apiKey))
+		if err != nil {
+			agent.Close()
+			return nil, err
+		}
+		agent.model = agent.Client.GenerativeModel(agent.provider.model)
+	}
+
+	// configure the model to be a NL text agent
+	model := agent.model
 	model.SetTemperature(0)
 	model.SetTopK(40)
 	model.SetTopP(0.95)
@@ -52,45 +172,166 @@ func InitAgent(ctx context.Context, system *string, tools []*genai.Tool, toolCal
 	if system != nil {
 		model.SystemInstruction = genai.NewUserContent(genai.Text(*system))
 	}
-	if tools != nil {
-		model.Tools = tools
-	}
 	model.ResponseMIMEType = "text/plain"
 
-	// populate the agent and return
-	agent := Agent{
-		ctx:      ctx,
-		Client:   client,
-		model:    model,
-		system:   system,
-		tools:    tools,
-		toolCall: toolCall,
+	// declare all the tools to the model
+	if tools := agent.allTools(); tools != nil {
+		model.Tools = tools
 	}
 
 	return &agent, nil
 }
 
+// replace the tools available to the model, sessions pick them up on their next request
+func (agent *Agent) SetTools(tools []*genai.Tool) {
+	agent.toolsMu.Lock()
+	defer agent.toolsMu.Unlock()
+	agent.tools = tools
+	agent.model.Tools = agent.allTools()
+}
+
+// a copy of the model for a session, so the tools can change while it is in use
+func (agent *Agent) copyModel() *genai.GenerativeModel {
+	agent.toolsMu.RLock()
+	defer agent.toolsMu.RUnlock()
+	model := *agent.model
+	return &model
+}
+
+// bring the tools of a session model up to date, must be called with the session held
+func (agent *Agent) refreshTools(model *genai.GenerativeModel) {
+	agent.toolsMu.RLock()
+	defer agent.toolsMu.RUnlock()
+	model.Tools = agent.model.Tools
+}
+
+// the agent tools plus any from mcp servers
+func (agent *Agent) allTools() []*genai.Tool {
+	if agent.mcpToolset == nil || len(agent.mcpToolset.FunctionDeclarations) == 0 {
+		return agent.tools
+	}
+	return append(append([]*genai.Tool{}, agent.tools...), agent.mcpToolset)
+}
+
+// release the agent resources
+func (agent *Agent) Close() {
+	for _, closer := range agent.closers {
+		closer()
+	}
+	agent.closers = nil
+	agent.closeMCPConns()
+	if agent.Client != nil {
+		agent.Client.Close()
+	}
+}
+
+// release an agent specific resource on Close, e.g. a database client
+func (agent *Agent) OnClose(closer func()) {
+	agent.closers = append(agent.closers, closer)
+}
+
 func (agent *Agent) NewSession() {
-	agent.session = agent.model.StartChat()
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	agent.sessionModel = agent.copyModel()
+	agent.session = agent.startSession(agent.sessionModel)
+}
+
+// start a chat session on the model with the agent provider
+func (agent *Agent) startSession(model *genai.GenerativeModel) chatSession {
+	if agent.provider.name == ProviderGemini {
+		return model.StartChat()
+	}
+	return newOpenAISession(agent.provider, model)
 }
 
 // call agent and run tools as required before returning the result
 // pre-determined graph flow of request, call tools as required, return final answer
 func (agent *Agent) CallAgent(message string) (string, error) {
+	response, err := agent.Ask(agent.ctx, Request{Input: message}, nil)
+	if err != nil {
+		return "", err
+	}
+	return response.Content, nil
+}
+
+// a single tool call made while answering a request
+type Step struct {
+	Tool       string         `json:"tool"`
+	PlanStep   string         `json:"planStep,omitempty"`
+	Args       map[string]any `json:"args,omitempty"`
+	Result     string         `json:"result,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Suspicious []string       `json:"suspicious,omitempty"`
+	Cached     bool           `json:"cached,omitempty"`
+	Started    time.Time      `json:"started"`
+	DurationMs int64          `json:"durationMs"`
+}
+
+// cap on the tool result kept in a step
+const maxStepResult = 1000
+
+// run the request through the agent, reporting each tool step to the observer (can be nil)
+// the context cancels the request between model cycles
+func (agent *Agent) Ask(ctx context.Context, request Request, observer func(Step)) (*Response, error) {
 
 	// check we have a session
-	if agent.session == nil {
-		err := errors.New("CallAgent(): no session configued. run NewSession() first")
+	if agent.session == nil && request.SessionID == "" {
+		err := errors.New("Ask(): no session configued. run NewSession() first")
 		log.Println(err)
-		return "", err
+		return nil, err
+	}
+
+	// one request sessions are dropped once answered
+	if ephemeralSession(request.SessionID) {
+		defer agent.endSession(request.SessionID)
+	}
+
+	// load any attachment files and pass them on to the tools
+	attachments, err := resolveAttachments(request.Attachments)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	ctx = ContextWithAttachments(ctx, attachments)
+
+	mode, err := agent.requestMode(request)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	// answer repeated requests from the cache, session answers depend on the conversation
+	responseKey := agent.responseKey(ctx, request.Input, mode, attachments)
+	cacheable := request.SessionID == "" || ephemeralSession(request.SessionID)
+	if cacheable {
+		if response := agent.cachedResponse(ctx, responseKey, request.Input); response != nil {
+			return response, nil
+		}
 	}
 
+	// plan mode works outside the chat session
+	state := &requestState{observer: observer, cacheable: cacheable}
+	if mode == ModePlan {
+		response, err := agent.askPlan(ctx, request, attachments, state)
+		if err == nil && state.cacheable {
+			agent.cacheResponse(ctx, responseKey, response)
+		}
+		return response, err
+	}
+
+	// one request at a time on the session
+	session, unlock := agent.requestSession(request.SessionID)
+	defer unlock()
+
 	// make the initial request
-	resp, err := agent.session.SendMessage(agent.ctx, genai.Text(message))
+	usage := &Usage{}
+	resp, err := session.SendMessage(ctx, requestParts(request.Input, attachments)...)
 	if err != nil {
 		log.Println(err)
-		return "", err
+		return nil, err
 	}
+	usage.add(resp.UsageMetadata)
 
 	// set max runs to 25
 	for idx := 0; idx < 25; idx++ {
@@ -101,10 +342,10 @@ func (agent *Agent) CallAgent(message string) (string, error) {
 			funcall, ok := part.(genai.FunctionCall)
 			if ok {
 				// call the agent specific handler to get the response
-				result, err := agent.toolCall(funcall)
+				result, err := agent.requestTool(ctx, funcall, "", state)
 				if err != nil {
 					log.Println(err)
-					return "", err
+					return nil, err
 				}
 				// save the result in the result slice
 				funcResult := genai.FunctionResponse{
@@ -121,28 +362,148 @@ func (agent *Agent) CallAgent(message string) (string, error) {
 			if len(funcResults) == 0 && ok {
 				// drop out with the reply
 				log.Println("agent reply: " + content)
-				return string(content), nil
+				response := &Response{Content: string(content), Usage: usage}
+				if state.cacheable {
+					agent.cacheResponse(ctx, responseKey, response)
+				}
+				return response, nil
 			}
 		}
 
+		// stop here if the request was cancelled while the tools ran
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		// pass the result back to the session
-		resp, err = agent.session.SendMessage(agent.ctx, funcResults...)
+		resp, err = session.SendMessage(ctx, funcResults...)
 		if err != nil {
 			log.Println(err)
-			return "", err
+			return nil, err
 		}
+		usage.add(resp.UsageMetadata)
 	}
 
 	// if we are here we ran out of cycles
-	return "", errors.New("message cycles exceeded")
+	return nil, errors.New("message cycles exceeded")
+}
+
+// tool call state shared over a request, safe for parallel tool calls
+type requestState struct {
+	mu       sync.Mutex
+	observer func(Step)
+	// the first tool with suspicious output, high risk calls are blocked after it
+	suspiciousTool string
+	// answers that needed a high risk tool or saw suspicious content are not cached
+	cacheable bool
+}
+
+// run a tool call for a request through the guardrails, approvals and cache, reporting the step
+// returns the result to pass to the model
+func (agent *Agent) requestTool(ctx context.Context, funcall genai.FunctionCall, planStep string, state *requestState) (string, error) {
+	step := Step{
+		Tool:     funcall.Name,
+		PlanStep: planStep,
+		Args:     funcall.Args,
+		Started:  time.Now(),
+	}
+	highRisk := agent.ToolPolicy(funcall.Name).Risk == RiskHigh
+
+	state.mu.Lock()
+	suspiciousTool := state.suspiciousTool
+	state.mu.Unlock()
+
+	var result string
+	var err error
+	if suspiciousTool != "" && guardrailsMode() == GuardrailsBlock && highRisk {
+		log.Println("guardrail: blocked " + funcall.Name + " after suspicious content in the " + suspiciousTool + " output")
+		result = "tool call blocked: high risk tools are disabled for this request after suspicious content in the " + suspiciousTool + " output"
+	} else {
+		result, step.Cached, err = agent.runTool(ctx, funcall)
+	}
+	step.DurationMs = time.Since(step.Started).Milliseconds()
+	step.Result = result
+	if len(step.Result) > maxStepResult {
+		step.Result = step.Result[:maxStepResult]
+	}
+	if err != nil {
+		step.Error = err.Error()
+	} else {
+		// scan the output and mark it as data for the model
+		result, step.Suspicious = agent.guardToolOutput(funcall.Name, result)
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if len(step.Suspicious) > 0 && state.suspiciousTool == "" {
+		state.suspiciousTool = funcall.Name
+	}
+	if len(step.Suspicious) > 0 || highRisk {
+		state.cacheable = false
+	}
+	if state.observer != nil {
+		state.observer(step)
+	}
+	return result, err
+}
+
+// run a single tool call through the agent specific handler
+// a panicking handler (e.g. a bad arg type from an external mcp client) is returned as an error
+func (agent *Agent) callTool(ctx context.Context, funcall genai.FunctionCall) (result string, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("tool %s failed: %v", funcall.Name, recovered)
+			log.Println(err)
+		}
+	}()
+	// high risk tools wait for a human decision, a refusal goes back to the model as the result
+	if agent.ToolPolicy(funcall.Name).Risk == RiskHigh {
+		approved, reason, err := agent.requestApproval(ctx, funcall)
+		if err != nil {
+			return "", err
+		}
+		if !approved {
+			return "tool call refused: " + reason, nil
+		}
+	}
+	// tools from mcp servers go to their server
+	result, handled, err := agent.callMCPServerTool(ctx, funcall)
+	if handled {
+		return result, err
+	}
+	return agent.toolCall(ctx, funcall)
 }
 
 // base agent request / response
 type Request struct {
-	Input string `json:"input"`
+	Input       string       `json:"input"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// react (default) or plan, the agent mode is used when empty
+	Mode string `json:"mode,omitempty"`
+	// conversation to continue, requests without one share the agent session
+	// ids starting with "ephemeral-" get a session of their own that ends with the request
+	SessionID string `json:"sessionId,omitempty"`
 }
 type Response struct {
 	Content string `json:"content"`
+	Usage   *Usage `json:"usage,omitempty"`
+	Cached  bool   `json:"cached,omitempty"`
+}
+
+// model token usage over all the cycles of a request
+type Usage struct {
+	PromptTokens     int32 `json:"promptTokens"`
+	CompletionTokens int32 `json:"completionTokens"`
+	TotalTokens      int32 `json:"totalTokens"`
+}
+
+func (usage *Usage) add(metadata *genai.UsageMetadata) {
+	if metadata == nil {
+		return
+	}
+	usage.PromptTokens += metadata.PromptTokenCount
+	usage.CompletionTokens += metadata.CandidatesTokenCount
+	usage.TotalTokens += metadata.TotalTokenCount
 }
 
 // generalized agent request handler
@@ -168,16 +529,13 @@ func (agent *Agent) HandleAgentRequest(res http.ResponseWriter, req *http.Reques
 	}
 
 	// call the agent
-	result, err := agent.CallAgent(reqBody.Input)
+	response, err := agent.Ask(req.Context(), reqBody, nil)
 	if err != nil {
 		http.Error(res, "Bad Request", http.StatusBadRequest)
 		return
 	}
 
 	// send the result back
-	response := Response{
-		Content: result,
-	}
 	res.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(res).Encode(response)
 }
@@ -194,12 +552,31 @@ func (agent *Agent) HandleRunningRequest(res http.ResponseWriter, req *http.Requ
 	// return implicit 200 OK
 }
 
-// generalized agent service at <hostname>:<port>/agent
+// generalized agent service at <hostname>:<port>/agent, with the grpc AgentService on the same port
 func (agent *Agent) RunAgent(hostname string, port string) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/agent", agent.HandleAgentRequest)
 	mux.HandleFunc("/running", agent.HandleRunningRequest)
-	go http.ListenAndServe(hostname+":"+port, mux)
+	mux.HandleFunc("/capabilities", agent.HandleCapabilitiesRequest)
+	mux.HandleFunc("/mcp", agent.HandleMCPRequest)
+	mux.HandleFunc("/v1/chat/completions", agent.HandleChatCompletionsRequest)
+	mux.HandleFunc("/v1/models", agent.HandleModelsRequest)
+	mux.HandleFunc("/jobs", agent.HandleJobsRequest)
+	mux.HandleFunc("/jobs/{id}", agent.HandleJobRequest)
+	mux.HandleFunc("/jobs/{id}/result", agent.HandleJobResultRequest)
+	mux.HandleFunc("/approvals", agent.HandleApprovalsRequest)
+	mux.HandleFunc("/approvals/{id}", agent.HandleApprovalRequest)
+	mux.HandleFunc("/cache", agent.HandleCacheRequest)
+	// grpc shares the port over cleartext http/2
+	grpcServer := agent.newGRPCServer()
+	handler := h2c.NewHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor == 2 && strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+			grpcServer.ServeHTTP(res, req)
+			return
+		}
+		mux.ServeHTTP(res, req)
+	}), &http2.Server{})
+	go http.ListenAndServe(hostname+":"+port, handler)
 	// ping the agent to make sure its ready
 	ready := false
 	for idx := 0; idx < 10 && !ready; idx++ {
@@ -0,0 +1,263 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"stock-agent/gemini-agent-assemble/agentpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+/////////
+// gRPC transport routines
+/////////
+
+// grpc agent service backed by the agent
+type grpcAgentServer struct {
+	agentpb.UnimplementedAgentServiceServer
+	agent *Agent
+}
+
+// grpc server for the agent, served on the same port as the http mux by RunAgent
+func (agent *Agent) newGRPCServer() *grpc.Server {
+	server := grpc.NewServer()
+	agentpb.RegisterAgentServiceServer(server, &grpcAgentServer{agent: agent})
+	return server
+}
+
+// map an agent error to a grpc status
+func grpcError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func toPBRequest(request Request) *agentpb.AskRequest {
+	pbRequest := &agentpb.AskRequest{Input: request.Input, Mode: request.Mode, SessionId: request.SessionID}
+	for _, attachment := range request.Attachments {
+		pbRequest.Attachments = append(pbRequest.Attachments, &agentpb.Attachment{
+			Name:     attachment.Name,
+			MimeType: attachment.MIMEType,
+			Data:     attachment.Data,
+			File:     attachment.File,
+		})
+	}
+	return pbRequest
+}
+
+func fromPBRequest(pbRequest *agentpb.AskRequest) Request {
+	request := Request{Input: pbRequest.GetInput(), Mode: pbRequest.GetMode(), SessionID: pbRequest.GetSessionId()}
+	for _, attachment := range pbRequest.GetAttachments() {
+		request.Attachments = append(request.Attachments, Attachment{
+			Name:     attachment.GetName(),
+			MIMEType: attachment.GetMimeType(),
+			Data:     attachment.GetData(),
+			File:     attachment.GetFile(),
+		})
+	}
+	return request
+}
+
+func toPBResponse(response *Response) *agentpb.AskResponse {
+	pbResponse := &agentpb.AskResponse{Content: response.Content, Cached: response.Cached}
+	if response.Usage != nil {
+		pbResponse.Usage = &agentpb.Usage{
+			PromptTokens:     response.Usage.PromptTokens,
+			CompletionTokens: response.Usage.CompletionTokens,
+			TotalTokens:      response.Usage.TotalTokens,
+		}
+	}
+	return pbResponse
+}
+
+func fromPBResponse(pbResponse *agentpb.AskResponse) *Response {
+	response := &Response{Content: pbResponse.GetContent(), Cached: pbResponse.GetCached()}
+	if pbResponse.GetUsage() != nil {
+		response.Usage = &Usage{
+			PromptTokens:     pbResponse.GetUsage().GetPromptTokens(),
+			CompletionTokens: pbResponse.GetUsage().GetCompletionTokens(),
+			TotalTokens:      pbResponse.GetUsage().GetTotalTokens(),
+		}
+	}
+	return response
+}
+
+func toPBStep(step Step) *agentpb.Step {
+	argsDat, _ := json.Marshal(step.Args)
+	return &agentpb.Step{
+		Tool:          step.Tool,
+		ArgsJson:      string(argsDat),
+		Result:        step.Result,
+		Error:         step.Error,
+		StartedUnixMs: step.Started.UnixMilli(),
+		DurationMs:    step.DurationMs,
+		Cached:        step.Cached,
+		PlanStep:      step.PlanStep,
+		Suspicious:    step.Suspicious,
+	}
+}
+
+func fromPBStep(pbStep *agentpb.Step) Step {
+	step := Step{
+		Tool:       pbStep.GetTool(),
+		Result:     pbStep.GetResult(),
+		Error:      pbStep.GetError(),
+		Started:    time.UnixMilli(pbStep.GetStartedUnixMs()),
+		DurationMs: pbStep.GetDurationMs(),
+		Cached:     pbStep.GetCached(),
+		PlanStep:   pbStep.GetPlanStep(),
+		Suspicious: pbStep.GetSuspicious(),
+	}
+	json.Unmarshal([]byte(pbStep.GetArgsJson()), &step.Args)
+	return step
+}
+
+func (server *grpcAgentServer) Ask(ctx context.Context, request *agentpb.AskRequest) (*agentpb.AskResponse, error) {
+	response, err := server.agent.Ask(ctx, fromPBRequest(request), nil)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toPBResponse(response), nil
+}
+
+func (server *grpcAgentServer) AskStream(request *agentpb.AskRequest, stream grpc.ServerStreamingServer[agentpb.AskEvent]) error {
+	response, err := server.agent.Ask(stream.Context(), fromPBRequest(request), func(step Step) {
+		err := stream.Send(&agentpb.AskEvent{Event: &agentpb.AskEvent_Step{Step: toPBStep(step)}})
+		if err != nil {
+			log.Println("AskStream step send error:", err)
+		}
+	})
+	if err != nil {
+		return grpcError(err)
+	}
+	return stream.Send(&agentpb.AskEvent{Event: &agentpb.AskEvent_Response{Response: toPBResponse(response)}})
+}
+
+func (server *grpcAgentServer) Capabilities(ctx context.Context, request *agentpb.CapabilitiesRequest) (*agentpb.CapabilitiesResponse, error) {
+	capabilities := server.agent.capabilities
+	if capabilities.Name == "" {
+		return nil, status.Error(codes.NotFound, "agent has no capabilities")
+	}
+	schemaDat, err := json.Marshal(capabilities.InputSchema)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &agentpb.CapabilitiesResponse{
+		Name:            capabilities.Name,
+		Description:     capabilities.Description,
+		Version:         capabilities.Version,
+		InputSchemaJson: string(schemaDat),
+		Examples:        capabilities.Examples,
+	}, nil
+}
+
+func (server *grpcAgentServer) Health(ctx context.Context, request *agentpb.HealthRequest) (*agentpb.HealthResponse, error) {
+	if server.agent.session == nil {
+		return &agentpb.HealthResponse{Status: agentpb.HealthResponse_STATUS_NOT_SERVING}, nil
+	}
+	return &agentpb.HealthResponse{Status: agentpb.HealthResponse_STATUS_SERVING}, nil
+}
+
+//////////////////
+// grpc agent client
+
+// shared grpc connections by target
+var grpcConnsMu sync.Mutex
+var grpcConns = map[string]*grpc.ClientConn{}
+
+func grpcConn(target string) (*grpc.ClientConn, error) {
+	grpcConnsMu.Lock()
+	defer grpcConnsMu.Unlock()
+	if conn, exists := grpcConns[target]; exists {
+		return conn, nil
+	}
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	grpcConns[target] = conn
+	return conn, nil
+}
+
+// grpc agent client
+type grpcAgentClient struct {
+	client agentpb.AgentServiceClient
+}
+
+// client for the agent at <hostname>:<port>
+func newGRPCAgentClient(target string) (*grpcAgentClient, error) {
+	conn, err := grpcConn(target)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcAgentClient{client: agentpb.NewAgentServiceClient(conn)}, nil
+}
+
+func (client *grpcAgentClient) Ask(ctx context.Context, request Request) (*Response, error) {
+	pbResponse, err := client.client.Ask(ctx, toPBRequest(request))
+	if err != nil {
+		return nil, err
+	}
+	return fromPBResponse(pbResponse), nil
+}
+
+func (client *grpcAgentClient) AskStream(ctx context.Context, request Request, observer func(Step)) (*Response, error) {
+	stream, err := client.client.AskStream(ctx, toPBRequest(request))
+	if err != nil {
+		return nil, err
+	}
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			return nil, errors.New("agent stream ended without a response")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if step := event.GetStep(); step != nil && observer != nil {
+			observer(fromPBStep(step))
+		}
+		if response := event.GetResponse(); response != nil {
+			return fromPBResponse(response), nil
+		}
+	}
+}
+
+func (client *grpcAgentClient) Capabilities(ctx context.Context) (*Capabilities, error) {
+	pbCapabilities, err := client.client.Capabilities(ctx, &agentpb.CapabilitiesRequest{})
+	if err != nil {
+		return nil, err
+	}
+	capabilities := &Capabilities{
+		Name:        pbCapabilities.GetName(),
+		Description: pbCapabilities.GetDescription(),
+		Version:     pbCapabilities.GetVersion(),
+		Examples:    pbCapabilities.GetExamples(),
+	}
+	err = json.Unmarshal([]byte(pbCapabilities.GetInputSchemaJson()), &capabilities.InputSchema)
+	if err != nil {
+		return nil, err
+	}
+	return capabilities, nil
+}
+
+func (client *grpcAgentClient) Health(ctx context.Context) error {
+	health, err := client.client.Health(ctx, &agentpb.HealthRequest{})
+	if err != nil {
+		return err
+	}
+	if health.GetStatus() != agentpb.HealthResponse_STATUS_SERVING {
+		return errors.New("agent not serving: " + health.GetStatus().String())
+	}
+	return nil
+}
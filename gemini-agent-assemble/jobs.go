@@ -0,0 +1,485 @@
+package geminiagentassemble
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/////////
+// Async job routines
+/////////
+
+// job lifecycle states
+type JobStatus string
+
+const (
+	JobPending          JobStatus = "pending"
+	JobRunning          JobStatus = "running"
+	JobAwaitingApproval JobStatus = "awaiting_approval"
+	JobCompleted        JobStatus = "completed"
+	JobFailed           JobStatus = "failed"
+	JobCancelled        JobStatus = "cancelled"
+)
+
+// check if the job has reached an end state
+func (status JobStatus) Finished() bool {
+	return status == JobCompleted || status == JobFailed || status == JobCancelled
+}
+
+// async agent request
+type JobRequest struct {
+	Request
+	CallbackURL string `json:"callbackUrl,omitempty"`
+}
+
+// async agent job state
+type Job struct {
+	ID          string    `json:"id"`
+	Status      JobStatus `json:"status"`
+	Input       string    `json:"input"`
+	Steps       []Step    `json:"steps"`
+	Result      string    `json:"result,omitempty"`
+	Usage       *Usage    `json:"usage,omitempty"`
+	Cached      bool      `json:"cached,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	CallbackURL string    `json:"callbackUrl,omitempty"`
+	Approval    *Approval `json:"approval,omitempty"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+}
+
+// job store lookup failure
+var ErrJobNotFound = errors.New("job not found")
+
+// pluggable job state storage
+// implementations must be safe for concurrent use and must not share job memory with the caller
+type JobStore interface {
+	Create(job *Job) error
+	Get(id string) (*Job, error)
+	Update(job *Job) error
+}
+
+// finished jobs are kept this long for polling, and the oldest go first past the cap
+const (
+	finishedJobTTL  = time.Hour
+	maxFinishedJobs = 1000
+)
+
+// in-memory job store, the default for a new agent
+type MemoryJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]Job
+}
+
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{jobs: map[string]Job{}}
+}
+
+func (store *MemoryJobStore) Create(job *Job) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, exists := store.jobs[job.ID]; exists {
+		return errors.New("job already exists: " + job.ID)
+	}
+	store.pruneJobs()
+	store.jobs[job.ID] = copyJob(job)
+	return nil
+}
+
+// drop the expired finished jobs, and the least recently finished over the cap
+// running jobs are kept, must be called with mu held
+func (store *MemoryJobStore) pruneJobs() {
+	var finished []string
+	for id, job := range store.jobs {
+		if !job.Status.Finished() {
+			continue
+		}
+		if time.Since(job.Updated) > finishedJobTTL {
+			delete(store.jobs, id)
+			continue
+		}
+		finished = append(finished, id)
+	}
+	if len(finished) < maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return store.jobs[finished[i]].Updated.Before(store.jobs[finished[j]].Updated)
+	})
+	for _, id := range finished[:len(finished)-maxFinishedJobs+1] {
+		delete(store.jobs, id)
+	}
+}
+
+func (store *MemoryJobStore) Get(id string) (*Job, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	job, exists := store.jobs[id]
+	if !exists {
+		return nil, ErrJobNotFound
+	}
+	job = copyJob(&job)
+	return &job, nil
+}
+
+func (store *MemoryJobStore) Update(job *Job) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, exists := store.jobs[job.ID]; !exists {
+		return ErrJobNotFound
+	}
+	store.jobs[job.ID] = copyJob(job)
+	return nil
+}
+
+// copy a job so the stored steps can't be changed from outside
+func copyJob(job *Job) Job {
+	jobCopy := *job
+	jobCopy.Steps = append([]Step(nil), job.Steps...)
+	if job.Approval != nil {
+		approval := *job.Approval
+		jobCopy.Approval = &approval
+	}
+	if job.Usage != nil {
+		usage := *job.Usage
+		jobCopy.Usage = &usage
+	}
+	return jobCopy
+}
+
+// replace the job store used by the agent
+func (agent *Agent) SetJobStore(store JobStore) {
+	agent.jobs = store
+}
+
+// random job identifier
+func newJobID() (string, error) {
+	dat := make([]byte, 16)
+	_, err := rand.Read(dat)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(dat), nil
+}
+
+// create a job for the request and run it in the background
+func (agent *Agent) SubmitJob(jobRequest JobRequest) (*Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	job := &Job{
+		ID:          id,
+		Status:      JobPending,
+		Input:       jobRequest.Input,
+		Steps:       []Step{},
+		CallbackURL: jobRequest.CallbackURL,
+		Created:     now,
+		Updated:     now,
+	}
+	err = agent.jobs.Create(job)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep the cancel handle while the job runs
+	ctx, cancel := context.WithCancel(context.Background())
+	agent.jobsMu.Lock()
+	if agent.jobCancels == nil {
+		agent.jobCancels = map[string]context.CancelFunc{}
+	}
+	agent.jobCancels[id] = cancel
+	agent.jobsMu.Unlock()
+
+	go agent.runJob(ctx, id, jobRequest.Request)
+
+	return job, nil
+}
+
+// run the job to completion, updating the store as it goes
+func (agent *Agent) runJob(ctx context.Context, id string, request Request) {
+	defer func() {
+		agent.jobsMu.Lock()
+		cancel := agent.jobCancels[id]
+		delete(agent.jobCancels, id)
+		agent.jobsMu.Unlock()
+		cancel()
+	}()
+
+	agent.updateJob(id, func(job *Job) {
+		job.Status = JobRunning
+	})
+
+	// record each tool step as it completes
+	response, err := agent.Ask(contextWithJobID(ctx, id), request, func(step Step) {
+		agent.updateJob(id, func(job *Job) {
+			job.Steps = append(job.Steps, step)
+		})
+	})
+
+	job := agent.updateJob(id, func(job *Job) {
+		switch {
+		case err == nil:
+			job.Status = JobCompleted
+			job.Result = response.Content
+			job.Usage = response.Usage
+			job.Cached = response.Cached
+		case ctx.Err() != nil:
+			job.Status = JobCancelled
+			job.Error = "job cancelled"
+		default:
+			job.Status = JobFailed
+			job.Error = err.Error()
+		}
+	})
+
+	// let the caller know
+	if job != nil && job.CallbackURL != "" {
+		postJobCallback(job)
+	}
+}
+
+// context key for the id of the job being run
+type jobIDKey struct{}
+
+func contextWithJobID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, jobIDKey{}, id)
+}
+
+// the id of the job being run, empty for a direct request
+func jobIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(jobIDKey{}).(string)
+	return id
+}
+
+// apply a change to a stored job, returning the updated job
+func (agent *Agent) updateJob(id string, change func(job *Job)) *Job {
+	agent.jobsMu.Lock()
+	defer agent.jobsMu.Unlock()
+	job, err := agent.jobs.Get(id)
+	if err != nil {
+		log.Println("job update error:", err)
+		return nil
+	}
+	change(job)
+	job.Updated = time.Now()
+	err = agent.jobs.Update(job)
+	if err != nil {
+		log.Println("job update error:", err)
+		return nil
+	}
+	return job
+}
+
+// cancel a running job
+func (agent *Agent) CancelJob(id string) error {
+	job, err := agent.jobs.Get(id)
+	if err != nil {
+		return err
+	}
+	agent.jobsMu.Lock()
+	cancel, running := agent.jobCancels[id]
+	agent.jobsMu.Unlock()
+	if job.Status.Finished() || !running {
+		return errors.New("job already " + string(job.Status))
+	}
+	cancel()
+	return nil
+}
+
+// post the finished job to its callback url
+func postJobCallback(job *Job) {
+	jobDat, err := json.Marshal(job)
+	if err != nil {
+		log.Println("job callback marshal error:", err)
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second, Transport: callbackTransport()}
+	resp, err := client.Post(job.CallbackURL, "application/json", bytes.NewBuffer(jobDat))
+	if err != nil {
+		log.Println("job callback error:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Println("job callback status:", resp.Status)
+	}
+}
+
+// callback hosts from JOB_CALLBACK_HOSTS (comma separated), nil when any public host is allowed
+func callbackHosts() map[string]bool {
+	value, ok := os.LookupEnv("JOB_CALLBACK_HOSTS")
+	if !ok || strings.TrimSpace(value) == "" {
+		return nil
+	}
+	hosts := map[string]bool{}
+	for _, host := range strings.Split(value, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts[host] = true
+		}
+	}
+	return hosts
+}
+
+// true for addresses a callback must not reach without an allowlist, e.g. loopback,
+// private networks and the link-local cloud metadata address
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
+
+// check a callback is an absolute http(s) url to an allowed host
+func validCallbackURL(callback string) bool {
+	parsed, err := url.Parse(callback)
+	if err != nil {
+		return false
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if hosts := callbackHosts(); hosts != nil {
+		return hosts[host]
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil && internalIP(ip) {
+		return false
+	}
+	return true
+}
+
+// transport for the callbacks, without an allowlist the connection is refused when the
+// host resolves to an internal address
+func callbackTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if callbackHosts() != nil {
+		return transport
+	}
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network string, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+				return errors.New("callback to internal address " + host + " refused")
+			}
+			return nil
+		},
+	}
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+	return transport
+}
+
+// write a json reply
+func writeJSON(res http.ResponseWriter, status int, value any) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(value)
+}
+
+// job submission handler at /jobs
+func (agent *Agent) HandleJobsRequest(res http.ResponseWriter, req *http.Request) {
+
+	// check for post
+	if req.Method != "POST" {
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	// check for json mime type
+	contentType := req.Header.Get("Content-Type")
+	if contentType == "" || contentType != "application/json" {
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	// decode the body
+	var reqBody JobRequest
+	err := json.NewDecoder(req.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if reqBody.CallbackURL != "" && !validCallbackURL(reqBody.CallbackURL) {
+		http.Error(res, "Bad Request: invalid callbackUrl", http.StatusBadRequest)
+		return
+	}
+
+	// start the job
+	job, err := agent.SubmitJob(reqBody)
+	if err != nil {
+		log.Println("SubmitJob():", err)
+		http.Error(res, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSON(res, http.StatusAccepted, job)
+}
+
+// job status and cancel handler at /jobs/{id}
+func (agent *Agent) HandleJobRequest(res http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+
+	switch req.Method {
+	case "GET":
+		job, err := agent.jobs.Get(id)
+		if err != nil {
+			http.Error(res, "Not Found", http.StatusNotFound)
+			return
+		}
+		writeJSON(res, http.StatusOK, job)
+	case "DELETE":
+		err := agent.CancelJob(id)
+		if errors.Is(err, ErrJobNotFound) {
+			http.Error(res, "Not Found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(res, "Conflict: "+err.Error(), http.StatusConflict)
+			return
+		}
+		res.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+	}
+}
+
+// job final result handler at /jobs/{id}/result
+func (agent *Agent) HandleJobResultRequest(res http.ResponseWriter, req *http.Request) {
+
+	// check for get
+	if req.Method != "GET" {
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	job, err := agent.jobs.Get(req.PathValue("id"))
+	if err != nil {
+		http.Error(res, "Not Found", http.StatusNotFound)
+		return
+	}
+	if job.Status != JobCompleted {
+		http.Error(res, "Conflict: job "+string(job.Status), http.StatusConflict)
+		return
+	}
+
+	writeJSON(res, http.StatusOK, Response{Content: job.Result, Usage: job.Usage, Cached: job.Cached})
+}
@@ -0,0 +1,105 @@
+package geminiagentassemble
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryJobStorePrune(t *testing.T) {
+	store := NewMemoryJobStore()
+	old := time.Now().Add(-2 * finishedJobTTL)
+	store.jobs["expired"] = Job{ID: "expired", Status: JobCompleted, Updated: old}
+	store.jobs["running"] = Job{ID: "running", Status: JobRunning, Updated: old}
+	err := store.Create(&Job{ID: "new", Status: JobPending})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("expired"); err != ErrJobNotFound {
+		t.Errorf("expired finished job kept, err = %v", err)
+	}
+	for _, id := range []string{"running", "new"} {
+		if _, err := store.Get(id); err != nil {
+			t.Errorf("job %s dropped: %v", id, err)
+		}
+	}
+
+	// past the cap the least recently finished go first
+	store = NewMemoryJobStore()
+	for idx := 0; idx < maxFinishedJobs; idx++ {
+		id := strconv.Itoa(idx)
+		store.jobs[id] = Job{ID: id, Status: JobFailed, Updated: time.Now().Add(time.Duration(idx-maxFinishedJobs) * time.Second)}
+	}
+	err = store.Create(&Job{ID: "new", Status: JobPending})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.jobs) != maxFinishedJobs {
+		t.Errorf("got %d jobs, want %d", len(store.jobs), maxFinishedJobs)
+	}
+	if _, err := store.Get("0"); err != ErrJobNotFound {
+		t.Errorf("oldest finished job kept, err = %v", err)
+	}
+}
+
+func TestValidCallbackURL(t *testing.T) {
+	for _, test := range []struct {
+		url  string
+		want bool
+	}{
+		{"https://hooks.example.com/done", true},
+		{"http://203.0.113.7:8080/jobs", true},
+		{"ftp://hooks.example.com/done", false},
+		{"/relative/path", false},
+		{"http://localhost:3200/jobs", false},
+		{"http://api.localhost/jobs", false},
+		{"http://127.0.0.1/jobs", false},
+		{"http://[::1]/jobs", false},
+		{"http://10.0.0.5/jobs", false},
+		{"http://192.168.1.20/jobs", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://0.0.0.0/jobs", false},
+	} {
+		if got := validCallbackURL(test.url); got != test.want {
+			t.Errorf("validCallbackURL(%s) = %v, want %v", test.url, got, test.want)
+		}
+	}
+
+	// an allowlist admits only its hosts, internal ones included
+	t.Setenv("JOB_CALLBACK_HOSTS", "hooks.internal, 10.0.0.5")
+	for _, test := range []struct {
+		url  string
+		want bool
+	}{
+		{"http://hooks.internal/jobs", true},
+		{"http://10.0.0.5:9000/jobs", true},
+		{"https://hooks.example.com/done", false},
+	} {
+		if got := validCallbackURL(test.url); got != test.want {
+			t.Errorf("with JOB_CALLBACK_HOSTS validCallbackURL(%s) = %v, want %v", test.url, got, test.want)
+		}
+	}
+}
+
+func TestCallbackTransportRefusesInternal(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// the dialled address is checked as well as the url, for names resolving to internal addresses
+	client := &http.Client{Timeout: 5 * time.Second, Transport: callbackTransport()}
+	_, err := client.Post(server.URL, "application/json", strings.NewReader("{}"))
+	if err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("err = %v, want the internal address refused", err)
+	}
+
+	t.Setenv("JOB_CALLBACK_HOSTS", "127.0.0.1")
+	client = &http.Client{Timeout: 5 * time.Second, Transport: callbackTransport()}
+	resp, err := client.Post(server.URL, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("allowlisted callback failed: %v", err)
+	}
+	resp.Body.Close()
+}
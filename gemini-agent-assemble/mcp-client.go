@@ -0,0 +1,650 @@
+package geminiagentassemble
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Model Context Protocol (MCP) client routines
+/////////
+
+// external mcp tool server, either a stdio command or a streamable http url
+type MCPServer struct {
+	Name    string
+	Command []string
+	URL     string
+}
+
+// parse the mcp servers from an env var of the form
+// "<name>=<command and args>;<name>=<http(s) url>"
+func MCPServersFromEnv(key string) ([]MCPServer, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var servers []MCPServer
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, target, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		target = strings.TrimSpace(target)
+		if !found || name == "" || target == "" {
+			return nil, errors.New("invalid " + key + " entry, expected <name>=<command or url>: " + entry)
+		}
+		server := MCPServer{Name: name}
+		if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+			server.URL = target
+		} else {
+			server.Command = strings.Fields(target)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// agent option to add the tools of external mcp servers
+func WithMCPServers(servers ...MCPServer) Option {
+	return func(agent *Agent) error {
+		for _, server := range servers {
+			err := agent.addMCPServer(server)
+			if err != nil {
+				return errors.New("mcp server " + server.Name + ": " + err.Error())
+			}
+		}
+		return nil
+	}
+}
+
+// transport independent mcp connection
+type mcpConn interface {
+	call(ctx context.Context, method string, params any) (json.RawMessage, error)
+	notify(method string, params any) error
+	close() error
+}
+
+// mcp tool routed to the server that provides it
+type mcpRoute struct {
+	conn     mcpConn
+	toolName string
+}
+
+// connect to the server, list its tools and add them to the agent
+func (agent *Agent) addMCPServer(server MCPServer) error {
+	var conn mcpConn
+	var err error
+	switch {
+	case server.URL != "":
+		conn = &httpMCPConn{url: server.URL, client: &http.Client{Timeout: 5 * time.Minute}}
+	case len(server.Command) > 0:
+		conn, err = startStdioMCPConn(server.Command)
+	default:
+		err = errors.New("needs a command or url")
+	}
+	if err != nil {
+		return err
+	}
+	agent.mcpConns = append(agent.mcpConns, conn)
+
+	// handshake
+	ctx, cancel := context.WithTimeout(agent.ctx, 30*time.Second)
+	defer cancel()
+	_, err = conn.call(ctx, "initialize", map[string]any{
+		"protocolVersion": mcpProtocolVersions[0],
+		"capabilities":    map[string]any{},
+		"clientInfo": map[string]any{
+			"name":    "stock-agent",
+			"version": "1.0.0",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	err = conn.notify("notifications/initialized", nil)
+	if err != nil {
+		return err
+	}
+
+	// page through the tools
+	var tools []mcpTool
+	cursor := ""
+	for {
+		params := map[string]any{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		resultDat, err := conn.call(ctx, "tools/list", params)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Tools      []mcpTool `json:"tools"`
+			NextCursor string    `json:"nextCursor"`
+		}
+		err = json.Unmarshal(resultDat, &result)
+		if err != nil {
+			return err
+		}
+		tools = append(tools, result.Tools...)
+		if result.NextCursor == "" {
+			break
+		}
+		cursor = result.NextCursor
+	}
+
+	// convert to function declarations, prefixing names that clash with existing tools
+	if agent.mcpRoutes == nil {
+		agent.mcpRoutes = map[string]mcpRoute{}
+	}
+	if agent.mcpToolset == nil {
+		agent.mcpToolset = &genai.Tool{}
+	}
+	for _, tool := range tools {
+		name := functionName(tool.Name)
+		if agent.hasTool(name) {
+			name = functionName(server.Name + "_" + tool.Name)
+		}
+		if agent.hasTool(name) {
+			log.Println("skipping duplicate mcp tool " + tool.Name + " from " + server.Name)
+			continue
+		}
+		agent.mcpToolset.FunctionDeclarations = append(agent.mcpToolset.FunctionDeclarations, &genai.FunctionDeclaration{
+			Name:        name,
+			Description: tool.Description,
+			Parameters:  jsonToSchema(tool.InputSchema),
+		})
+		agent.mcpRoutes[name] = mcpRoute{conn: conn, toolName: tool.Name}
+		// external server output is only data to the model
+		agent.SetToolPolicy(name, ToolPolicy{Untrusted: true})
+	}
+	log.Println("added " + strconv.Itoa(len(tools)) + " tools from mcp server " + server.Name)
+	return nil
+}
+
+// check if a function name is already declared to the model
+func (agent *Agent) hasTool(name string) bool {
+	for _, tool := range agent.allTools() {
+		for _, declaration := range tool.FunctionDeclarations {
+			if declaration.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// make a name valid as a function declaration name
+func functionName(name string) string {
+	var builder strings.Builder
+	for idx, char := range name {
+		valid := (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || char == '_' ||
+			(idx > 0 && ((char >= '0' && char <= '9') || char == '.' || char == '-'))
+		if valid {
+			builder.WriteRune(char)
+		} else {
+			builder.WriteRune('_')
+		}
+	}
+	result := builder.String()
+	if len(result) > 64 {
+		result = result[:64]
+	}
+	return result
+}
+
+// convert a json schema to a genai schema, keeping the parts gemini supports
+func jsonToSchema(jsonSchema map[string]any) *genai.Schema {
+	if jsonSchema == nil {
+		return nil
+	}
+	schema := &genai.Schema{}
+
+	// the type can be a list including null
+	typeName, _ := jsonSchema["type"].(string)
+	if types, ok := jsonSchema["type"].([]any); ok {
+		for _, entry := range types {
+			entryName, _ := entry.(string)
+			if entryName == "null" {
+				schema.Nullable = true
+			} else if typeName == "" {
+				typeName = entryName
+			}
+		}
+	}
+	switch typeName {
+	case "string":
+		schema.Type = genai.TypeString
+	case "number":
+		schema.Type = genai.TypeNumber
+	case "integer":
+		schema.Type = genai.TypeInteger
+	case "boolean":
+		schema.Type = genai.TypeBoolean
+	case "array":
+		schema.Type = genai.TypeArray
+	default:
+		schema.Type = genai.TypeObject
+	}
+
+	schema.Description, _ = jsonSchema["description"].(string)
+	if enum, ok := jsonSchema["enum"].([]any); ok && schema.Type == genai.TypeString {
+		for _, value := range enum {
+			if valueStr, ok := value.(string); ok {
+				schema.Enum = append(schema.Enum, valueStr)
+			}
+		}
+	}
+	if items, ok := jsonSchema["items"].(map[string]any); ok {
+		schema.Items = jsonToSchema(items)
+	} else if schema.Type == genai.TypeArray {
+		// gemini needs the item type
+		schema.Items = &genai.Schema{Type: genai.TypeString}
+	}
+	if properties, ok := jsonSchema["properties"].(map[string]any); ok {
+		schema.Properties = map[string]*genai.Schema{}
+		for name, property := range properties {
+			if propertySchema, ok := property.(map[string]any); ok {
+				schema.Properties[name] = jsonToSchema(propertySchema)
+			}
+		}
+	}
+	if required, ok := jsonSchema["required"].([]any); ok {
+		for _, name := range required {
+			if nameStr, ok := name.(string); ok {
+				schema.Required = append(schema.Required, nameStr)
+			}
+		}
+	}
+	return schema
+}
+
+// route a function call to its mcp server, returns false if it is not an mcp tool
+func (agent *Agent) callMCPServerTool(ctx context.Context, funcall genai.FunctionCall) (string, bool, error) {
+	route, exists := agent.mcpRoutes[funcall.Name]
+	if !exists {
+		return "", false, nil
+	}
+	log.Println("running mcp server tool " + route.toolName)
+
+	args := funcall.Args
+	if args == nil {
+		args = map[string]any{}
+	}
+	resultDat, err := route.conn.call(ctx, "tools/call", map[string]any{
+		"name":      route.toolName,
+		"arguments": args,
+	})
+	if err != nil {
+		return "", true, err
+	}
+	var result struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		StructuredContent json.RawMessage `json:"structuredContent"`
+		IsError           bool            `json:"isError"`
+	}
+	err = json.Unmarshal(resultDat, &result)
+	if err != nil {
+		return "", true, err
+	}
+
+	// join the text content, the model sees tool errors as results
+	var texts []string
+	for _, content := range result.Content {
+		if content.Type == "text" {
+			texts = append(texts, content.Text)
+		}
+	}
+	if len(texts) == 0 && len(result.StructuredContent) > 0 {
+		texts = append(texts, string(result.StructuredContent))
+	}
+	text := strings.Join(texts, "\n")
+	if result.IsError {
+		text = "tool error: " + text
+	}
+	return text, true, nil
+}
+
+// close the connections to the mcp servers
+func (agent *Agent) closeMCPConns() {
+	for _, conn := range agent.mcpConns {
+		err := conn.close()
+		if err != nil {
+			log.Println("mcp close error:", err)
+		}
+	}
+	agent.mcpConns = nil
+}
+
+// decode the result or error of a json-rpc response
+func rpcResult(response rpcResponse) (json.RawMessage, error) {
+	if response.Error != nil {
+		return nil, errors.New("mcp error " + strconv.Itoa(response.Error.Code) + ": " + response.Error.Message)
+	}
+	resultDat, err := json.Marshal(response.Result)
+	if err != nil {
+		return nil, err
+	}
+	return resultDat, nil
+}
+
+// outgoing json-rpc request, a notification when there is no id
+func marshalRPCRequest(id json.RawMessage, method string, params any) ([]byte, error) {
+	request := rpcRequest{
+		JSONRPC: "2.0",
+		ID:      id,
+		Method:  method,
+	}
+	if params != nil {
+		paramsDat, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		request.Params = paramsDat
+	}
+	return json.Marshal(request)
+}
+
+// incoming json-rpc message with the result kept raw
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+func (message rpcMessage) response() rpcResponse {
+	return rpcResponse{ID: message.ID, Result: message.Result, Error: message.Error}
+}
+
+//////////////////
+// stdio transport
+
+type stdioMCPConn struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	writeMu sync.Mutex
+	nextID  int64
+	mu      sync.Mutex
+	pending map[string]chan rpcResponse
+	done    chan struct{}
+}
+
+// launch the server process and start reading its replies
+func startStdioMCPConn(command []string) (*stdioMCPConn, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &stdioMCPConn{
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: map[string]chan rpcResponse{},
+		done:    make(chan struct{}),
+	}
+	go conn.read(stdout)
+	return conn, nil
+}
+
+// dispatch replies to the waiting calls until the server exits
+func (conn *stdioMCPConn) read(stdout io.Reader) {
+	defer close(conn.done)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var message rpcMessage
+		err := json.Unmarshal(scanner.Bytes(), &message)
+		if err != nil {
+			log.Println("mcp stdio parse error:", err)
+			continue
+		}
+		// we offer no client features, refuse any server requests
+		if message.Method != "" {
+			if len(message.ID) > 0 {
+				conn.write(marshalRPC(rpcResponse{ID: message.ID, Error: &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + message.Method}}))
+			}
+			continue
+		}
+		conn.mu.Lock()
+		reply, exists := conn.pending[string(message.ID)]
+		delete(conn.pending, string(message.ID))
+		conn.mu.Unlock()
+		if exists {
+			reply <- message.response()
+		}
+	}
+}
+
+func (conn *stdioMCPConn) write(message []byte) error {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	_, err := conn.stdin.Write(append(message, '\n'))
+	return err
+}
+
+func (conn *stdioMCPConn) call(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	conn.mu.Lock()
+	conn.nextID++
+	id := json.RawMessage(strconv.FormatInt(conn.nextID, 10))
+	reply := make(chan rpcResponse, 1)
+	conn.pending[string(id)] = reply
+	conn.mu.Unlock()
+	defer func() {
+		conn.mu.Lock()
+		delete(conn.pending, string(id))
+		conn.mu.Unlock()
+	}()
+
+	message, err := marshalRPCRequest(id, method, params)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.write(message)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case response := <-reply:
+		return rpcResult(response)
+	case <-conn.done:
+		return nil, errors.New("mcp server exited")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (conn *stdioMCPConn) notify(method string, params any) error {
+	message, err := marshalRPCRequest(nil, method, params)
+	if err != nil {
+		return err
+	}
+	return conn.write(message)
+}
+
+func (conn *stdioMCPConn) close() error {
+	conn.stdin.Close()
+	select {
+	case <-conn.done:
+	case <-time.After(2 * time.Second):
+		conn.cmd.Process.Kill()
+	}
+	return conn.cmd.Wait()
+}
+
+/////////////////////////////
+// streamable http transport
+
+type httpMCPConn struct {
+	url       string
+	client    *http.Client
+	mu        sync.Mutex
+	nextID    int64
+	sessionID string
+	version   string
+}
+
+func (conn *httpMCPConn) post(ctx context.Context, message []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", conn.url, bytes.NewBuffer(message))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	conn.mu.Lock()
+	if conn.sessionID != "" {
+		req.Header.Set("Mcp-Session-Id", conn.sessionID)
+	}
+	if conn.version != "" {
+		req.Header.Set("MCP-Protocol-Version", conn.version)
+	}
+	conn.mu.Unlock()
+	return conn.client.Do(req)
+}
+
+func (conn *httpMCPConn) call(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	conn.mu.Lock()
+	conn.nextID++
+	id := json.RawMessage(strconv.FormatInt(conn.nextID, 10))
+	conn.mu.Unlock()
+
+	request, err := marshalRPCRequest(id, method, params)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := conn.post(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("mcp request failed: " + resp.Status)
+	}
+	if sessionID := resp.Header.Get("Mcp-Session-Id"); sessionID != "" {
+		conn.mu.Lock()
+		conn.sessionID = sessionID
+		conn.mu.Unlock()
+	}
+
+	// the reply is either plain json or an event stream carrying it
+	var message rpcMessage
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		message, err = readEventStreamReply(resp.Body, id)
+	} else {
+		err = json.NewDecoder(resp.Body).Decode(&message)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resultDat, err := rpcResult(message.response())
+	if err != nil {
+		return nil, err
+	}
+
+	// remember the agreed protocol version for the following requests
+	if method == "initialize" {
+		var result struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		json.Unmarshal(resultDat, &result)
+		conn.mu.Lock()
+		conn.version = result.ProtocolVersion
+		conn.mu.Unlock()
+	}
+	return resultDat, nil
+}
+
+// find the reply to the request id in a server sent event stream
+func readEventStreamReply(body io.Reader, id json.RawMessage) (rpcMessage, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			continue
+		}
+		// a blank line ends the event
+		if line == "" && data.Len() > 0 {
+			var message rpcMessage
+			err := json.Unmarshal([]byte(data.String()), &message)
+			data.Reset()
+			if err == nil && message.Method == "" && string(message.ID) == string(id) {
+				return message, nil
+			}
+		}
+	}
+	if data.Len() > 0 {
+		var message rpcMessage
+		err := json.Unmarshal([]byte(data.String()), &message)
+		if err == nil && string(message.ID) == string(id) {
+			return message, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return rpcMessage{}, err
+	}
+	return rpcMessage{}, errors.New("mcp event stream ended without a reply")
+}
+
+func (conn *httpMCPConn) notify(method string, params any) error {
+	message, err := marshalRPCRequest(nil, method, params)
+	if err != nil {
+		return err
+	}
+	resp, err := conn.post(context.Background(), message)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// end the server session if there is one
+func (conn *httpMCPConn) close() error {
+	if conn.sessionID == "" {
+		return nil
+	}
+	req, err := http.NewRequest("DELETE", conn.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Mcp-Session-Id", conn.sessionID)
+	resp, err := conn.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
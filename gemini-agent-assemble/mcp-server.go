@@ -0,0 +1,311 @@
+package geminiagentassemble
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Model Context Protocol (MCP) server routines
+/////////
+
+// protocol versions this server can speak, latest first
+var mcpProtocolVersions = []string{"2025-06-18", "2025-03-26", "2024-11-05"}
+
+// json-rpc 2.0 message envelopes
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// json-rpc error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+)
+
+// mcp tool description and call result
+type mcpTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	InputSchema map[string]any `json:"inputSchema"`
+}
+type mcpContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+type mcpToolResult struct {
+	Content []mcpContent `json:"content"`
+	IsError bool         `json:"isError"`
+}
+
+// name of the mcp tool that sends a request to the agent itself
+func (agent *Agent) mcpAgentToolName() string {
+	if agent.capabilities.Name != "" {
+		return agent.capabilities.Name
+	}
+	return "agent"
+}
+
+// the agent tools plus the agent itself as mcp tools
+func (agent *Agent) mcpTools() []mcpTool {
+	description := agent.capabilities.Description
+	if description == "" {
+		description = "Make a natural language request to the agent and return the result."
+	}
+	tools := []mcpTool{{
+		Name:        agent.mcpAgentToolName(),
+		Description: description,
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"message": map[string]any{
+					"type":        "string",
+					"description": "The natural language request message for the agent",
+				},
+			},
+			"required": []string{"message"},
+		},
+	}}
+
+	agent.toolsMu.RLock()
+	defer agent.toolsMu.RUnlock()
+	for _, tool := range agent.allTools() {
+		for _, declaration := range tool.FunctionDeclarations {
+			inputSchema := schemaToJSON(declaration.Parameters)
+			if inputSchema == nil {
+				inputSchema = map[string]any{"type": "object"}
+			}
+			tools = append(tools, mcpTool{
+				Name:        declaration.Name,
+				Description: declaration.Description,
+				InputSchema: inputSchema,
+			})
+		}
+	}
+	return tools
+}
+
+// convert a genai schema to a json schema
+func schemaToJSON(schema *genai.Schema) map[string]any {
+	if schema == nil {
+		return nil
+	}
+	jsonSchema := map[string]any{}
+	switch schema.Type {
+	case genai.TypeString:
+		jsonSchema["type"] = "string"
+	case genai.TypeNumber:
+		jsonSchema["type"] = "number"
+	case genai.TypeInteger:
+		jsonSchema["type"] = "integer"
+	case genai.TypeBoolean:
+		jsonSchema["type"] = "boolean"
+	case genai.TypeArray:
+		jsonSchema["type"] = "array"
+	case genai.TypeObject:
+		jsonSchema["type"] = "object"
+	}
+	if schema.Description != "" {
+		jsonSchema["description"] = schema.Description
+	}
+	if schema.Format != "" {
+		jsonSchema["format"] = schema.Format
+	}
+	if len(schema.Enum) > 0 {
+		jsonSchema["enum"] = schema.Enum
+	}
+	if schema.Items != nil {
+		jsonSchema["items"] = schemaToJSON(schema.Items)
+	}
+	if len(schema.Properties) > 0 {
+		properties := map[string]any{}
+		for name, property := range schema.Properties {
+			properties[name] = schemaToJSON(property)
+		}
+		jsonSchema["properties"] = properties
+	}
+	if len(schema.Required) > 0 {
+		jsonSchema["required"] = schema.Required
+	}
+	return jsonSchema
+}
+
+// handle one json-rpc message, returns nil for notifications
+func (agent *Agent) HandleMCPMessage(ctx context.Context, message []byte) []byte {
+	var request rpcRequest
+	err := json.Unmarshal(message, &request)
+	if err != nil {
+		return marshalRPC(rpcResponse{ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: "parse error"}})
+	}
+	if request.JSONRPC != "2.0" || request.Method == "" {
+		// responses from the client and malformed messages need no reply
+		if len(request.ID) == 0 || request.Method == "" {
+			return nil
+		}
+		return marshalRPC(rpcResponse{ID: request.ID, Error: &rpcError{Code: rpcInvalidRequest, Message: "invalid request"}})
+	}
+	// notifications get no reply
+	if len(request.ID) == 0 {
+		return nil
+	}
+
+	result, rpcErr := agent.handleMCPRequest(ctx, request)
+	return marshalRPC(rpcResponse{ID: request.ID, Result: result, Error: rpcErr})
+}
+
+// dispatch an mcp request by method
+func (agent *Agent) handleMCPRequest(ctx context.Context, request rpcRequest) (any, *rpcError) {
+	switch request.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		json.Unmarshal(request.Params, &params)
+		// agree the client version if we speak it, otherwise offer our latest
+		version := mcpProtocolVersions[0]
+		for _, supported := range mcpProtocolVersions {
+			if params.ProtocolVersion == supported {
+				version = supported
+			}
+		}
+		return map[string]any{
+			"protocolVersion": version,
+			"capabilities": map[string]any{
+				"tools": map[string]any{"listChanged": false},
+			},
+			"serverInfo": map[string]any{
+				"name":    agent.mcpAgentToolName(),
+				"version": agent.capabilities.Version,
+			},
+		}, nil
+	case "ping":
+		return map[string]any{}, nil
+	case "tools/list":
+		return map[string]any{"tools": agent.mcpTools()}, nil
+	case "tools/call":
+		var params struct {
+			Name      string         `json:"name"`
+			Arguments map[string]any `json:"arguments"`
+		}
+		err := json.Unmarshal(request.Params, &params)
+		if err != nil || params.Name == "" {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "invalid tools/call params"}
+		}
+		return agent.callMCPTool(ctx, params.Name, params.Arguments), nil
+	default:
+		return nil, &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + request.Method}
+	}
+}
+
+// run an mcp tool call against the agent or one of its tools
+func (agent *Agent) callMCPTool(ctx context.Context, name string, args map[string]any) mcpToolResult {
+	log.Println("running mcp tool call for " + name)
+
+	var result string
+	var err error
+	if name == agent.mcpAgentToolName() {
+		message, ok := args["message"].(string)
+		if !ok {
+			return mcpToolResult{Content: []mcpContent{{Type: "text", Text: "missing arg: message"}}, IsError: true}
+		}
+		var response *Response
+		response, err = agent.Ask(ctx, Request{Input: message}, nil)
+		if err == nil {
+			result = response.Content
+		}
+	} else {
+		result, err = agent.callTool(ctx, genai.FunctionCall{Name: name, Args: args})
+	}
+	if err != nil {
+		log.Println("mcp tool call error:", err)
+		return mcpToolResult{Content: []mcpContent{{Type: "text", Text: err.Error()}}, IsError: true}
+	}
+	return mcpToolResult{Content: []mcpContent{{Type: "text", Text: result}}}
+}
+
+func marshalRPC(response rpcResponse) []byte {
+	response.JSONRPC = "2.0"
+	dat, err := json.Marshal(response)
+	if err != nil {
+		log.Println("json-rpc marshal error:", err)
+		return nil
+	}
+	return dat
+}
+
+// serve the agent as an mcp server over newline delimited json-rpc until the input closes
+func (agent *Agent) ServeMCPStdio(ctx context.Context, in io.Reader, out io.Writer) error {
+	log.Println("mcp server running on stdio")
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		reply := agent.HandleMCPMessage(ctx, line)
+		if reply == nil {
+			continue
+		}
+		_, err := out.Write(append(reply, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// mcp streamable http handler at /mcp
+func (agent *Agent) HandleMCPRequest(res http.ResponseWriter, req *http.Request) {
+
+	// reject cross-site browser requests
+	if origin := req.Header.Get("Origin"); origin != "" {
+		originURL, err := url.Parse(origin)
+		if err != nil || originURL.Host != req.Host {
+			http.Error(res, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	// only single json-rpc posts, no server initiated streams
+	if req.Method != "POST" {
+		res.Header().Set("Allow", "POST")
+		http.Error(res, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	message, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(res, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	reply := agent.HandleMCPMessage(req.Context(), message)
+	if reply == nil {
+		res.WriteHeader(http.StatusAccepted)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(reply)
+}
@@ -0,0 +1,369 @@
+package geminiagentassemble
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Model provider routines
+/////////
+
+// supported model providers
+const (
+	ProviderGemini = "gemini"
+	ProviderOpenAI = "openai"
+	ProviderOllama = "ollama"
+)
+
+// default model names and endpoints
+const (
+	defaultGeminiModel   = "gemini-2.0-flash-exp"
+	defaultOpenAIBaseURL = "https://api.openai.com/v1"
+	defaultOllamaBaseURL = "http://localhost:11434/v1"
+)
+
+// model backend selected by MODEL_PROVIDER (gemini by default), MODEL_NAME, MODEL_BASE_URL and MODEL_API_KEY
+type modelProvider struct {
+	name    string
+	model   string
+	baseURL string
+	apiKey  string
+}
+
+// read a model setting, the agent's <prefix>_MODEL_* variable takes precedence over MODEL_*
+func modelEnv(prefix string, key string) (string, bool) {
+	if prefix != "" {
+		if value, ok := os.LookupEnv(prefix + "_" + key); ok && value != "" {
+			return value, true
+		}
+	}
+	return os.LookupEnv(key)
+}
+
+// read the model provider from the environment
+func modelProviderFromEnv(prefix string) (*modelProvider, error) {
+	provider := &modelProvider{name: ProviderGemini}
+	if name, ok := modelEnv(prefix, "MODEL_PROVIDER"); ok && name != "" {
+		provider.name = strings.ToLower(name)
+	}
+	provider.model, _ = modelEnv(prefix, "MODEL_NAME")
+	provider.baseURL, _ = modelEnv(prefix, "MODEL_BASE_URL")
+	provider.apiKey, _ = modelEnv(prefix, "MODEL_API_KEY")
+
+	switch provider.name {
+	case ProviderGemini:
+		if provider.model == "" {
+			provider.model = defaultGeminiModel
+		}
+		// gemini keeps its own api key variable
+		apiKey, ok := os.LookupEnv("GEMINI_API_KEY")
+		if !ok {
+			return nil, errors.New("environment variable GEMINI_API_KEY not set")
+		}
+		provider.apiKey = apiKey
+	case ProviderOpenAI, ProviderOllama:
+		// ollama serves the openai chat completions api, so both share the adapter
+		if provider.baseURL == "" {
+			provider.baseURL = defaultOpenAIBaseURL
+			if provider.name == ProviderOllama {
+				provider.baseURL = defaultOllamaBaseURL
+			}
+		}
+		provider.baseURL = strings.TrimSuffix(provider.baseURL, "/")
+		if provider.model == "" {
+			return nil, errors.New("environment variable MODEL_NAME not set for model provider " + provider.name)
+		}
+	default:
+		return nil, errors.New("unknown model provider: " + provider.name)
+	}
+	return provider, nil
+}
+
+// chat session with the model, implemented by *genai.ChatSession and the openai adapter
+type chatSession interface {
+	SendMessage(ctx context.Context, parts ...genai.Part) (*genai.GenerateContentResponse, error)
+}
+
+//////////////////
+// openai compatible chat completions adapter
+
+// openai chat message, content is a string or a list of typed parts
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    any              `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+type openAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name string `json:"name"`
+		// a json encoded string, some servers send the object itself
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+type openAITool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Parameters  map[string]any `json:"parameters"`
+	} `json:"function"`
+}
+type openAIRequest struct {
+	Model       string          `json:"model"`
+	Messages    []openAIMessage `json:"messages"`
+	Tools       []openAITool    `json:"tools,omitempty"`
+	Temperature *float32        `json:"temperature,omitempty"`
+	TopP        *float32        `json:"top_p,omitempty"`
+	MaxTokens   *int32          `json:"max_tokens,omitempty"`
+	// {"type": "json_object"} for the json reply mode
+	ResponseFormat map[string]string `json:"response_format,omitempty"`
+}
+type openAIResponse struct {
+	Choices []struct {
+		Message      openAIMessage `json:"message"`
+		FinishReason string        `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int32 `json:"prompt_tokens"`
+		CompletionTokens int32 `json:"completion_tokens"`
+		TotalTokens      int32 `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+// chat session against an openai compatible api, configured from the shared generative model settings
+type openAISession struct {
+	provider *modelProvider
+	model    *genai.GenerativeModel
+	client   *http.Client
+	history  []openAIMessage
+	// tool calls of the last reply waiting for their function responses
+	pending []openAIToolCall
+}
+
+func newOpenAISession(provider *modelProvider, model *genai.GenerativeModel) *openAISession {
+	return &openAISession{provider: provider, model: model, client: &http.Client{}}
+}
+
+// send the parts as the next turn and return the reply in the genai form used by Ask
+func (session *openAISession) SendMessage(ctx context.Context, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	turn, pending, err := session.turnMessages(parts)
+	if err != nil {
+		return nil, err
+	}
+
+	// system instruction, history and the new turn
+	var messages []openAIMessage
+	if session.model.SystemInstruction != nil {
+		messages = append(messages, openAIMessage{Role: "system", Content: contentText(session.model.SystemInstruction)})
+	}
+	messages = append(messages, session.history...)
+	messages = append(messages, turn...)
+
+	request := openAIRequest{
+		Model:       session.provider.model,
+		Messages:    messages,
+		Tools:       openAITools(session.model.Tools),
+		Temperature: session.model.Temperature,
+		TopP:        session.model.TopP,
+		MaxTokens:   session.model.MaxOutputTokens,
+	}
+	if session.model.ResponseMIMEType == "application/json" {
+		request.ResponseFormat = map[string]string{"type": "json_object"}
+	}
+	reply, err := session.post(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Choices) == 0 {
+		return nil, errors.New("model reply has no choices")
+	}
+	message := reply.Choices[0].Message
+
+	// convert the reply, tool calls go first as Ask stops at a text only part
+	content := &genai.Content{Role: "model"}
+	for idx, toolCall := range message.ToolCalls {
+		args, err := toolCallArgs(toolCall.Function.Arguments)
+		if err != nil {
+			return nil, errors.New("bad arguments for tool call " + toolCall.Function.Name + ": " + err.Error())
+		}
+		// history keeps the arguments as a json string
+		argsDat, _ := json.Marshal(args)
+		message.ToolCalls[idx].Function.Arguments, _ = json.Marshal(string(argsDat))
+		content.Parts = append(content.Parts, genai.FunctionCall{Name: toolCall.Function.Name, Args: args})
+	}
+	text, _ := message.Content.(string)
+	if text != "" || len(content.Parts) == 0 {
+		content.Parts = append(content.Parts, genai.Text(text))
+	}
+	resp := &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{Content: content}}}
+	if reply.Usage != nil {
+		resp.UsageMetadata = &genai.UsageMetadata{
+			PromptTokenCount:     reply.Usage.PromptTokens,
+			CandidatesTokenCount: reply.Usage.CompletionTokens,
+			TotalTokenCount:      reply.Usage.TotalTokens,
+		}
+	}
+
+	// keep the turn only once it succeeded, as the genai chat session does
+	session.pending = pending
+	for idx := range message.ToolCalls {
+		if message.ToolCalls[idx].ID == "" {
+			message.ToolCalls[idx].ID = "call_" + strconv.Itoa(len(session.history)) + "_" + strconv.Itoa(idx)
+		}
+		message.ToolCalls[idx].Type = "function"
+		session.pending = append(session.pending, message.ToolCalls[idx])
+	}
+	message.Role = "assistant"
+	message.Content = text
+	if text == "" && len(message.ToolCalls) > 0 {
+		message.Content = nil
+	}
+	session.history = append(append(session.history, turn...), message)
+	return resp, nil
+}
+
+// map the genai parts of a turn to openai messages, function responses answer the pending tool calls
+func (session *openAISession) turnMessages(parts []genai.Part) ([]openAIMessage, []openAIToolCall, error) {
+	pending := append([]openAIToolCall{}, session.pending...)
+	var messages []openAIMessage
+	var userParts []map[string]any
+	hasBlob := false
+	for _, part := range parts {
+		switch part := part.(type) {
+		case genai.Text:
+			userParts = append(userParts, map[string]any{"type": "text", "text": string(part)})
+		case genai.Blob:
+			hasBlob = true
+			dataURL := "data:" + part.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(part.Data)
+			if strings.HasPrefix(part.MIMEType, "image/") {
+				userParts = append(userParts, map[string]any{"type": "image_url", "image_url": map[string]any{"url": dataURL}})
+			} else {
+				userParts = append(userParts, map[string]any{"type": "file", "file": map[string]any{"file_data": dataURL}})
+			}
+		case genai.FunctionResponse:
+			// answer the first waiting call to the function
+			id := ""
+			for idx, toolCall := range pending {
+				if toolCall.Function.Name == part.Name {
+					id = toolCall.ID
+					pending = append(pending[:idx], pending[idx+1:]...)
+					break
+				}
+			}
+			if id == "" {
+				return nil, nil, errors.New("function response without a tool call: " + part.Name)
+			}
+			resultDat, err := json.Marshal(part.Response)
+			if err != nil {
+				return nil, nil, err
+			}
+			messages = append(messages, openAIMessage{Role: "tool", Content: string(resultDat), ToolCallID: id})
+		default:
+			return nil, nil, errors.New("unsupported part for the openai model provider")
+		}
+	}
+	if len(userParts) > 0 {
+		var content any = userParts
+		if !hasBlob {
+			// plain text stays a string for servers without content part support
+			var texts []string
+			for _, part := range userParts {
+				texts = append(texts, part["text"].(string))
+			}
+			content = strings.Join(texts, "\n")
+		}
+		messages = append(messages, openAIMessage{Role: "user", Content: content})
+	}
+	return messages, pending, nil
+}
+
+// post the chat completion request
+func (session *openAISession) post(ctx context.Context, request openAIRequest) (*openAIResponse, error) {
+	reqDat, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, session.provider.baseURL+"/chat/completions", bytes.NewReader(reqDat))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if session.provider.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+session.provider.apiKey)
+	}
+	resp, err := session.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1000))
+		return nil, errors.New("model request failed: " + resp.Status + ": " + strings.TrimSpace(string(body)))
+	}
+	var reply openAIResponse
+	err = json.NewDecoder(resp.Body).Decode(&reply)
+	if err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// the genai tool declarations as openai function tools
+func openAITools(tools []*genai.Tool) []openAITool {
+	var functions []openAITool
+	for _, tool := range tools {
+		for _, declaration := range tool.FunctionDeclarations {
+			function := openAITool{Type: "function"}
+			function.Function.Name = declaration.Name
+			function.Function.Description = declaration.Description
+			function.Function.Parameters = schemaToJSON(declaration.Parameters)
+			if function.Function.Parameters == nil {
+				function.Function.Parameters = map[string]any{"type": "object", "properties": map[string]any{}}
+			}
+			functions = append(functions, function)
+		}
+	}
+	return functions
+}
+
+// decode tool call arguments given as a json string or a json object
+func toolCallArgs(raw json.RawMessage) (map[string]any, error) {
+	args := map[string]any{}
+	if len(raw) == 0 || string(raw) == "null" {
+		return args, nil
+	}
+	var encoded string
+	if json.Unmarshal(raw, &encoded) == nil {
+		if strings.TrimSpace(encoded) == "" {
+			return args, nil
+		}
+		raw = json.RawMessage(encoded)
+	}
+	err := json.Unmarshal(raw, &args)
+	return args, err
+}
+
+// the text of a genai content
+func contentText(content *genai.Content) string {
+	var texts []string
+	for _, part := range content.Parts {
+		if text, ok := part.(genai.Text); ok {
+			texts = append(texts, string(text))
+		}
+	}
+	return strings.Join(texts, "\n")
+}
@@ -0,0 +1,248 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// stub chat completions server answering with the replies in turn and keeping the requests
+type stubModel struct {
+	t        *testing.T
+	replies  []string
+	status   int
+	requests []openAIRequest
+}
+
+func (stub *stubModel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/chat/completions" {
+		stub.t.Errorf("request path = %s, want /chat/completions", r.URL.Path)
+	}
+	if auth := r.Header.Get("Authorization"); auth != "Bearer test-key" {
+		stub.t.Errorf("authorization = %q, want the bearer api key", auth)
+	}
+	var request openAIRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		stub.t.Errorf("decode request: %v", err)
+	}
+	stub.requests = append(stub.requests, request)
+	if stub.status != 0 {
+		http.Error(w, "model overloaded", stub.status)
+		return
+	}
+	if len(stub.replies) == 0 {
+		stub.t.Error("unexpected model request")
+		http.Error(w, "no reply", http.StatusInternalServerError)
+		return
+	}
+	reply := stub.replies[0]
+	stub.replies = stub.replies[1:]
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(reply))
+}
+
+// openai session against the stub with a system instruction and two tools
+func stubSession(t *testing.T, stub *stubModel) *openAISession {
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	model := &genai.GenerativeModel{}
+	model.SetTemperature(0)
+	model.SystemInstruction = genai.NewUserContent(genai.Text("be brief"))
+	model.Tools = []*genai.Tool{{
+		FunctionDeclarations: []*genai.FunctionDeclaration{{
+			Name:        "queryDatabase",
+			Description: "Query the daily prices",
+			Parameters: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"ticker": {Type: genai.TypeString, Description: "The ticker"},
+					"days":   {Type: genai.TypeInteger},
+				},
+				Required: []string{"ticker"},
+			},
+		}, {
+			Name:        "listTickers",
+			Description: "List the tickers",
+		}},
+	}}
+	provider := &modelProvider{name: ProviderOpenAI, model: "stub-model", baseURL: server.URL, apiKey: "test-key"}
+	return newOpenAISession(provider, model)
+}
+
+func TestOpenAIToolDeclarations(t *testing.T) {
+	stub := &stubModel{t: t, replies: []string{`{"choices": [{"message": {"role": "assistant", "content": "hi"}}]}`}}
+	session := stubSession(t, stub)
+	_, err := session.SendMessage(context.Background(), genai.Text("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := stub.requests[0]
+	if request.Model != "stub-model" || request.Temperature == nil || *request.Temperature != 0 {
+		t.Errorf("model settings = %s %v, want stub-model at temperature 0", request.Model, request.Temperature)
+	}
+	if len(request.Messages) != 2 || request.Messages[0].Role != "system" || request.Messages[0].Content != "be brief" ||
+		request.Messages[1].Role != "user" || request.Messages[1].Content != "hello" {
+		t.Errorf("messages = %+v, want the system instruction and the user text", request.Messages)
+	}
+	if len(request.Tools) != 2 {
+		t.Fatalf("got %d tools, want 2", len(request.Tools))
+	}
+	query := request.Tools[0]
+	if query.Type != "function" || query.Function.Name != "queryDatabase" || query.Function.Description != "Query the daily prices" {
+		t.Errorf("tool = %+v, want the queryDatabase function", query)
+	}
+	wantParameters := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"ticker": map[string]any{"type": "string", "description": "The ticker"},
+			"days":   map[string]any{"type": "integer"},
+		},
+		"required": []any{"ticker"},
+	}
+	if !reflect.DeepEqual(query.Function.Parameters, wantParameters) {
+		t.Errorf("parameters = %v, want %v", query.Function.Parameters, wantParameters)
+	}
+	// a function without parameters still declares an empty object
+	wantEmpty := map[string]any{"type": "object", "properties": map[string]any{}}
+	if !reflect.DeepEqual(request.Tools[1].Function.Parameters, wantEmpty) {
+		t.Errorf("parameters = %v, want %v", request.Tools[1].Function.Parameters, wantEmpty)
+	}
+}
+
+func TestOpenAIToolCalls(t *testing.T) {
+	stub := &stubModel{t: t, replies: []string{
+		// arguments as a json string, and as the object itself
+		`{"choices": [{"message": {"role": "assistant", "content": null, "tool_calls": [
+			{"id": "call_a", "type": "function", "function": {"name": "queryDatabase", "arguments": "{\"ticker\": \"aapl\", \"days\": 5}"}},
+			{"id": "call_b", "type": "function", "function": {"name": "listTickers", "arguments": {"exchange": "nasdaq"}}}
+		]}, "finish_reason": "tool_calls"}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "Final Answer: done"}}]}`,
+	}}
+	session := stubSession(t, stub)
+	resp, err := session.SendMessage(context.Background(), genai.Text("what did apple close at"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := resp.Candidates[0].Content.Parts
+	want := []genai.Part{
+		genai.FunctionCall{Name: "queryDatabase", Args: map[string]any{"ticker": "aapl", "days": float64(5)}},
+		genai.FunctionCall{Name: "listTickers", Args: map[string]any{"exchange": "nasdaq"}},
+	}
+	if !reflect.DeepEqual(parts, want) {
+		t.Fatalf("parts = %#v, want %#v", parts, want)
+	}
+
+	// the responses answer the calls in any order
+	_, err = session.SendMessage(context.Background(),
+		genai.FunctionResponse{Name: "listTickers", Response: map[string]any{"result": "aapl"}},
+		genai.FunctionResponse{Name: "queryDatabase", Response: map[string]any{"result": "250.42"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := stub.requests[1].Messages
+	if len(messages) != 5 {
+		t.Fatalf("got %d messages, want system, user, assistant and 2 tool messages", len(messages))
+	}
+	assistant := messages[2]
+	if assistant.Role != "assistant" || len(assistant.ToolCalls) != 2 || assistant.ToolCalls[0].ID != "call_a" {
+		t.Errorf("assistant message = %+v, want the two tool calls", assistant)
+	}
+	// history keeps the arguments as a json string
+	if args := string(assistant.ToolCalls[1].Function.Arguments); args != `"{\"exchange\":\"nasdaq\"}"` {
+		t.Errorf("history arguments = %s, want a json string", args)
+	}
+	for idx, wantID := range []string{"call_b", "call_a"} {
+		message := messages[3+idx]
+		if message.Role != "tool" || message.ToolCallID != wantID {
+			t.Errorf("message %d = %s %s, want a tool message for %s", 3+idx, message.Role, message.ToolCallID, wantID)
+		}
+	}
+	if content, _ := messages[4].Content.(string); content != `{"result":"250.42"}` {
+		t.Errorf("tool content = %v, want the json response", messages[4].Content)
+	}
+}
+
+func TestOpenAIUnknownFunctionResponse(t *testing.T) {
+	session := stubSession(t, &stubModel{t: t})
+	_, err := session.SendMessage(context.Background(), genai.FunctionResponse{Name: "queryDatabase"})
+	if err == nil || !strings.Contains(err.Error(), "without a tool call") {
+		t.Errorf("err = %v, want a function response without a tool call error", err)
+	}
+}
+
+func TestOpenAIErrorStatus(t *testing.T) {
+	stub := &stubModel{t: t, status: http.StatusServiceUnavailable}
+	session := stubSession(t, stub)
+	_, err := session.SendMessage(context.Background(), genai.Text("hello"))
+	if err == nil || !strings.Contains(err.Error(), "503") || !strings.Contains(err.Error(), "model overloaded") {
+		t.Fatalf("err = %v, want the status and body", err)
+	}
+	// a failed turn is not kept
+	if len(session.history) != 0 {
+		t.Errorf("history = %+v, want empty after a failed request", session.history)
+	}
+}
+
+func TestOpenAIUsage(t *testing.T) {
+	stub := &stubModel{t: t, replies: []string{
+		`{"choices": [{"message": {"role": "assistant", "content": "hi"}}], "usage": {"prompt_tokens": 12, "completion_tokens": 3, "total_tokens": 15}}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "again"}}]}`,
+	}}
+	session := stubSession(t, stub)
+	resp, err := session.SendMessage(context.Background(), genai.Text("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &genai.UsageMetadata{PromptTokenCount: 12, CandidatesTokenCount: 3, TotalTokenCount: 15}
+	if !reflect.DeepEqual(resp.UsageMetadata, want) {
+		t.Errorf("usage = %+v, want %+v", resp.UsageMetadata, want)
+	}
+	if text := contentText(resp.Candidates[0].Content); text != "hi" {
+		t.Errorf("text = %q, want hi", text)
+	}
+
+	// replies without usage leave it unset
+	resp, err = session.SendMessage(context.Background(), genai.Text("hello again"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.UsageMetadata != nil {
+		t.Errorf("usage = %+v, want nil", resp.UsageMetadata)
+	}
+}
+
+func TestOpenAIJSONReply(t *testing.T) {
+	stub := &stubModel{t: t, replies: []string{
+		`{"choices": [{"message": {"role": "assistant", "content": "{\"steps\": []}"}}]}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "hi"}}]}`,
+	}}
+	session := stubSession(t, stub)
+	session.model.ResponseMIMEType = "application/json"
+	_, err := session.SendMessage(context.Background(), genai.Text("plan this"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format := stub.requests[0].ResponseFormat; format["type"] != "json_object" {
+		t.Errorf("response format = %v, want json_object", format)
+	}
+
+	// text replies leave the format unset
+	session.model.ResponseMIMEType = "text/plain"
+	_, err = session.SendMessage(context.Background(), genai.Text("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format := stub.requests[1].ResponseFormat; format != nil {
+		t.Errorf("response format = %v, want none", format)
+	}
+}
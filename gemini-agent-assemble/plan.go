@@ -0,0 +1,473 @@
+package geminiagentassemble
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Plan-then-execute routines
+/////////
+
+// request modes, react decides step by step in the chat session, plan makes an explicit plan first
+const (
+	ModeReAct = "react"
+	ModePlan  = "plan"
+)
+
+// plan limits
+const (
+	maxPlanSteps = 12
+	maxReplans   = 2
+)
+
+// explicit plan of tool calls with their dependencies
+type Plan struct {
+	Steps []PlanStep `json:"steps"`
+}
+
+// a planned tool call, string args can take a dependency result with {{<step id>}}
+type PlanStep struct {
+	ID        string         `json:"id"`
+	Tool      string         `json:"tool"`
+	Args      map[string]any `json:"args"`
+	DependsOn []string       `json:"dependsOn,omitempty"`
+}
+
+// set the mode for requests without one, react by default
+func (agent *Agent) SetMode(mode string) error {
+	if mode != ModeReAct && mode != ModePlan {
+		return errors.New("unknown agent mode: " + mode)
+	}
+	agent.mode = mode
+	return nil
+}
+
+// the mode for a request
+func (agent *Agent) requestMode(request Request) (string, error) {
+	mode := request.Mode
+	if mode == "" {
+		mode = agent.mode
+	}
+	switch mode {
+	case "", ModeReAct:
+		return ModeReAct, nil
+	case ModePlan:
+		return ModePlan, nil
+	default:
+		return "", errors.New("unknown agent mode: " + mode)
+	}
+}
+
+// a model with the agent settings, its own system instruction and no tools
+func (agent *Agent) toolFreeModel(system string, jsonReply bool) *genai.GenerativeModel {
+	model := &genai.GenerativeModel{}
+	if agent.Client != nil {
+		model = agent.Client.GenerativeModel(agent.provider.model)
+	}
+	settings := agent.copyModel()
+	model.GenerationConfig = settings.GenerationConfig
+	model.SafetySettings = settings.SafetySettings
+	if system != "" {
+		model.SystemInstruction = genai.NewUserContent(genai.Text(system))
+	}
+	if jsonReply {
+		model.ResponseMIMEType = "application/json"
+	}
+	return model
+}
+
+// single model call outside the agent chat session
+func (agent *Agent) generate(ctx context.Context, model *genai.GenerativeModel, parts []genai.Part, usage *Usage) (string, error) {
+	resp, err := agent.startSession(model).SendMessage(ctx, parts...)
+	if err != nil {
+		return "", err
+	}
+	usage.add(resp.UsageMetadata)
+	if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		return "", errors.New("empty model reply")
+	}
+	return contentText(resp.Candidates[0].Content), nil
+}
+
+// the declared tools by name
+func (agent *Agent) declarations() map[string]*genai.FunctionDeclaration {
+	agent.toolsMu.RLock()
+	defer agent.toolsMu.RUnlock()
+	declarations := map[string]*genai.FunctionDeclaration{}
+	for _, tool := range agent.allTools() {
+		for _, declaration := range tool.FunctionDeclarations {
+			declarations[declaration.Name] = declaration
+		}
+	}
+	return declarations
+}
+
+const planInstruction = `You plan how to answer a request with the tools listed below. Respond with only a JSON object of this form:
+{"steps":[{"id":"s1","tool":"<tool name>","args":{"<arg>":"<value>"},"dependsOn":[]}]}
+Rules:
+* Use only the listed tools and give every required arg.
+* Only add steps that are needed, never repeat a call with the same args.
+* Steps without dependencies run in parallel. A step that needs the result of other steps lists their ids in dependsOn, and can insert a result into a string arg with {{<step id>}}.
+* Use an empty steps list when the request needs no tools.`
+
+// ask the model for a plan, completed steps and the last failure are given when replanning
+// and the earlier turns when the request continues a session
+func (agent *Agent) makePlan(ctx context.Context, request Request, attachments []Attachment, history string, declarations map[string]*genai.FunctionDeclaration, completed map[string]string, failure string, usage *Usage) (*Plan, error) {
+	var prompt strings.Builder
+	if agent.system != nil {
+		prompt.WriteString("The agent you plan for has this role:\n" + *agent.system + "\n\n")
+	}
+	prompt.WriteString("Tools:\n")
+	names := make([]string, 0, len(declarations))
+	for name := range declarations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		declaration := declarations[name]
+		schemaDat, _ := json.Marshal(schemaToJSON(declaration.Parameters))
+		prompt.WriteString("- " + name + ": " + declaration.Description + " Args schema: " + string(schemaDat) + "\n")
+	}
+	if len(completed) > 0 {
+		prompt.WriteString("\nSteps already completed, use their ids in dependsOn instead of repeating them:\n")
+		ids := make([]string, 0, len(completed))
+		for id := range completed {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			prompt.WriteString("[" + id + "] " + completed[id] + "\n")
+		}
+	}
+	if failure != "" {
+		prompt.WriteString("\nThe previous plan failed: " + failure + "\nPlan only the remaining work, using new step ids.\n")
+	}
+	if history != "" {
+		prompt.WriteString("\nConversation so far:\n" + history + "\n")
+	}
+	prompt.WriteString("\nRequest: " + request.Input)
+
+	reply, err := agent.generate(ctx, agent.toolFreeModel(planInstruction, true), requestParts(prompt.String(), attachments), usage)
+	if err != nil {
+		return nil, err
+	}
+	// take the json object out of any surrounding text or code fence
+	start, end := strings.Index(reply, "{"), strings.LastIndex(reply, "}")
+	if start < 0 || end < start {
+		return nil, errors.New("plan is not a json object")
+	}
+	var plan Plan
+	err = json.Unmarshal([]byte(reply[start:end+1]), &plan)
+	if err != nil {
+		return nil, errors.New("plan is not valid json: " + err.Error())
+	}
+	return &plan, nil
+}
+
+// check the plan only uses known tools with their required args, and its dependencies form a graph
+func validatePlan(plan *Plan, declarations map[string]*genai.FunctionDeclaration, completed map[string]string) error {
+	if len(plan.Steps) > maxPlanSteps {
+		return errors.New("plan has more than " + strconv.Itoa(maxPlanSteps) + " steps")
+	}
+	ids := map[string]bool{}
+	for _, step := range plan.Steps {
+		if step.ID == "" {
+			return errors.New("plan step without an id")
+		}
+		if _, exists := completed[step.ID]; exists || ids[step.ID] {
+			return errors.New("duplicate plan step id: " + step.ID)
+		}
+		ids[step.ID] = true
+	}
+	for _, step := range plan.Steps {
+		declaration, exists := declarations[step.Tool]
+		if !exists {
+			return errors.New("step " + step.ID + " uses an unknown tool: " + step.Tool)
+		}
+		if declaration.Parameters != nil {
+			for _, required := range declaration.Parameters.Required {
+				if _, exists := step.Args[required]; !exists {
+					return errors.New("step " + step.ID + " is missing the " + required + " arg for " + step.Tool)
+				}
+			}
+		}
+		dependencies := map[string]bool{}
+		for _, dependency := range step.DependsOn {
+			if _, exists := completed[dependency]; !exists && !ids[dependency] {
+				return errors.New("step " + step.ID + " depends on an unknown step: " + dependency)
+			}
+			if dependency == step.ID {
+				return errors.New("step " + step.ID + " depends on itself")
+			}
+			dependencies[dependency] = true
+		}
+		argsDat, _ := json.Marshal(step.Args)
+		for _, reference := range placeholders(string(argsDat)) {
+			if !dependencies[reference] {
+				return errors.New("step " + step.ID + " uses the result of " + reference + " without depending on it")
+			}
+		}
+	}
+	// every step must become runnable
+	done := map[string]bool{}
+	for len(done) < len(plan.Steps) {
+		progress := false
+		for _, step := range plan.Steps {
+			if done[step.ID] || !dependenciesDone(step, done, completed) {
+				continue
+			}
+			done[step.ID] = true
+			progress = true
+		}
+		if !progress {
+			return errors.New("plan dependencies form a cycle")
+		}
+	}
+	return nil
+}
+
+func dependenciesDone(step PlanStep, done map[string]bool, completed map[string]string) bool {
+	for _, dependency := range step.DependsOn {
+		if _, exists := completed[dependency]; !exists && !done[dependency] {
+			return false
+		}
+	}
+	return true
+}
+
+// step ids referenced as {{<step id>}} in the text
+func placeholders(text string) []string {
+	var references []string
+	for {
+		start := strings.Index(text, "{{")
+		if start < 0 {
+			return references
+		}
+		end := strings.Index(text[start:], "}}")
+		if end < 0 {
+			return references
+		}
+		references = append(references, strings.TrimSpace(text[start+2:start+end]))
+		text = text[start+end+2:]
+	}
+}
+
+// put the dependency results into the string args
+func substituteArgs(value any, results map[string]string) any {
+	switch value := value.(type) {
+	case string:
+		// each reference as written, spaces inside the braces included
+		var substituted strings.Builder
+		for {
+			start := strings.Index(value, "{{")
+			end := -1
+			if start >= 0 {
+				end = strings.Index(value[start:], "}}")
+			}
+			if end < 0 {
+				substituted.WriteString(value)
+				return substituted.String()
+			}
+			substituted.WriteString(value[:start])
+			substituted.WriteString(results[strings.TrimSpace(value[start+2:start+end])])
+			value = value[start+end+2:]
+		}
+	case map[string]any:
+		substituted := map[string]any{}
+		for key, item := range value {
+			substituted[key] = substituteArgs(item, results)
+		}
+		return substituted
+	case []any:
+		substituted := []any{}
+		for _, item := range value {
+			substituted = append(substituted, substituteArgs(item, results))
+		}
+		return substituted
+	default:
+		return value
+	}
+}
+
+// run the plan in waves of steps whose dependencies are done, the steps of a wave run in parallel
+// steps depending on a failed step are skipped, the rest of the plan still runs
+// returns a description of any failed steps, the completed results are added to results
+func (agent *Agent) runPlan(ctx context.Context, plan *Plan, results map[string]string, state *requestState) (string, error) {
+	remaining := plan.Steps
+	done := map[string]bool{}
+	failed := map[string]bool{}
+	var failures []string
+	for len(remaining) > 0 {
+		var wave, rest []PlanStep
+		for _, step := range remaining {
+			blocked := ""
+			for _, dependency := range step.DependsOn {
+				if failed[dependency] {
+					blocked = dependency
+				}
+			}
+			switch {
+			case blocked != "":
+				failed[step.ID] = true
+				failures = append(failures, "step "+step.ID+" ("+step.Tool+") not run as step "+blocked+" failed")
+			case dependenciesDone(step, done, results):
+				wave = append(wave, step)
+			default:
+				rest = append(rest, step)
+			}
+		}
+		if len(wave) == 0 {
+			if len(rest) > 0 {
+				failures = append(failures, "plan dependencies form a cycle")
+			}
+			break
+		}
+
+		outputs := make([]string, len(wave))
+		errs := make([]error, len(wave))
+		var wg sync.WaitGroup
+		for idx, step := range wave {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				args, _ := substituteArgs(step.Args, results).(map[string]any)
+				outputs[idx], errs[idx] = agent.requestTool(ctx, genai.FunctionCall{Name: step.Tool, Args: args}, step.ID, state)
+			}()
+		}
+		wg.Wait()
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		for idx, step := range wave {
+			if errs[idx] != nil {
+				failed[step.ID] = true
+				failures = append(failures, "step "+step.ID+" ("+step.Tool+") failed: "+errs[idx].Error())
+				continue
+			}
+			results[step.ID] = outputs[idx]
+			done[step.ID] = true
+		}
+		remaining = rest
+	}
+	return strings.Join(failures, "; "), nil
+}
+
+// report the plan in the request trace
+func tracePlan(state *requestState, plan *Plan, attempt int, started time.Time, err error) {
+	step := Step{
+		Tool:       "plan",
+		Args:       map[string]any{"attempt": attempt},
+		Started:    started,
+		DurationMs: time.Since(started).Milliseconds(),
+	}
+	if plan != nil {
+		step.Args["steps"] = plan.Steps
+	}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.observer != nil {
+		state.observer(step)
+	}
+}
+
+// answer the request by planning the tool calls, running the plan and composing the answer from the results
+// a failed or invalid plan is replanned from the completed steps
+func (agent *Agent) askPlan(ctx context.Context, request Request, attachments []Attachment, state *requestState) (*Response, error) {
+	// a session request plans with the earlier turns and adds its answer to them
+	var session chatSession
+	history := ""
+	if request.SessionID != "" {
+		var unlock func()
+		session, unlock = agent.requestSession(request.SessionID)
+		defer unlock()
+		history = sessionTranscript(session)
+	}
+
+	usage := &Usage{}
+	declarations := agent.declarations()
+	results := map[string]string{}
+	calls := map[string]string{}
+	failure := ""
+	for attempt := 1; attempt <= maxReplans+1; attempt++ {
+		started := time.Now()
+		plan, err := agent.makePlan(ctx, request, attachments, history, declarations, calls, failure, usage)
+		if err == nil {
+			err = validatePlan(plan, declarations, calls)
+		}
+		tracePlan(state, plan, attempt, started, err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			log.Println("plan attempt " + strconv.Itoa(attempt) + " rejected: " + err.Error())
+			failure = "invalid plan: " + err.Error()
+			continue
+		}
+
+		failure, err = agent.runPlan(ctx, plan, results, state)
+		if err != nil {
+			return nil, err
+		}
+		// keep a summary of each completed call for replanning
+		for _, step := range plan.Steps {
+			if _, exists := results[step.ID]; exists {
+				argsDat, _ := json.Marshal(step.Args)
+				calls[step.ID] = step.Tool + " " + string(argsDat) + " completed"
+			}
+		}
+		if failure == "" {
+			break
+		}
+		log.Println("plan attempt " + strconv.Itoa(attempt) + " failed: " + failure)
+	}
+
+	// compose the answer from the results
+	var prompt strings.Builder
+	if history != "" {
+		prompt.WriteString("Conversation so far:\n" + history + "\n\n")
+	}
+	prompt.WriteString("Request: " + request.Input + "\n\n")
+	if len(results) > 0 {
+		prompt.WriteString("Results of the tool calls made for the request:\n")
+		ids := make([]string, 0, len(results))
+		for id := range results {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			prompt.WriteString("[" + id + "] " + calls[id] + ":\n" + results[id] + "\n\n")
+		}
+	}
+	if failure != "" {
+		prompt.WriteString("Some of the work could not be done: " + failure + "\n\n")
+	}
+	prompt.WriteString("Answer the request using these results.")
+	system := ""
+	if agent.system != nil {
+		system = *agent.system
+	}
+	content, err := agent.generate(ctx, agent.toolFreeModel(system, false), requestParts(prompt.String(), attachments), usage)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	log.Println("agent reply: " + content)
+	if session != nil {
+		recordTurn(session, request.Input, content)
+	}
+	return &Response{Content: content, Usage: usage}, nil
+}
@@ -0,0 +1,128 @@
+package geminiagentassemble
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// declarations of a price tool needing a ticker and a results tool without args
+var planDeclarations = map[string]*genai.FunctionDeclaration{
+	"queryDatabase": {
+		Name: "queryDatabase",
+		Parameters: &genai.Schema{
+			Type:       genai.TypeObject,
+			Properties: map[string]*genai.Schema{"ticker": {Type: genai.TypeString}},
+			Required:   []string{"ticker"},
+		},
+	},
+	"getResults": {Name: "getResults"},
+}
+
+func TestValidatePlan(t *testing.T) {
+	ticker := map[string]any{"ticker": "AAPL"}
+	manySteps := []PlanStep{}
+	for idx := 0; idx <= maxPlanSteps; idx++ {
+		manySteps = append(manySteps, PlanStep{ID: "s" + strconv.Itoa(idx), Tool: "getResults"})
+	}
+	for _, test := range []struct {
+		name      string
+		steps     []PlanStep
+		completed map[string]string
+		// empty when the plan is valid
+		want string
+	}{
+		{"independent steps", []PlanStep{{ID: "a", Tool: "queryDatabase", Args: ticker}, {ID: "b", Tool: "getResults"}}, nil, ""},
+		{"dependency chain", []PlanStep{
+			{ID: "c", Tool: "queryDatabase", Args: map[string]any{"ticker": "{{b}}"}, DependsOn: []string{"b"}},
+			{ID: "b", Tool: "queryDatabase", Args: map[string]any{"ticker": "{{ a }}"}, DependsOn: []string{"a"}},
+			{ID: "a", Tool: "getResults"},
+		}, nil, ""},
+		{"depends on a completed step", []PlanStep{{ID: "b", Tool: "queryDatabase", Args: map[string]any{"ticker": "{{a}}"}, DependsOn: []string{"a"}}}, map[string]string{"a": "AAPL"}, ""},
+		{"too many steps", manySteps, nil, "more than"},
+		{"missing id", []PlanStep{{Tool: "getResults"}}, nil, "without an id"},
+		{"duplicate id", []PlanStep{{ID: "a", Tool: "getResults"}, {ID: "a", Tool: "getResults"}}, nil, "duplicate"},
+		{"id of a completed step", []PlanStep{{ID: "a", Tool: "getResults"}}, map[string]string{"a": "done"}, "duplicate"},
+		{"unknown tool", []PlanStep{{ID: "a", Tool: "dropDatabase"}}, nil, "unknown tool: dropDatabase"},
+		{"missing required arg", []PlanStep{{ID: "a", Tool: "queryDatabase", Args: map[string]any{}}}, nil, "missing the ticker arg"},
+		{"missing dependency", []PlanStep{{ID: "a", Tool: "getResults", DependsOn: []string{"z"}}}, nil, "unknown step: z"},
+		{"self dependency", []PlanStep{{ID: "a", Tool: "getResults", DependsOn: []string{"a"}}}, nil, "depends on itself"},
+		{"placeholder without the dependency", []PlanStep{
+			{ID: "a", Tool: "getResults"},
+			{ID: "b", Tool: "queryDatabase", Args: map[string]any{"ticker": "{{a}}"}},
+		}, nil, "without depending on it"},
+		{"nested placeholder without the dependency", []PlanStep{
+			{ID: "a", Tool: "getResults"},
+			{ID: "b", Tool: "queryDatabase", Args: map[string]any{"ticker": "AAPL", "filter": map[string]any{"dates": []any{"{{a}}"}}}},
+		}, nil, "without depending on it"},
+		{"two step cycle", []PlanStep{
+			{ID: "a", Tool: "getResults", DependsOn: []string{"b"}},
+			{ID: "b", Tool: "getResults", DependsOn: []string{"a"}},
+		}, nil, "cycle"},
+		{"cycle behind a runnable step", []PlanStep{
+			{ID: "a", Tool: "getResults"},
+			{ID: "b", Tool: "getResults", DependsOn: []string{"a", "d"}},
+			{ID: "c", Tool: "getResults", DependsOn: []string{"b"}},
+			{ID: "d", Tool: "getResults", DependsOn: []string{"c"}},
+		}, nil, "cycle"},
+	} {
+		err := validatePlan(&Plan{Steps: test.steps}, planDeclarations, test.completed)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%s: %v, want a valid plan", test.name, err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%s: err = %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		want []string
+	}{
+		{"no references", nil},
+		{"{{a}} and {{ b }}", []string{"a", "b"}},
+		{`{"ticker":"{{resolve}}","days":"{{days}}"}`, []string{"resolve", "days"}},
+		// an unclosed reference is not one
+		{"{{a}} then {{b", []string{"a"}},
+	} {
+		if got := placeholders(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("placeholders(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestSubstituteArgs(t *testing.T) {
+	results := map[string]string{"ticker": "AAPL", "period": "2024-Q4"}
+	args := map[string]any{
+		"ticker": "{{ticker}}",
+		"query":  "close of {{ticker}} in {{ period }}",
+		"filter": map[string]any{
+			"tickers": []any{"{{ticker}}", "MSFT", map[string]any{"quarter": "{{period}}"}},
+			"days":    float64(5),
+		},
+		"unknown": "{{missing}}",
+		"flag":    true,
+	}
+	want := map[string]any{
+		"ticker": "AAPL",
+		"query":  "close of AAPL in 2024-Q4",
+		"filter": map[string]any{
+			"tickers": []any{"AAPL", "MSFT", map[string]any{"quarter": "2024-Q4"}},
+			"days":    float64(5),
+		},
+		"unknown": "",
+		"flag":    true,
+	}
+	if got := substituteArgs(args, results); !reflect.DeepEqual(got, want) {
+		t.Errorf("substituted args = %v, want %v", got, want)
+	}
+	// the planned args are left as they were
+	if args["ticker"] != "{{ticker}}" || args["filter"].(map[string]any)["tickers"].([]any)[0] != "{{ticker}}" {
+		t.Errorf("args changed in place: %v", args)
+	}
+}
@@ -0,0 +1,154 @@
+package geminiagentassemble
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+/////////
+// Multi-turn session routines
+/////////
+
+// session limits, idle sessions are dropped and the least recently used go first when full
+const (
+	sessionIdleTimeout = 30 * time.Minute
+	maxSessions        = 1000
+)
+
+// chat session of a session id
+type conversation struct {
+	mu       sync.Mutex
+	model    *genai.GenerativeModel
+	session  chatSession
+	lastUsed time.Time
+}
+
+// prefix of the one request sessions, these are cached like the agent session and ended after the request
+const ephemeralSessionPrefix = "ephemeral-"
+
+func ephemeralSession(id string) bool {
+	return strings.HasPrefix(id, ephemeralSessionPrefix)
+}
+
+// drop a session
+func (agent *Agent) endSession(id string) {
+	agent.sessionsMu.Lock()
+	delete(agent.sessions, id)
+	agent.sessionsMu.Unlock()
+}
+
+// chat session for the request, the agent session when there is no session id
+// the returned unlock releases the session for the next request
+func (agent *Agent) requestSession(id string) (chatSession, func()) {
+	if id == "" {
+		agent.mu.Lock()
+		agent.refreshTools(agent.sessionModel)
+		return agent.session, agent.mu.Unlock
+	}
+
+	agent.sessionsMu.Lock()
+	if agent.sessions == nil {
+		agent.sessions = map[string]*conversation{}
+	}
+	conv, exists := agent.sessions[id]
+	if !exists {
+		agent.pruneSessions()
+		model := agent.copyModel()
+		conv = &conversation{model: model, session: agent.startSession(model)}
+		agent.sessions[id] = conv
+	}
+	conv.lastUsed = time.Now()
+	agent.sessionsMu.Unlock()
+
+	conv.mu.Lock()
+	agent.refreshTools(conv.model)
+	return conv.session, conv.mu.Unlock
+}
+
+// drop the idle sessions, and the least recently used to make room for a new one
+// must be called with sessionsMu held
+func (agent *Agent) pruneSessions() {
+	ids := make([]string, 0, len(agent.sessions))
+	for id, conv := range agent.sessions {
+		if time.Since(conv.lastUsed) > sessionIdleTimeout {
+			delete(agent.sessions, id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) < maxSessions {
+		return
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return agent.sessions[ids[i]].lastUsed.Before(agent.sessions[ids[j]].lastUsed)
+	})
+	for _, id := range ids[:len(ids)-maxSessions+1] {
+		delete(agent.sessions, id)
+	}
+}
+
+// earlier turns given to a plan, the oldest are left out over the limit
+const maxTranscriptMessages = 20
+
+// the text turns of a chat session, tool calls and results are left out
+func sessionTranscript(session chatSession) string {
+	var lines []string
+	switch session := session.(type) {
+	case *genai.ChatSession:
+		for _, content := range session.History {
+			if text := contentText(content); text != "" {
+				lines = append(lines, content.Role+": "+text)
+			}
+		}
+	case *openAISession:
+		for _, message := range session.history {
+			if message.Role != "user" && message.Role != "assistant" {
+				continue
+			}
+			if text := messageText(message); text != "" {
+				lines = append(lines, message.Role+": "+text)
+			}
+		}
+	}
+	if len(lines) > maxTranscriptMessages {
+		lines = lines[len(lines)-maxTranscriptMessages:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// the text of an openai message, content is a string or a list of typed parts
+func messageText(message openAIMessage) string {
+	switch content := message.Content.(type) {
+	case string:
+		return content
+	case []map[string]any:
+		var texts []string
+		for _, part := range content {
+			if text, ok := part["text"].(string); ok {
+				texts = append(texts, text)
+			}
+		}
+		return strings.Join(texts, "\n")
+	}
+	return ""
+}
+
+// add a turn answered outside the chat session, e.g. in plan mode, to its history
+func recordTurn(session chatSession, input string, answer string) {
+	switch session := session.(type) {
+	case *genai.ChatSession:
+		session.History = append(session.History,
+			genai.NewUserContent(genai.Text(input)),
+			&genai.Content{Role: "model", Parts: []genai.Part{genai.Text(answer)}},
+		)
+	case *openAISession:
+		session.history = append(session.history,
+			openAIMessage{Role: "user", Content: input},
+			openAIMessage{Role: "assistant", Content: answer},
+		)
+	}
+}
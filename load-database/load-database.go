@@ -2,90 +2,229 @@ package loaddatabase
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 
+	agentcache "stock-agent/agent-cache"
+	stockdata "stock-agent/stock-data"
+
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-type tickerLine struct {
-	Date  string `bson:"date"`
-	Open  string `bson:"open"`
-	High  string `bson:"high"`
-	Low   string `bson:"low"`
-	Close string `bson:"close"`
+// row errors logged per file
+const maxLoggedRowErrors = 5
+
+// a csv row that could not be converted
+type RowError struct {
+	Line int
+	Err  error
+}
+
+func (rowError RowError) Error() string {
+	return "line " + strconv.Itoa(rowError.Line) + ": " + rowError.Err.Error()
+}
+
+// columns of the csv files, found from the header
+type csvColumns struct {
+	date, open, high, low, close int
+	// -1 when there is no volume
+	volume int
+	count  int
+}
+
+// the columns named in the header, or the original index,date,open,high,low,close layout
+func findColumns(header string) csvColumns {
+	columns := csvColumns{date: 1, open: 2, high: 3, low: 4, close: 5, volume: -1, count: 6}
+	names := strings.Split(strings.ToLower(header), ",")
+	found := map[string]int{}
+	for idx, name := range names {
+		found[strings.TrimSpace(name)] = idx
+	}
+	for _, name := range []string{"date", "open", "high", "low", "close"} {
+		if _, exists := found[name]; !exists {
+			return columns
+		}
+	}
+	columns = csvColumns{date: found["date"], open: found["open"], high: found["high"], low: found["low"], close: found["close"], volume: -1, count: len(names)}
+	if idx, exists := found["volume"]; exists {
+		columns.volume = idx
+	}
+	return columns
+}
+
+// convert the csv content to typed lines, returning the rows that could not be converted
+func parseCSV(content string) ([]stockdata.TickerLine, []RowError) {
+	contentLines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	columns := findColumns(contentLines[0])
+	var lines []stockdata.TickerLine
+	var rowErrors []RowError
+	for idx, contentLine := range contentLines[1:] {
+		if strings.TrimSpace(contentLine) == "" {
+			continue
+		}
+		line, err := parseRow(strings.Split(contentLine, ","), columns)
+		if err != nil {
+			// line numbers from 1 with the header
+			rowErrors = append(rowErrors, RowError{Line: idx + 2, Err: err})
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, rowErrors
+}
+
+func parseRow(fields []string, columns csvColumns) (stockdata.TickerLine, error) {
+	line := stockdata.TickerLine{}
+	if len(fields) != columns.count {
+		return line, errors.New("expected " + strconv.Itoa(columns.count) + " fields, got " + strconv.Itoa(len(fields)))
+	}
+	date, err := stockdata.ParseDate(fields[columns.date])
+	if err != nil {
+		return line, err
+	}
+	line.Date = date
+	prices := []*float64{&line.Open, &line.High, &line.Low, &line.Close}
+	for idx, column := range []int{columns.open, columns.high, columns.low, columns.close} {
+		price, err := strconv.ParseFloat(strings.TrimSpace(fields[column]), 64)
+		if err != nil || price < 0 {
+			return line, errors.New("invalid " + stockdata.PriceFields[idx] + " \"" + fields[column] + "\"")
+		}
+		*prices[idx] = price
+	}
+	if columns.volume >= 0 && strings.TrimSpace(fields[columns.volume]) != "" {
+		// volumes are sometimes written as floats
+		volume, err := strconv.ParseFloat(strings.TrimSpace(fields[columns.volume]), 64)
+		if err != nil || volume < 0 {
+			return line, errors.New("invalid volume \"" + fields[columns.volume] + "\"")
+		}
+		line.Volume = int64(volume)
+	}
+	return line, nil
+}
+
+// database load settings
+type LoadOptions struct {
+	// directory of the <ticker>.csv files, NASDAQ_DATA when empty
+	DataDir string
+	// only load these tickers, all files when empty
+	Tickers []string
+	// replace only the loaded ticker collections instead of dropping the database
+	Append bool
 }
 
-func LoadNasdaqDatabase(databaseName string) {
+func LoadNasdaqDatabase(databaseName string, loadOptions LoadOptions) error {
 
 	// pull the db client
 	mongodbUri, exists := os.LookupEnv("MONGODB_URI")
 	if !exists {
-		log.Fatalln("no MONGODB_URI in env vars")
+		return errors.New("no MONGODB_URI in env vars")
 	}
 	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(mongodbUri))
 	if err != nil {
-		log.Fatalln("error connecting to mongoDB", err)
-	}
-
-	// clear out any existing database and recreate
-	err = client.Database(databaseName).Drop(context.TODO())
-	if err != nil {
-		log.Fatalln("error connecting to mongoDB", err)
+		log.Println("error connecting to mongoDB", err)
+		return err
 	}
+	defer client.Disconnect(context.TODO())
 
 	// load the directory
-	dir, exists := os.LookupEnv("NASDAQ_DATA")
-	if !exists {
-		log.Fatalln("no NASDAQ_DATA in env vars")
+	dir := loadOptions.DataDir
+	if dir == "" {
+		dir, exists = os.LookupEnv("NASDAQ_DATA")
+		if !exists {
+			return errors.New("no NASDAQ_DATA in env vars")
+		}
+	}
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
 	}
 	filenames, err := os.ReadDir(dir)
 	if err != nil {
-		log.Fatalln("error reading dir", err)
+		log.Println("error reading dir", err)
+		return err
+	}
+
+	// clear out any existing database and recreate
+	if !loadOptions.Append {
+		err = client.Database(databaseName).Drop(context.TODO())
+		if err != nil {
+			log.Println("error dropping the database", err)
+			return err
+		}
 	}
 
 	// process each file
+	tickers := map[string]bool{}
+	for _, ticker := range loadOptions.Tickers {
+		tickers[strings.ToLower(ticker)] = true
+	}
+	loaded, rows, rejected := 0, 0, 0
 	for _, filename := range filenames {
+		ticker := strings.Split(filename.Name(), ".")[0]
+		if filename.IsDir() || (len(tickers) > 0 && !tickers[strings.ToLower(ticker)]) {
+			continue
+		}
 		// open and read the content
 		content, err := os.ReadFile(dir + filename.Name())
 		if err != nil {
-			log.Fatalln("error reading file:", filename.Name())
+			log.Println("error reading file:", filename.Name())
+			return err
+		}
+		// convert to the typed schema, reporting the rows that do not convert
+		dayLines, rowErrors := parseCSV(string(content))
+		if len(rowErrors) > 0 {
+			log.Println(filename.Name() + ": rejected " + strconv.Itoa(len(rowErrors)) + " of " + strconv.Itoa(len(rowErrors)+len(dayLines)) + " rows")
+			for _, rowError := range rowErrors[:min(len(rowErrors), maxLoggedRowErrors)] {
+				log.Println(filename.Name() + ": " + rowError.Error())
+			}
+			rejected += len(rowErrors)
+		}
+		if len(dayLines) == 0 {
+			log.Println("no data in file:", filename.Name())
+			continue
 		}
-		// split the content on new line
-		contentLines := strings.Split(string(content), "\r\n")
 
 		// create the collection based on the filename ticker
-		coll := client.Database(databaseName).Collection(strings.Split(filename.Name(), ".")[0])
-
-		// extract each line
-		var dayData []interface{}
-		for idx, line := range contentLines {
-			// skip the first line
-			if idx == 0 {
-				continue
-			}
-			// populate the ticker line
-			lineSplit := strings.Split(line, ",")
-			if len(lineSplit) != 6 {
-				// ignore - last line
-				continue
+		coll := client.Database(databaseName).Collection(ticker)
+		if loadOptions.Append {
+			err = coll.Drop(context.TODO())
+			if err != nil {
+				log.Println("error dropping collection:", ticker)
+				return err
 			}
-			dayData = append(dayData, tickerLine{
-				Date:  lineSplit[1],
-				Open:  lineSplit[2],
-				High:  lineSplit[3],
-				Low:   lineSplit[4],
-				Close: lineSplit[5],
-			})
 		}
 
 		// add to the collection as a batch
+		dayData := make([]interface{}, len(dayLines))
+		for idx, line := range dayLines {
+			dayData[idx] = line
+		}
 		_, err = coll.InsertMany(context.TODO(), dayData)
 		if err != nil {
-			log.Fatalln("error inserting batch:", err)
+			log.Println("error inserting batch:", err)
+			return err
 		}
+		err = stockdata.EnsureIndexes(context.TODO(), coll)
+		if err != nil {
+			log.Println("error indexing collection:", ticker)
+			return err
+		}
+		loaded++
+		rows += len(dayLines)
 	}
+	log.Println("loaded " + strconv.Itoa(loaded) + " tickers (" + strconv.Itoa(rows) + " rows, " + strconv.Itoa(rejected) + " rejected) into " + databaseName)
 
+	// cached answers were built from the old data
+	err = agentcache.Invalidate(context.TODO())
+	if err != nil {
+		log.Println("error invalidating the agent cache:", err)
+	}
+	err = agentcache.BumpDataVersion(context.TODO(), client)
+	if err != nil {
+		log.Println("error bumping the data version:", err)
+	}
+	return nil
 }
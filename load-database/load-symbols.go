@@ -0,0 +1,95 @@
+package loaddatabase
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+
+	agentcache "stock-agent/agent-cache"
+	tickersymbols "stock-agent/ticker-symbols"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/////////
+// Symbol metadata loading
+/////////
+
+// replace the symbols collection with the symbols csv, SYMBOLS_CSV when the path is empty
+func LoadSymbols(path string) error {
+	ctx := context.TODO()
+
+	if path == "" {
+		var exists bool
+		path, exists = os.LookupEnv("SYMBOLS_CSV")
+		if !exists {
+			return errors.New("no SYMBOLS_CSV in env vars")
+		}
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Println("error reading file:", path)
+		return err
+	}
+	symbols, rowErrors, err := tickersymbols.ParseCSV(string(content))
+	if err != nil {
+		return err
+	}
+	if len(rowErrors) > 0 {
+		log.Println(path + ": rejected " + strconv.Itoa(len(rowErrors)) + " of " + strconv.Itoa(len(rowErrors)+len(symbols)) + " rows")
+		for _, rowError := range rowErrors[:min(len(rowErrors), maxLoggedRowErrors)] {
+			log.Println(path + ": " + rowError.Error())
+		}
+	}
+	if len(symbols) == 0 {
+		return errors.New("no symbols in " + path)
+	}
+
+	// pull the db client
+	mongodbUri, exists := os.LookupEnv("MONGODB_URI")
+	if !exists {
+		return errors.New("no MONGODB_URI in env vars")
+	}
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongodbUri))
+	if err != nil {
+		log.Println("error connecting to mongoDB", err)
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	coll := client.Database(tickersymbols.Database).Collection(tickersymbols.Collection)
+	err = coll.Drop(ctx)
+	if err != nil {
+		log.Println("error dropping collection:", tickersymbols.Collection)
+		return err
+	}
+	symbolData := make([]interface{}, len(symbols))
+	for idx, symbol := range symbols {
+		symbolData[idx] = symbol
+	}
+	_, err = coll.InsertMany(ctx, symbolData)
+	if err != nil {
+		log.Println("error inserting batch:", err)
+		return err
+	}
+	err = tickersymbols.EnsureIndexes(ctx, coll)
+	if err != nil {
+		log.Println("error indexing collection:", tickersymbols.Collection)
+		return err
+	}
+	log.Println("loaded " + strconv.Itoa(len(symbols)) + " symbols (" + strconv.Itoa(len(rowErrors)) + " rejected) into " + tickersymbols.Database + "." + tickersymbols.Collection)
+
+	// resolutions made from the old symbols, the resolvers read the symbols again on the version bump
+	err = agentcache.Invalidate(ctx)
+	if err != nil {
+		log.Println("error invalidating the agent cache:", err)
+	}
+	err = agentcache.BumpDataVersion(ctx, client)
+	if err != nil {
+		log.Println("error bumping the data version:", err)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package loaddatabase
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+
+	agentcache "stock-agent/agent-cache"
+	stockdata "stock-agent/stock-data"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/////////
+// Migration of string collections to the typed schema
+/////////
+
+// database migration settings
+type MigrateOptions struct {
+	// only migrate these tickers, all collections when empty
+	Tickers []string
+	// count the documents to convert without changing them
+	DryRun bool
+	// delete the documents that cannot be converted instead of leaving them as strings
+	DropInvalid bool
+}
+
+// fields of the original schema held as strings
+var legacyFilter = bson.D{{Key: "$or", Value: bson.A{
+	bson.D{{Key: "date", Value: bson.D{{Key: "$type", Value: "string"}}}},
+	bson.D{{Key: "open", Value: bson.D{{Key: "$type", Value: "string"}}}},
+	bson.D{{Key: "high", Value: bson.D{{Key: "$type", Value: "string"}}}},
+	bson.D{{Key: "low", Value: bson.D{{Key: "$type", Value: "string"}}}},
+	bson.D{{Key: "close", Value: bson.D{{Key: "$type", Value: "string"}}}},
+	bson.D{{Key: "volume", Value: bson.D{{Key: "$type", Value: "string"}}}},
+}}}
+
+// a date from the leading yyyy-mm-dd of a string, dates are kept, null when invalid
+var dateExpression = bson.D{{Key: "$cond", Value: bson.A{
+	bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$type", Value: "$date"}}, "date"}}},
+	"$date",
+	bson.D{{Key: "$dateFromString", Value: bson.D{
+		{Key: "dateString", Value: bson.D{{Key: "$substrCP", Value: bson.A{"$date", 0, len(stockdata.DateLayout)}}}},
+		{Key: "format", Value: "%Y-%m-%d"},
+		{Key: "timezone", Value: "UTC"},
+		{Key: "onError", Value: nil},
+		{Key: "onNull", Value: nil},
+	}}},
+}}}
+
+// a double from a string or number field, null when invalid
+func doubleExpression(field string) bson.D {
+	return bson.D{{Key: "$convert", Value: bson.D{
+		{Key: "input", Value: "$" + field},
+		{Key: "to", Value: "double"},
+		{Key: "onError", Value: nil},
+		{Key: "onNull", Value: nil},
+	}}}
+}
+
+// true when the volume is missing or converts
+var volumeValid = bson.D{{Key: "$or", Value: bson.A{
+	bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$type", Value: "$volume"}}, "missing"}}},
+	bson.D{{Key: "$ne", Value: bson.A{doubleExpression("volume"), nil}}},
+}}}
+
+// true when every field of the document converts
+func convertibleExpression() bson.D {
+	checks := bson.A{bson.D{{Key: "$ne", Value: bson.A{dateExpression, nil}}}}
+	for _, field := range stockdata.PriceFields {
+		checks = append(checks, bson.D{{Key: "$ne", Value: bson.A{doubleExpression(field), nil}}})
+	}
+	checks = append(checks, volumeValid)
+	return bson.D{{Key: "$and", Value: checks}}
+}
+
+// pipeline update to the typed schema
+func migrationUpdate() bson.A {
+	set := bson.D{{Key: "date", Value: dateExpression}}
+	for _, field := range stockdata.PriceFields {
+		set = append(set, bson.E{Key: field, Value: doubleExpression(field)})
+	}
+	set = append(set, bson.E{Key: "volume", Value: bson.D{{Key: "$cond", Value: bson.A{
+		bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$type", Value: "$volume"}}, "missing"}}},
+		"$$REMOVE",
+		bson.D{{Key: "$toLong", Value: doubleExpression("volume")}},
+	}}}})
+	return bson.A{bson.D{{Key: "$set", Value: set}}}
+}
+
+// convert the ticker collections loaded with string fields to the typed schema
+// documents that cannot be converted are reported and left as they are, or deleted with DropInvalid
+func MigrateNasdaqDatabase(databaseName string, migrateOptions MigrateOptions) error {
+	ctx := context.TODO()
+
+	// pull the db client
+	mongodbUri, exists := os.LookupEnv("MONGODB_URI")
+	if !exists {
+		return errors.New("no MONGODB_URI in env vars")
+	}
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongodbUri))
+	if err != nil {
+		log.Println("error connecting to mongoDB", err)
+		return err
+	}
+	defer client.Disconnect(ctx)
+	db := client.Database(databaseName)
+
+	// the collections to migrate
+	names := migrateOptions.Tickers
+	if len(names) == 0 {
+		names, err = db.ListCollectionNames(ctx, bson.D{{Key: "name", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$regex", Value: "^system\\."}}}}}})
+		if err != nil {
+			log.Println("error listing collections", err)
+			return err
+		}
+	}
+
+	convertible := bson.D{{Key: "$and", Value: bson.A{legacyFilter, bson.D{{Key: "$expr", Value: convertibleExpression()}}}}}
+	invalid := bson.D{{Key: "$and", Value: bson.A{legacyFilter, bson.D{{Key: "$expr", Value: bson.D{{Key: "$not", Value: bson.A{convertibleExpression()}}}}}}}}
+	migrated, converted, invalidTotal := 0, int64(0), int64(0)
+	for _, name := range names {
+		coll := db.Collection(name)
+		toConvert, err := coll.CountDocuments(ctx, convertible)
+		if err != nil {
+			log.Println("error counting documents:", name)
+			return err
+		}
+		invalidCount, err := coll.CountDocuments(ctx, invalid)
+		if err != nil {
+			log.Println("error counting documents:", name)
+			return err
+		}
+		if toConvert == 0 && invalidCount == 0 {
+			continue
+		}
+
+		// report the documents that will not convert
+		if invalidCount > 0 {
+			log.Println(name + ": " + strconv.FormatInt(invalidCount, 10) + " documents cannot be converted")
+			cursor, err := coll.Find(ctx, invalid, options.Find().SetLimit(maxLoggedRowErrors))
+			if err != nil {
+				log.Println("error finding documents:", name)
+				return err
+			}
+			var documents []bson.M
+			err = cursor.All(ctx, &documents)
+			if err != nil {
+				return err
+			}
+			for _, document := range documents {
+				documentDat, _ := bson.MarshalExtJSON(document, false, false)
+				log.Println(name + ": " + string(documentDat))
+			}
+		}
+		converted += toConvert
+		invalidTotal += invalidCount
+		migrated++
+		if migrateOptions.DryRun {
+			log.Println(name + ": would convert " + strconv.FormatInt(toConvert, 10) + " documents")
+			continue
+		}
+
+		result, err := coll.UpdateMany(ctx, convertible, migrationUpdate())
+		if err != nil {
+			log.Println("error converting documents:", name)
+			return err
+		}
+		log.Println(name + ": converted " + strconv.FormatInt(result.ModifiedCount, 10) + " documents")
+		if migrateOptions.DropInvalid && invalidCount > 0 {
+			deleted, err := coll.DeleteMany(ctx, invalid)
+			if err != nil {
+				log.Println("error deleting documents:", name)
+				return err
+			}
+			log.Println(name + ": deleted " + strconv.FormatInt(deleted.DeletedCount, 10) + " documents")
+		}
+		err = stockdata.EnsureIndexes(ctx, coll)
+		if err != nil {
+			log.Println("error indexing collection:", name)
+			return err
+		}
+	}
+
+	summary := strconv.Itoa(migrated) + " collections, " + strconv.FormatInt(converted, 10) + " documents to convert, " + strconv.FormatInt(invalidTotal, 10) + " invalid"
+	if migrateOptions.DryRun {
+		log.Println("dry run over " + summary)
+		return nil
+	}
+	log.Println("migrated " + summary + " in " + databaseName)
+
+	// cached answers were built from the old data
+	err = agentcache.Invalidate(ctx)
+	if err != nil {
+		log.Println("error invalidating the agent cache:", err)
+	}
+	err = agentcache.BumpDataVersion(ctx, client)
+	if err != nil {
+		log.Println("error bumping the data version:", err)
+	}
+	if invalidTotal > 0 && !migrateOptions.DropInvalid {
+		return errors.New(strconv.FormatInt(invalidTotal, 10) + " documents could not be converted, fix them or run again with -drop-invalid")
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"strings"
+
+	loaddatabase "stock-agent/load-database"
+)
+
+// load the nasdaq database from the csv files
+func runLoad(args []string) error {
+	flags := flag.NewFlagSet("load", flag.ContinueOnError)
+	database := flags.String("database", "nasdaq", "database to load")
+	dataDir := flags.String("data", "", "directory of the <ticker>.csv files, NASDAQ_DATA by default")
+	tickers := flags.String("tickers", "", "comma separated tickers to load, all files by default")
+	appendTickers := flags.Bool("append", false, "replace only the loaded ticker collections instead of dropping the database")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usageError{errors.New("unexpected load arguments: " + strings.Join(flags.Args(), " "))}
+	}
+
+	options := loaddatabase.LoadOptions{DataDir: *dataDir, Append: *appendTickers}
+	if *tickers != "" {
+		for _, ticker := range strings.Split(*tickers, ",") {
+			options.Tickers = append(options.Tickers, strings.TrimSpace(ticker))
+		}
+	}
+	return loaddatabase.LoadNasdaqDatabase(*database, options)
+}
+
+// load the symbol metadata from the symbols csv
+func runLoadSymbols(args []string) error {
+	flags := flag.NewFlagSet("load-symbols", flag.ContinueOnError)
+	file := flags.String("file", "", "symbols csv file, SYMBOLS_CSV by default")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usageError{errors.New("unexpected load-symbols arguments: " + strings.Join(flags.Args(), " "))}
+	}
+	return loaddatabase.LoadSymbols(*file)
+}
+
+// convert the collections loaded with string fields to the typed schema
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	database := flags.String("database", "nasdaq", "database to migrate")
+	tickers := flags.String("tickers", "", "comma separated tickers to migrate, all collections by default")
+	dryRun := flags.Bool("dry-run", false, "report the documents to convert without changing them")
+	dropInvalid := flags.Bool("drop-invalid", false, "delete the documents that cannot be converted")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usageError{errors.New("unexpected migrate arguments: " + strings.Join(flags.Args(), " "))}
+	}
+
+	options := loaddatabase.MigrateOptions{DryRun: *dryRun, DropInvalid: *dropInvalid}
+	if *tickers != "" {
+		for _, ticker := range strings.Split(*tickers, ",") {
+			options.Tickers = append(options.Tickers, strings.TrimSpace(ticker))
+		}
+	}
+	return loaddatabase.MigrateNasdaqDatabase(*database, options)
+}
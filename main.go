@@ -1,119 +1,172 @@
 package main
 
 import (
-	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
-	datacombineagent "stock-agent/data-combine-agent"
-	databaseagent "stock-agent/database-agent"
-	loaddatabase "stock-agent/load-database"
-	quarterlyresultsagent "stock-agent/quarterly-results-agent"
-	stockMarketInfoApp "stock-agent/stock-market-info-app"
+	agentconfig "stock-agent/agent-config"
 
 	"github.com/joho/godotenv"
 )
 
+// command line usage
+const usage = `usage: stock-agent [-config <file>] [-log-level <level>] <command> [flags]
+
+commands:
+  serve         run the registry service and agents in this process
+  supervise     run the registry service and agents as supervised processes
+  load          load the nasdaq database from the csv files
+  load-symbols  load the ticker symbol metadata from the symbols csv
+  migrate       convert a database loaded with string prices to the typed schema
+  ask           send a question to an agent and print the answer
+  repl          talk to an agent interactively
+  eval          run an evaluation suite against an agent
+
+run stock-agent <command> -h for the command flags
+
+global flags:
+`
+
+// exit codes
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// log level of the command line, passed on to supervised processes
+var logLevel = "info"
+
+// bad command line, reported with exit code 2
+type usageError struct {
+	error
+}
+
 func main() {
+	os.Exit(run(os.Args[1:]))
+}
 
-	// pull in the env vars
-	err := godotenv.Load()
+// run the command line and return the exit code
+func run(args []string) int {
+	flags := flag.NewFlagSet("stock-agent", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	configPath := flags.String("config", "", "config file (.yaml, .yml or .toml), AGENT_CONFIG by default")
+	flags.StringVar(&logLevel, "log-level", logLevel, "debug (with source lines), info or quiet")
+	err := parseFlags(flags, args)
 	if err != nil {
-		log.Fatalln("error loading .env file:", err)
+		return exitCode(err)
 	}
-
-	// load the database if requested
-	load, exists := os.LookupEnv("LOAD_DB")
-	if exists && load == "true" {
-		loaddatabase.LoadNasdaqDatabase("nasdaq")
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
 	}
 
-	// agent initializations
-	// initialize and run the nasdaq database agent as a service
-	dbAgentHostname, exists := os.LookupEnv("DATABASE_AGENT_HOSTNAME")
-	if !exists {
-		log.Fatalln("missing DATABASE_AGENT_HOSTNAME in .env")
-	}
-	dbAgentPort, exists := os.LookupEnv("DATABASE_AGENT_PORT")
-	if !exists {
-		log.Fatalln("missing DATABASE_AGENT_PORT in .env")
-	}
-	dbAgent, err := databaseagent.InitDatabaseAgent(context.Background())
+	err = setLogLevel(logLevel)
 	if err != nil {
-		log.Fatalln("error InitDatabaseAgent:", err)
+		return exitCode(usageError{err})
 	}
-	dbAgent.RunAgent(dbAgentHostname, dbAgentPort)
-
-	// initialize and run the quarterly results agent as a service
-	qrAgentHostname, exists := os.LookupEnv("QUARTERLY_RESULTS_AGENT_HOSTNAME")
-	if !exists {
-		log.Fatalln("missing QUARTERLY_RESULTS_AGENT_HOSTNAME in .env")
-	}
-	qrAgentPort, exists := os.LookupEnv("QUARTERLY_RESULTS_AGENT_PORT")
-	if !exists {
-		log.Fatalln("missing QUARTERLY_RESULTS_AGENT_PORT in .env")
-	}
-	qrAgent, err := quarterlyresultsagent.InitQuarterlyResultsAgent(context.Background())
+	err = loadEnv(*configPath)
 	if err != nil {
-		log.Fatalln("error InitQuarterlyResultsAgent:", err)
+		return exitCode(err)
 	}
-	qrAgent.RunAgent(qrAgentHostname, qrAgentPort)
 
-	// initialize and run the data combiner agent as a service
-	dcAgentHostname, exists := os.LookupEnv("DATA_COMBINE_AGENT_HOSTNAME")
-	if !exists {
-		log.Fatalln("missing DATA_COMBINE_AGENT_HOSTNAME in .env")
-	}
-	dcAgentPort, exists := os.LookupEnv("DATA_COMBINE_AGENT_PORT")
-	if !exists {
-		log.Fatalln("missing DATA_COMBINE_AGENT_PORT in .env")
-	}
-	dcAgent, err := datacombineagent.InitDataCombineAgent(context.Background())
-	if err != nil {
-		log.Fatalln("error InitDataCombineAgent:", err)
-	}
-	dcAgent.RunAgent(dcAgentHostname, dcAgentPort)
+	command, commandArgs := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "serve":
+		err = runServe(commandArgs)
+	case "supervise":
+		err = runSupervise(commandArgs)
+	case "load":
+		err = runLoad(commandArgs)
+	case "load-symbols":
+		err = runLoadSymbols(commandArgs)
+	case "migrate":
+		err = runMigrate(commandArgs)
+	case "ask":
+		err = runAsk(commandArgs)
+	case "repl":
+		err = runREPL(commandArgs)
+	case "eval":
+		err = runEval(commandArgs)
+	default:
+		flags.Usage()
+		err = usageError{errors.New("unknown command: " + command)}
+	}
+	return exitCode(err)
+}
 
-	// initialize and run the stock market info app as a service
-	smiHostname, exists := os.LookupEnv("STOCK_MARKET_INFO_APP_HOSTNAME")
-	if !exists {
-		log.Fatalln("missing STOCK_MARKET_INFO_APP_HOSTNAME in .env")
-	}
-	smiPort, exists := os.LookupEnv("STOCK_MARKET_INFO_APP_PORT")
-	if !exists {
-		log.Fatalln("missing STOCK_MARKET_INFO_APP_PORT in .env")
+// map a command error to its exit code, reporting it on stderr
+func exitCode(err error) int {
+	var usageErr usageError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.As(err, &usageErr):
+		// the flag package already reported its own parse errors
+		if usageErr.error != errFlagParse {
+			fmt.Fprintln(os.Stderr, "error:", usageErr.error)
+		}
+		return exitUsage
+	default:
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return exitError
 	}
-	smi, err := stockMarketInfoApp.InitStockMarketInfoAgent(context.Background())
-	if err != nil {
-		log.Fatalln("error InitStockMarketInfoAgent:", err)
-	}
-	smi.RunAgent(smiHostname, smiPort)
+}
 
-	// call the database agent through the client tool
-	//response, err := databaseagent.CallDatabaseAgent("what was Apple's highest close price in November 2024")
-	//response, err := databaseagent.CallDatabaseAgent("how many collections are there")
-	if err != nil {
-		log.Fatalln("error call agent:", err)
-	}
-	//log.Println(response)
+// flag parse failure already printed by the flag set
+var errFlagParse = errors.New("invalid flags")
 
-	// call the quarterly results agent through the client tool
-	//response, err = quarterlyresultsagent.CallQuarterlyResultsAgent("Get Apple's Q4 2024 results")
-	if err != nil {
-		log.Fatalln("error call agent:", err)
+// parse the flags of a command
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	err := flags.Parse(args)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, flag.ErrHelp):
+		return err
+	default:
+		return usageError{errFlagParse}
 	}
-	//log.Println(response)
+}
 
-	// call the data combiner for a compound query
-	//response, err := datacombineagent.CallDataCombineAgent("Get Apple's close price for all of November 2024, summarize the same years Q4 results and then generate a table for all quarters of 2024 financial results")
-	if err != nil {
-		log.Fatalln("error call agent:", err)
+// set the log output for the level
+func setLogLevel(level string) error {
+	switch level {
+	case "debug":
+		log.SetFlags(log.LstdFlags | log.Lshortfile)
+	case "info":
+	case "quiet":
+		log.SetOutput(io.Discard)
+	default:
+		return errors.New("unknown log level: " + level + ", expected debug, info or quiet")
+	}
+	return nil
+}
+
+// pull in the env vars from .env and the config file
+// env vars that are already set take precedence over both
+func loadEnv(configPath string) error {
+	err := godotenv.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return errors.New("error loading .env file: " + err.Error())
 	}
-	//log.Println(response)
 
-	// call the stock market info app
-	response, err := stockMarketInfoApp.CallStockMarketInfoApp("Get Apple's close price for all of November 2024, summarize the same years Q4 results and then generate a table for all quarters of 2024 financial results")
+	if configPath == "" {
+		configPath = os.Getenv("AGENT_CONFIG")
+	}
+	if configPath == "" {
+		return nil
+	}
+	config, err := agentconfig.Load(configPath)
 	if err != nil {
-		log.Fatalln("error call agent:", err)
+		return err
 	}
-	log.Println(response)
+	return config.Apply()
 }
@@ -1,16 +1,13 @@
 package quarterlyresultsagent
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
-	"io"
 	"log"
-	"net/http"
 	"os"
 
 	agentassemble "stock-agent/gemini-agent-assemble"
+	tickersymbols "stock-agent/ticker-symbols"
 
 	"github.com/google/generative-ai-go/genai"
 )
@@ -41,7 +38,9 @@ var quarterlyResultsTools = &genai.Tool{
 			},
 			Required: []string{"ticker", "year", "quarter"},
 		},
-	}},
+	},
+		tickersymbols.ResolveTickerDeclaration,
+	},
 }
 
 // month quarters (1 is Jan, etc...)
@@ -50,8 +49,8 @@ var q2 = []string{"04", "05", "06"}
 var q3 = []string{"07", "08", "09"}
 var q4 = []string{"10", "11", "12"}
 
-// tool to check if a quarterly result is available
-func getResults(ticker string, year string, quarter string) string {
+// tool to check if a quarterly result is available, the error text is the reply when it is not
+func getResults(ticker string, year string, quarter string) (string, error) {
 	log.Println("running getResults tool for " + ticker + " for " + quarter + " - " + year)
 
 	// first check if the ticker directory exists
@@ -61,7 +60,7 @@ func getResults(ticker string, year string, quarter string) string {
 	}
 	if _, err := os.Stat(resultsRoot + ticker); os.IsNotExist(err) {
 		// does not exist, so reply
-		return "quarterly results for " + ticker + " are not available."
+		return "", errors.New("quarterly results for " + ticker + " are not available.")
 	}
 
 	// now check if the quarter and year exists
@@ -120,19 +119,19 @@ func getResults(ticker string, year string, quarter string) string {
 			break
 		}
 	default:
-		return "unhandled quarter format: " + quarter
+		return "", errors.New("unhandled quarter format: " + quarter)
 	}
 	if filepath == "" {
-		return "quarterly results not found."
+		return "", errors.New("quarterly results not found.")
 	}
 
 	// read the file and return the contents
 	resultsDat, err := os.ReadFile(filepath)
 	if err != nil {
 		log.Println("failed to read results file")
-		return "failed to retrieve quarterly results."
+		return "", errors.New("failed to retrieve quarterly results.")
 	}
-	return string(resultsDat)
+	return string(resultsDat), nil
 }
 
 // agent initialization
@@ -140,15 +139,29 @@ func InitQuarterlyResultsAgent(ctx context.Context) (*agentassemble.Agent, error
 	system := `
 You are an AI agent that retrieve a stock ticker's quarterly results.
 You must use the tools to help answer the request and return the result.
+Use the resolveTicker tool to find the lower case ticker of a company named in the request rather than guessing it. When the result is ambiguous, pick the candidate the request means or say which candidates there are.
 `
 	// initialize the agent
 	var tools = []*genai.Tool{quarterlyResultsTools}
-	agentQuarterlyResults, err := agentassemble.InitAgent(ctx, &system, tools, quarterlyResultsTool)
+	agentQuarterlyResults, err := agentassemble.InitAgent(ctx, &system, tools, quarterlyResultsTool, agentassemble.WithEnvSettings("QUARTERLY_RESULTS_AGENT"))
 	if err != nil {
 		log.Println("Error initializing the quarterly results agent")
 		return nil, err
 	}
 
+	// publish what the agent can do
+	agentQuarterlyResults.SetCapabilities(agentassemble.Capabilities{
+		Name:        "quarterlyResultsAgent",
+		Description: "Make a request to the quarterly results agent. The agent will extract the requested company quarterly results release and return it.",
+		Examples: []string{
+			"Get Apple's Q4 2024 results",
+		},
+	})
+
+	// the results release html is outside content, and fixed for a quarter
+	agentQuarterlyResults.SetToolPolicy(quarterlyResultsTools.FunctionDeclarations[0].Name, agentassemble.ToolPolicy{Untrusted: true, Cacheable: true})
+	agentQuarterlyResults.SetToolPolicy(quarterlyResultsTools.FunctionDeclarations[1].Name, agentassemble.ToolPolicy{Cacheable: true, CacheTTL: tickersymbols.SymbolsTTL})
+
 	// always start a new session
 	agentQuarterlyResults.NewSession()
 
@@ -156,7 +169,7 @@ You must use the tools to help answer the request and return the result.
 }
 
 // tool call handler
-func quarterlyResultsTool(funcall genai.FunctionCall) (string, error) {
+func quarterlyResultsTool(ctx context.Context, funcall genai.FunctionCall) (string, error) {
 
 	result := ""
 	// find the function to call - all tool calls come here
@@ -181,13 +194,21 @@ func quarterlyResultsTool(funcall genai.FunctionCall) (string, error) {
 			return err.Error(), err
 		}
 		// call the query database tool
-		result = getResults(ticker.(string), year.(string), quarter.(string))
+		var err error
+		result, err = getResults(ticker.(string), year.(string), quarter.(string))
+		if err != nil {
+			// a missing release may be added later
+			agentassemble.SkipCache(ctx)
+			result = err.Error()
+		}
 		debugRes := result
 		// cap the debug
 		if len(debugRes) > 500 {
 			debugRes = debugRes[:500]
 		}
 		log.Println("quarterly results result (capped): " + debugRes)
+	} else if funcall.Name == quarterlyResultsTools.FunctionDeclarations[1].Name {
+		return tickersymbols.CallResolveTicker(ctx, funcall)
 	} else {
 		log.Println("unhandled function name: " + funcall.Name)
 		return "", errors.New("unhandled function name: " + funcall.Name)
@@ -217,7 +238,7 @@ var CallQuarterlyResultsAgentTool = &genai.Tool{
 }
 
 // client tool for the database agent
-func CallQuarterlyResultsAgent(message string) (string, error) {
+func CallQuarterlyResultsAgent(ctx context.Context, message string) (string, error) {
 	log.Println("running CallQuarterlyResultsAgent tool for :" + message)
 
 	// get the agent endpoint
@@ -234,40 +255,6 @@ func CallQuarterlyResultsAgent(message string) (string, error) {
 		return "", err
 	}
 
-	// build the payload
-	request := agentassemble.Request{
-		Input: message,
-	}
-	reqDat, err := json.Marshal(request)
-	if err != nil {
-		return "", err
-	}
-
-	// repare the request
-	req, err := http.NewRequest("POST", "http://"+hostname+":"+port+"/agent", bytes.NewBuffer(reqDat))
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	// send the post
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	// extract and decode the reply
-	response := agentassemble.Response{}
-	respDat, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	err = json.Unmarshal(respDat, &response)
-	if err != nil {
-		return "", err
-	}
-
-	return response.Content, nil
+	// send the request with the configured transport
+	return agentassemble.CallAgentEndpoint(ctx, "http://"+hostname+":"+port, message)
 }
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	agentconfig "stock-agent/agent-config"
+	agentassemble "stock-agent/gemini-agent-assemble"
+)
+
+/////////
+// Interactive conversation with an agent
+/////////
+
+// a question and answer of the conversation
+type replTurn struct {
+	Agent    string               `json:"agent"`
+	Question string               `json:"question"`
+	Answer   string               `json:"answer,omitempty"`
+	Error    string               `json:"error,omitempty"`
+	Steps    []agentassemble.Step `json:"steps,omitempty"`
+	Time     time.Time            `json:"time"`
+}
+
+// repl state
+type repl struct {
+	agent     string
+	client    agentassemble.AgentClient
+	transport string
+	timeout   time.Duration
+	mode      string
+	sessionID string
+	history   []replTurn
+	out       io.Writer
+}
+
+const replHelp = `commands:
+  /agent <name or url>  talk to another agent, starting a new session
+  /mode <react|plan>    set the request mode, empty for the agent default
+  /reset                start a new session
+  /history              show the conversation
+  /export <file>        save the conversation as markdown (.md) or json (.json)
+  /help                 show this help
+  /quit                 leave
+`
+
+// talk to an agent, keeping a session for multi-turn conversation
+func runREPL(args []string) error {
+	flags := flag.NewFlagSet("repl", flag.ContinueOnError)
+	agentName := flags.String("agent", "stockMarketInfoApp", "agent to talk to: "+strings.Join(agentconfig.AgentNames(), ", ")+", or an endpoint url")
+	transport := flags.String("transport", agentassemble.AgentTransport(), "http or grpc")
+	timeout := flags.Duration("timeout", agentassemble.AgentTimeout(), "request deadline")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	session := &repl{transport: *transport, timeout: *timeout, out: os.Stdout}
+	err = session.connect(*agentName)
+	if err != nil {
+		return usageError{err}
+	}
+	fmt.Fprintln(session.out, "connected to "+session.agent+", session "+session.sessionID+", /help for the commands")
+
+	input := bufio.NewScanner(os.Stdin)
+	input.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for {
+		fmt.Fprint(session.out, session.agent+"> ")
+		if !input.Scan() {
+			fmt.Fprintln(session.out)
+			return input.Err()
+		}
+		line := strings.TrimSpace(input.Text())
+		switch {
+		case line == "":
+			continue
+		case line == "/quit" || line == "/exit":
+			return nil
+		case strings.HasPrefix(line, "/"):
+			err = session.command(line)
+		default:
+			err = session.ask(line)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+	}
+}
+
+// random session id
+func newSessionID() string {
+	dat := make([]byte, 8)
+	rand.Read(dat)
+	return hex.EncodeToString(dat)
+}
+
+// connect to an agent by name or endpoint url with a new session
+func (session *repl) connect(agent string) error {
+	endpoint := agent
+	if !strings.Contains(agent, "://") {
+		if _, known := agentconfig.Prefix(agent); !known {
+			return errors.New("unknown agent: " + agent)
+		}
+		hostname, port, err := agentAddress(agent)
+		if err != nil {
+			return err
+		}
+		endpoint = "http://" + hostname + ":" + port
+	}
+	client, err := agentassemble.NewAgentClient(session.transport, endpoint)
+	if err != nil {
+		return err
+	}
+	session.agent = agent
+	session.client = client
+	session.sessionID = newSessionID()
+	return nil
+}
+
+// run a repl command
+func (session *repl) command(line string) error {
+	command, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch command {
+	case "/agent":
+		if arg == "" {
+			fmt.Fprintln(session.out, session.agent)
+			return nil
+		}
+		err := session.connect(arg)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(session.out, "connected to "+session.agent+", session "+session.sessionID)
+	case "/mode":
+		if arg != "" && arg != agentassemble.ModeReAct && arg != agentassemble.ModePlan {
+			return errors.New("unknown mode: " + arg)
+		}
+		session.mode = arg
+	case "/reset":
+		session.sessionID = newSessionID()
+		session.history = nil
+		fmt.Fprintln(session.out, "new session "+session.sessionID)
+	case "/history":
+		for _, turn := range session.history {
+			fmt.Fprintln(session.out, turn.Agent+"> "+turn.Question)
+			if turn.Error != "" {
+				fmt.Fprintln(session.out, "error: "+turn.Error)
+				continue
+			}
+			fmt.Fprintln(session.out, renderMarkdown(turn.Answer))
+		}
+	case "/export":
+		if arg == "" {
+			return errors.New("usage: /export <file>")
+		}
+		err := session.export(arg)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(session.out, "conversation saved to "+arg)
+	case "/help":
+		fmt.Fprint(session.out, replHelp)
+	default:
+		return errors.New("unknown command: " + command + ", /help for the commands")
+	}
+	return nil
+}
+
+// ask the question in the session, showing the tool calls as they happen
+// ctrl-c cancels the request and keeps the repl
+func (session *repl) ask(question string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, session.timeout)
+	defer cancel()
+
+	turn := replTurn{Agent: session.agent, Question: question, Time: time.Now()}
+	request := agentassemble.Request{Input: question, Mode: session.mode, SessionID: session.sessionID}
+	response, err := session.client.AskStream(ctx, request, func(step agentassemble.Step) {
+		turn.Steps = append(turn.Steps, step)
+		if isAgentCall(step.Tool) {
+			fmt.Fprint(os.Stderr, "agent ")
+		} else {
+			fmt.Fprint(os.Stderr, "tool  ")
+		}
+		printStep(step)
+	})
+	if err != nil {
+		turn.Error = err.Error()
+		session.history = append(session.history, turn)
+		return err
+	}
+	turn.Answer = response.Content
+	session.history = append(session.history, turn)
+	fmt.Fprintln(session.out, renderMarkdown(response.Content))
+	return nil
+}
+
+// downstream agents are exposed to their callers as call<Name> tools
+func isAgentCall(tool string) bool {
+	return strings.HasPrefix(tool, "call")
+}
+
+// save the conversation as markdown or json
+func (session *repl) export(path string) error {
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		historyDat, err := json.MarshalIndent(session.history, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, append(historyDat, '\n'), 0644)
+	}
+	var transcript strings.Builder
+	for _, turn := range session.history {
+		transcript.WriteString("## " + turn.Agent + ": " + turn.Question + "\n\n")
+		for _, step := range turn.Steps {
+			argsDat, _ := json.Marshal(step.Args)
+			transcript.WriteString("- `" + step.Tool + "` " + string(argsDat) + "\n")
+		}
+		if len(turn.Steps) > 0 {
+			transcript.WriteString("\n")
+		}
+		if turn.Error != "" {
+			transcript.WriteString("error: " + turn.Error + "\n\n")
+			continue
+		}
+		transcript.WriteString(turn.Answer + "\n\n")
+	}
+	return os.WriteFile(path, []byte(transcript.String()), 0644)
+}
+
+/////////
+// Terminal markdown
+/////////
+
+// draw the markdown tables of the text with aligned columns, other lines are kept
+func renderMarkdown(text string) string {
+	lines := strings.Split(text, "\n")
+	var rendered []string
+	for idx := 0; idx < len(lines); idx++ {
+		if !isTableRow(lines[idx]) {
+			rendered = append(rendered, lines[idx])
+			continue
+		}
+		end := idx
+		for end < len(lines) && isTableRow(lines[end]) {
+			end++
+		}
+		rendered = append(rendered, renderTable(lines[idx:end])...)
+		idx = end - 1
+	}
+	return strings.Join(rendered, "\n")
+}
+
+func isTableRow(line string) bool {
+	line = strings.TrimSpace(line)
+	return len(line) > 1 && strings.HasPrefix(line, "|") && strings.HasSuffix(line, "|")
+}
+
+// the |---|:---:| row under the header
+func isTableRule(cells []string) bool {
+	for _, cell := range cells {
+		if strings.Trim(cell, "-: ") != "" || !strings.Contains(cell, "-") {
+			return false
+		}
+	}
+	return true
+}
+
+func tableCells(line string) []string {
+	line = strings.TrimSpace(line)
+	cells := strings.Split(line[1:len(line)-1], "|")
+	for idx, cell := range cells {
+		cells[idx] = strings.TrimSpace(strings.ReplaceAll(cell, "**", ""))
+	}
+	return cells
+}
+
+func renderTable(lines []string) []string {
+	var rows [][]string
+	header := false
+	for idx, line := range lines {
+		cells := tableCells(line)
+		if isTableRule(cells) {
+			header = header || idx == 1
+			continue
+		}
+		rows = append(rows, cells)
+	}
+	widths := []int{}
+	for _, row := range rows {
+		for idx, cell := range row {
+			if idx >= len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[idx] = max(widths[idx], utf8.RuneCountInString(cell))
+		}
+	}
+	rule := func(left string, middle string, right string) string {
+		parts := make([]string, len(widths))
+		for idx, width := range widths {
+			parts[idx] = strings.Repeat("─", width+2)
+		}
+		return left + strings.Join(parts, middle) + right
+	}
+
+	rendered := []string{rule("┌", "┬", "┐")}
+	for rowIdx, row := range rows {
+		parts := make([]string, len(widths))
+		for idx, width := range widths {
+			cell := ""
+			if idx < len(row) {
+				cell = row[idx]
+			}
+			parts[idx] = " " + cell + strings.Repeat(" ", width-utf8.RuneCountInString(cell)) + " "
+		}
+		rendered = append(rendered, "│"+strings.Join(parts, "│")+"│")
+		if rowIdx == 0 && header && len(rows) > 1 {
+			rendered = append(rendered, rule("├", "┼", "┤"))
+		}
+	}
+	return append(rendered, rule("└", "┴", "┘"))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		markdown string
+		want     string
+	}{
+		{"header rule", `Apple closed at:
+| Ticker | **Close** |
+|---|---:|
+| AAPL | 237.33 |
+Source: nasdaq`, `Apple closed at:
+┌────────┬────────┐
+│ Ticker │ Close  │
+├────────┼────────┤
+│ AAPL   │ 237.33 │
+└────────┴────────┘
+Source: nasdaq`},
+		{"no header rule", `| x | yy |
+| zzz | w |`, `┌─────┬────┐
+│ x   │ yy │
+│ zzz │ w  │
+└─────┴────┘`},
+		// short rows are padded and long rows widen the table
+		{"ragged rows", `| a | b |
+| --- | :-: |
+| 1 |
+| 2 | 3 | 4 |`, `┌───┬───┬───┐
+│ a │ b │   │
+├───┼───┼───┤
+│ 1 │   │   │
+│ 2 │ 3 │ 4 │
+└───┴───┴───┘`},
+		// widths count characters rather than bytes
+		{"multi-byte cells", `| Société | € |
+|-|-|
+| LVMH | 640 |`, `┌─────────┬─────┐
+│ Société │ €   │
+├─────────┼─────┤
+│ LVMH    │ 640 │
+└─────────┴─────┘`},
+		{"rule after the first row only", `| a |
+| b |
+|---|`, `┌───┐
+│ a │
+│ b │
+└───┘`},
+		{"no table", "close | 237.33\n|", "close | 237.33\n|"},
+	} {
+		if got := renderMarkdown(test.markdown); got != test.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRenderMarkdownSeparateTables(t *testing.T) {
+	got := renderMarkdown("| a |\n\n| bb |")
+	want := strings.Join([]string{"┌───┐", "│ a │", "└───┘", "", "┌────┐", "│ bb │", "└────┘"}, "\n")
+	if got != want {
+		t.Errorf("tables:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+
+	agentconfig "stock-agent/agent-config"
+	agentregistry "stock-agent/agent-registry"
+	datacombineagent "stock-agent/data-combine-agent"
+	databaseagent "stock-agent/database-agent"
+	agentassemble "stock-agent/gemini-agent-assemble"
+	loaddatabase "stock-agent/load-database"
+	quarterlyresultsagent "stock-agent/quarterly-results-agent"
+	stockMarketInfoApp "stock-agent/stock-market-info-app"
+)
+
+// agent services in start order, data layer agents register with the registry
+var agentServices = []struct {
+	name  string
+	init  func(ctx context.Context) (*agentassemble.Agent, error)
+	layer string
+}{
+	{"database", databaseagent.InitDatabaseAgent, agentregistry.DataLayer},
+	{"quarterlyResults", quarterlyresultsagent.InitQuarterlyResultsAgent, agentregistry.DataLayer},
+	{"dataCombine", datacombineagent.InitDataCombineAgent, ""},
+	{"stockMarketInfoApp", stockMarketInfoApp.InitStockMarketInfoAgent, ""},
+}
+
+// listen address of an agent from its env vars
+func agentAddress(name string) (string, string, error) {
+	prefix, _ := agentconfig.Prefix(name)
+	hostname, exists := os.LookupEnv(prefix + "_HOSTNAME")
+	if !exists {
+		return "", "", errors.New("missing " + prefix + "_HOSTNAME in .env")
+	}
+	port, exists := os.LookupEnv(prefix + "_PORT")
+	if !exists {
+		return "", "", errors.New("missing " + prefix + "_PORT in .env")
+	}
+	return hostname, port, nil
+}
+
+// run the registry service and agents until interrupted
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	selected := flags.String("agents", "", "comma separated services to run: registry, "+strings.Join(agentconfig.AgentNames(), ", ")+"\n(default the registry, unless AGENT_REGISTRY_FILE is set, and the enabled agents)")
+	load := flags.Bool("load", os.Getenv("LOAD_DB") == "true", "load the nasdaq database before starting, LOAD_DB by default")
+	mcpStdio := flags.String("mcp-stdio", os.Getenv("MCP_STDIO_AGENT"), "serve this agent as an mcp server over stdio, MCP_STDIO_AGENT by default")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usageError{errors.New("unexpected serve arguments: " + strings.Join(flags.Args(), " "))}
+	}
+
+	// pick the services
+	_, useRegistryFile := os.LookupEnv("AGENT_REGISTRY_FILE")
+	runRegistry := !useRegistryFile
+	run := func(name string) bool {
+		return agentconfig.Enabled(agentServicePrefix(name))
+	}
+	if *selected != "" {
+		names := strings.Split(*selected, ",")
+		for idx, name := range names {
+			names[idx] = strings.TrimSpace(name)
+			if _, known := agentconfig.Prefix(names[idx]); !known && names[idx] != "registry" {
+				return usageError{errors.New("unknown service: " + names[idx])}
+			}
+		}
+		runRegistry = slices.Contains(names, "registry")
+		run = func(name string) bool {
+			return slices.Contains(names, name)
+		}
+	}
+	if *mcpStdio != "" {
+		name := mcpAgentName(*mcpStdio)
+		if _, known := agentconfig.Prefix(name); !known {
+			return usageError{errors.New("unknown mcp stdio agent: " + *mcpStdio)}
+		}
+		if !run(name) {
+			return usageError{errors.New("mcp stdio agent " + *mcpStdio + " is not run in this process")}
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// load the database if requested
+	if *load {
+		err = loaddatabase.LoadNasdaqDatabase("nasdaq", loaddatabase.LoadOptions{})
+		if err != nil {
+			return err
+		}
+		// and the symbol metadata when there is a csv of it
+		if _, exists := os.LookupEnv("SYMBOLS_CSV"); exists {
+			err = loaddatabase.LoadSymbols("")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// run the agent registry service
+	if runRegistry {
+		registryHostname, exists := os.LookupEnv("AGENT_REGISTRY_HOSTNAME")
+		if !exists {
+			return errors.New("missing AGENT_REGISTRY_HOSTNAME in .env")
+		}
+		registryPort, exists := os.LookupEnv("AGENT_REGISTRY_PORT")
+		if !exists {
+			return errors.New("missing AGENT_REGISTRY_PORT in .env")
+		}
+		err = agentregistry.NewRegistry().RunRegistry(registryHostname, registryPort)
+		if err != nil {
+			return err
+		}
+	}
+
+	// initialize and run the agents as services
+	agents := map[string]*agentassemble.Agent{}
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+	for _, service := range agentServices {
+		if !run(service.name) {
+			continue
+		}
+		hostname, port, err := agentAddress(service.name)
+		if err != nil {
+			return err
+		}
+		agent, err := service.init(ctx)
+		if err != nil {
+			return errors.New("error initializing the " + service.name + " agent: " + err.Error())
+		}
+		agents[service.name] = agent
+		// the app also serves the lower layer agents of this process as chat completion models
+		if service.name == "stockMarketInfoApp" {
+			for _, name := range []string{"database", "quarterlyResults", "dataCombine"} {
+				if lower, exists := agents[name]; exists {
+					agent.AddChatModel(lower.Capabilities().Name, lower)
+				}
+			}
+		}
+		err = agent.RunAgent(hostname, port)
+		if err != nil {
+			return errors.New("error running the " + service.name + " agent: " + err.Error())
+		}
+		if service.layer != "" && !useRegistryFile {
+			err = agentregistry.RegisterAgent(service.layer, "http://"+hostname+":"+port, agent.Capabilities())
+			if err != nil {
+				return err
+			}
+			go agentregistry.KeepRegistered(ctx, service.layer, "http://"+hostname+":"+port, agent.Capabilities())
+		}
+	}
+
+	// serve one of the agents as an mcp server over stdio
+	if *mcpStdio != "" {
+		return agents[mcpAgentName(*mcpStdio)].ServeMCPStdio(ctx, os.Stdin, os.Stdout)
+	}
+
+	<-ctx.Done()
+	log.Println("shutting down")
+	return nil
+}
+
+func agentServicePrefix(name string) string {
+	prefix, _ := agentconfig.Prefix(name)
+	return prefix
+}
+
+// mcp stdio agents keep their original names
+func mcpAgentName(name string) string {
+	switch name {
+	case "quarterly-results":
+		return "quarterlyResults"
+	case "data-combine":
+		return "dataCombine"
+	case "stock-market-info-app":
+		return "stockMarketInfoApp"
+	default:
+		return name
+	}
+}
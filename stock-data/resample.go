@@ -0,0 +1,133 @@
+package stockdata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/////////
+// Resampling of the daily lines to longer bars
+/////////
+
+// bar period of a resample
+type Period string
+
+const (
+	Weekly    Period = "weekly"
+	Monthly   Period = "monthly"
+	Quarterly Period = "quarterly"
+	Yearly    Period = "yearly"
+)
+
+// parse a period name, case insensitive
+func ParsePeriod(text string) (Period, error) {
+	period := Period(strings.ToLower(strings.TrimSpace(text)))
+	switch period {
+	case Weekly, Monthly, Quarterly, Yearly:
+		return period, nil
+	}
+	return "", errors.New("invalid period \"" + text + "\", expected weekly, monthly, quarterly or yearly")
+}
+
+// an ohlc bar over the trading days of a period
+type Bar struct {
+	// label of the period, 2024-W05, 2024-11, 2024-Q1, 2024, or FY2025-Q1 and FY2025 for fiscal years
+	Period string
+	// first and last trading days of the bar, a bar at the edge of a range may not cover its whole period
+	Start  time.Time
+	End    time.Time
+	Open   float64
+	High   float64
+	Low    float64
+	Close  float64
+	Volume int64
+	Days   int
+}
+
+// json form with yyyy-mm-dd dates
+type barJSON struct {
+	Period string  `json:"period"`
+	Start  string  `json:"start"`
+	End    string  `json:"end"`
+	Open   float64 `json:"open"`
+	High   float64 `json:"high"`
+	Low    float64 `json:"low"`
+	Close  float64 `json:"close"`
+	Volume int64   `json:"volume,omitempty"`
+	Days   int     `json:"days"`
+}
+
+func (bar Bar) MarshalJSON() ([]byte, error) {
+	return json.Marshal(barJSON{
+		Period: bar.Period,
+		Start:  bar.Start.UTC().Format(DateLayout),
+		End:    bar.End.UTC().Format(DateLayout),
+		Open:   bar.Open,
+		High:   bar.High,
+		Low:    bar.Low,
+		Close:  bar.Close,
+		Volume: bar.Volume,
+		Days:   bar.Days,
+	})
+}
+
+// label of the period holding the date, quarters and years start in the yearStart month,
+// January for calendar periods, and a fiscal year is named after the calendar year it ends in
+// weeks are ISO weeks starting on Monday
+func PeriodLabel(date time.Time, period Period, yearStart time.Month) string {
+	date = date.UTC()
+	switch period {
+	case Weekly:
+		year, week := date.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case Monthly:
+		return date.Format("2006-01")
+	}
+	if yearStart < time.January || yearStart > time.December {
+		yearStart = time.January
+	}
+	// months into the year and the year the period ends in
+	months := (int(date.Month()) - int(yearStart) + 12) % 12
+	year := date.Year()
+	if yearStart != time.January && date.Month() >= yearStart {
+		year++
+	}
+	prefix := ""
+	if yearStart != time.January {
+		prefix = "FY"
+	}
+	if period == Quarterly {
+		return fmt.Sprintf("%s%d-Q%d", prefix, year, months/3+1)
+	}
+	return fmt.Sprintf("%s%d", prefix, year)
+}
+
+// aggregate daily lines in date order into bars with the first open, the highest high,
+// the lowest low, the last close and the summed volume
+func Resample(lines []TickerLine, period Period, yearStart time.Month) ([]Bar, error) {
+	period, err := ParsePeriod(string(period))
+	if err != nil {
+		return nil, err
+	}
+	bars := []Bar{}
+	for idx, line := range lines {
+		if idx > 0 && line.Date.Before(lines[idx-1].Date) {
+			return nil, errors.New("lines are not in date order at " + line.Date.UTC().Format(DateLayout))
+		}
+		label := PeriodLabel(line.Date, period, yearStart)
+		if len(bars) == 0 || bars[len(bars)-1].Period != label {
+			bars = append(bars, Bar{Period: label, Start: line.Date, Open: line.Open, High: line.High, Low: line.Low})
+		}
+		bar := &bars[len(bars)-1]
+		bar.End = line.Date
+		bar.High = max(bar.High, line.High)
+		bar.Low = min(bar.Low, line.Low)
+		bar.Close = line.Close
+		bar.Volume += line.Volume
+		bar.Days++
+	}
+	return bars, nil
+}
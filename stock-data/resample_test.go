@@ -0,0 +1,163 @@
+package stockdata
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// a utc date at midnight
+func day(year int, month time.Month, date int) time.Time {
+	return time.Date(year, month, date, 0, 0, 0, 0, time.UTC)
+}
+
+func TestPeriodLabelCalendar(t *testing.T) {
+	for _, test := range []struct {
+		date   time.Time
+		period Period
+		want   string
+	}{
+		{day(2024, time.January, 1), Monthly, "2024-01"},
+		{day(2024, time.November, 29), Monthly, "2024-11"},
+		{day(2024, time.January, 1), Quarterly, "2024-Q1"},
+		{day(2024, time.March, 31), Quarterly, "2024-Q1"},
+		{day(2024, time.April, 1), Quarterly, "2024-Q2"},
+		{day(2024, time.September, 30), Quarterly, "2024-Q3"},
+		{day(2024, time.December, 31), Quarterly, "2024-Q4"},
+		{day(2024, time.January, 1), Yearly, "2024"},
+		{day(2024, time.December, 31), Yearly, "2024"},
+		// a date in another zone is labelled by its utc day
+		{time.Date(2024, time.December, 31, 20, 0, 0, 0, time.FixedZone("EST", -5*3600)), Yearly, "2025"},
+	} {
+		if got := PeriodLabel(test.date, test.period, time.January); got != test.want {
+			t.Errorf("PeriodLabel(%s, %s) = %s, want %s", test.date.Format(time.RFC3339), test.period, got, test.want)
+		}
+	}
+}
+
+func TestPeriodLabelFiscal(t *testing.T) {
+	// fiscal years starting in October are named after the calendar year they end in
+	for _, test := range []struct {
+		date   time.Time
+		period Period
+		want   string
+	}{
+		{day(2024, time.September, 30), Quarterly, "FY2024-Q4"},
+		{day(2024, time.October, 1), Quarterly, "FY2025-Q1"},
+		{day(2024, time.December, 31), Quarterly, "FY2025-Q1"},
+		{day(2025, time.January, 1), Quarterly, "FY2025-Q2"},
+		{day(2025, time.April, 1), Quarterly, "FY2025-Q3"},
+		{day(2025, time.July, 1), Quarterly, "FY2025-Q4"},
+		{day(2024, time.September, 30), Yearly, "FY2024"},
+		{day(2024, time.October, 1), Yearly, "FY2025"},
+		{day(2025, time.September, 30), Yearly, "FY2025"},
+		// months are not fiscal
+		{day(2024, time.October, 1), Monthly, "2024-10"},
+	} {
+		if got := PeriodLabel(test.date, test.period, time.October); got != test.want {
+			t.Errorf("PeriodLabel(%s, %s, October) = %s, want %s", test.date.Format(DateLayout), test.period, got, test.want)
+		}
+	}
+	// an invalid start month falls back to calendar periods
+	if got := PeriodLabel(day(2024, time.October, 1), Quarterly, 13); got != "2024-Q4" {
+		t.Errorf("PeriodLabel with month 13 = %s, want 2024-Q4", got)
+	}
+}
+
+func TestPeriodLabelISOWeeks(t *testing.T) {
+	for _, test := range []struct {
+		date time.Time
+		want string
+	}{
+		{day(2024, time.January, 1), "2024-W01"},
+		{day(2024, time.November, 4), "2024-W45"},
+		// the week of a monday late in december is the first of the next year
+		{day(2024, time.December, 29), "2024-W52"},
+		{day(2024, time.December, 30), "2025-W01"},
+		{day(2025, time.January, 5), "2025-W01"},
+		// and early january days can be in the last week of the year before
+		{day(2021, time.January, 3), "2020-W53"},
+		{day(2021, time.January, 4), "2021-W01"},
+	} {
+		if got := PeriodLabel(test.date, Weekly, time.January); got != test.want {
+			t.Errorf("PeriodLabel(%s, weekly) = %s, want %s", test.date.Format(DateLayout), got, test.want)
+		}
+	}
+}
+
+func TestResample(t *testing.T) {
+	lines := []TickerLine{
+		{Date: day(2024, time.December, 26), Open: 10, High: 12, Low: 9, Close: 11, Volume: 100},
+		{Date: day(2024, time.December, 27), Open: 11, High: 15, Low: 10, Close: 14, Volume: 200},
+		{Date: day(2024, time.December, 30), Open: 14, High: 14, Low: 8, Close: 9, Volume: 300},
+		{Date: day(2024, time.December, 31), Open: 9, High: 10, Low: 7, Close: 10, Volume: 400},
+		{Date: day(2025, time.January, 2), Open: 10, High: 16, Low: 10, Close: 15, Volume: 500},
+	}
+
+	weekly, err := Resample(lines, Weekly, time.January)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Bar{
+		{Period: "2024-W52", Start: lines[0].Date, End: lines[1].Date, Open: 10, High: 15, Low: 9, Close: 14, Volume: 300, Days: 2},
+		{Period: "2025-W01", Start: lines[2].Date, End: lines[4].Date, Open: 14, High: 16, Low: 7, Close: 15, Volume: 1200, Days: 3},
+	}
+	if !reflect.DeepEqual(weekly, want) {
+		t.Errorf("weekly bars = %+v, want %+v", weekly, want)
+	}
+
+	yearly, err := Resample(lines, "Yearly", time.January)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []Bar{
+		{Period: "2024", Start: lines[0].Date, End: lines[3].Date, Open: 10, High: 15, Low: 7, Close: 10, Volume: 1000, Days: 4},
+		{Period: "2025", Start: lines[4].Date, End: lines[4].Date, Open: 10, High: 16, Low: 10, Close: 15, Volume: 500, Days: 1},
+	}
+	if !reflect.DeepEqual(yearly, want) {
+		t.Errorf("yearly bars = %+v, want %+v", yearly, want)
+	}
+}
+
+func TestResampleFiscalQuarters(t *testing.T) {
+	lines := []TickerLine{
+		{Date: day(2024, time.December, 31), Open: 1, High: 2, Low: 1, Close: 2, Volume: 10},
+		{Date: day(2025, time.January, 2), Open: 2, High: 3, Low: 2, Close: 3, Volume: 20},
+	}
+	bars, err := Resample(lines, Quarterly, time.October)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bars) != 2 || bars[0].Period != "FY2025-Q1" || bars[1].Period != "FY2025-Q2" {
+		t.Errorf("fiscal quarter bars = %+v, want FY2025-Q1 and FY2025-Q2", bars)
+	}
+}
+
+func TestResampleErrors(t *testing.T) {
+	lines := []TickerLine{
+		{Date: day(2024, time.November, 5), Open: 1, High: 1, Low: 1, Close: 1},
+		{Date: day(2024, time.November, 4), Open: 1, High: 1, Low: 1, Close: 1},
+	}
+	if _, err := Resample(lines, Monthly, time.January); err == nil {
+		t.Error("Resample accepted lines out of date order")
+	}
+	if _, err := Resample(lines[:1], "daily", time.January); err == nil {
+		t.Error("Resample accepted an unknown period")
+	}
+	bars, err := Resample(nil, Monthly, time.January)
+	if err != nil || len(bars) != 0 {
+		t.Errorf("Resample(nil) = %v, %v, want no bars", bars, err)
+	}
+}
+
+func TestBarJSON(t *testing.T) {
+	bar := Bar{Period: "2024-11", Start: day(2024, time.November, 1), End: day(2024, time.November, 29), Open: 1.5, High: 2, Low: 1, Close: 1.75, Volume: 10, Days: 20}
+	dat, err := bar.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"period":"2024-11","start":"2024-11-01","end":"2024-11-29","open":1.5,"high":2,"low":1,"close":1.75,"volume":10,"days":20}`
+	if string(dat) != want {
+		t.Errorf("bar json = %s, want %s", dat, want)
+	}
+}
@@ -0,0 +1,147 @@
+package stockdata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/////////
+// Daily price schema of the nasdaq ticker collections
+/////////
+
+// date layout of the csv files, the tool args and the json
+const DateLayout = "2006-01-02"
+
+// a trading day of a ticker collection, the date is a bson date at midnight utc
+type TickerLine struct {
+	Date   time.Time `bson:"date" json:"date"`
+	Open   float64   `bson:"open" json:"open"`
+	High   float64   `bson:"high" json:"high"`
+	Low    float64   `bson:"low" json:"low"`
+	Close  float64   `bson:"close" json:"close"`
+	Volume int64     `bson:"volume,omitempty" json:"volume,omitempty"`
+}
+
+// price fields of a ticker line
+var PriceFields = []string{"open", "high", "low", "close"}
+
+// json form with yyyy-mm-dd dates
+type tickerLineJSON struct {
+	Date   string  `json:"date"`
+	Open   float64 `json:"open"`
+	High   float64 `json:"high"`
+	Low    float64 `json:"low"`
+	Close  float64 `json:"close"`
+	Volume int64   `json:"volume,omitempty"`
+}
+
+func (line TickerLine) MarshalJSON() ([]byte, error) {
+	return json.Marshal(tickerLineJSON{
+		Date:   line.Date.UTC().Format(DateLayout),
+		Open:   line.Open,
+		High:   line.High,
+		Low:    line.Low,
+		Close:  line.Close,
+		Volume: line.Volume,
+	})
+}
+
+func (line *TickerLine) UnmarshalJSON(lineDat []byte) error {
+	var decoded tickerLineJSON
+	err := json.Unmarshal(lineDat, &decoded)
+	if err != nil {
+		return err
+	}
+	date, err := ParseDate(decoded.Date)
+	if err != nil {
+		return err
+	}
+	*line = TickerLine{Date: date, Open: decoded.Open, High: decoded.High, Low: decoded.Low, Close: decoded.Close, Volume: decoded.Volume}
+	return nil
+}
+
+// value of a field by name, open, high, low, close or volume
+func (line TickerLine) Value(field string) (float64, error) {
+	switch field {
+	case "open":
+		return line.Open, nil
+	case "high":
+		return line.High, nil
+	case "low":
+		return line.Low, nil
+	case "close":
+		return line.Close, nil
+	case "volume":
+		return float64(line.Volume), nil
+	default:
+		return 0, errors.New("unknown field " + field + ", expected open, high, low, close or volume")
+	}
+}
+
+// parse a yyyy-mm-dd date, a trailing time as in 2024-11-01 00:00:00 is ignored
+func ParseDate(text string) (time.Time, error) {
+	text = strings.TrimSpace(text)
+	if len(text) > len(DateLayout) && (text[len(DateLayout)] == ' ' || text[len(DateLayout)] == 'T') {
+		text = text[:len(DateLayout)]
+	}
+	date, err := time.Parse(DateLayout, text)
+	if err != nil {
+		return time.Time{}, errors.New("invalid date \"" + text + "\", expected yyyy-mm-dd")
+	}
+	return date, nil
+}
+
+// filter on the date field from yyyy-mm-dd dates, an empty date leaves that end open
+func DateFilter(startDate string, endDate string) (bson.D, error) {
+	dateRange := bson.D{}
+	if startDate != "" {
+		start, err := ParseDate(startDate)
+		if err != nil {
+			return nil, err
+		}
+		dateRange = append(dateRange, bson.E{Key: "$gte", Value: start})
+	}
+	if endDate != "" {
+		end, err := ParseDate(endDate)
+		if err != nil {
+			return nil, err
+		}
+		dateRange = append(dateRange, bson.E{Key: "$lte", Value: end})
+	}
+	if len(dateRange) == 0 {
+		return bson.D{}, nil
+	}
+	return bson.D{{Key: "date", Value: dateRange}}, nil
+}
+
+// the lines of a ticker over a date range in date order
+func FindLines(ctx context.Context, coll *mongo.Collection, startDate string, endDate string) ([]TickerLine, error) {
+	filter, err := DateFilter(startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "date", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var lines []TickerLine
+	err = cursor.All(ctx, &lines)
+	if err != nil {
+		// collections loaded before the typed schema hold strings
+		return nil, errors.New(err.Error() + ", the " + coll.Name() + " collection may need migrating with stock-agent migrate")
+	}
+	return lines, nil
+}
+
+// index the date of a ticker collection for the range queries
+func EnsureIndexes(ctx context.Context, coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "date", Value: 1}}})
+	return err
+}
@@ -1,13 +1,9 @@
 package stockmarketinfoapp
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
-	"io"
 	"log"
-	"net/http"
 	"os"
 
 	datacombineagent "stock-agent/data-combine-agent"
@@ -17,7 +13,7 @@ import (
 )
 
 /////////////////
-// data combine agent
+// stock market info app
 
 // client agent tools descriptions from the agents
 var stockMarketInfoTools = &genai.Tool{
@@ -41,12 +37,24 @@ When you know the final answer, you must start the response with the words 'Fina
 `
 	// initialize the agent
 	var tools = []*genai.Tool{stockMarketInfoTools}
-	agentStockMarketInfo, err := agentassemble.InitAgent(ctx, &system, tools, callStockMarketInfoTool)
+	agentStockMarketInfo, err := agentassemble.InitAgent(ctx, &system, tools, callStockMarketInfoTool, agentassemble.WithEnvSettings("STOCK_MARKET_INFO_APP"))
 	if err != nil {
 		log.Println("Error initializing the database agent")
 		return nil, err
 	}
 
+	// publish what the agent can do
+	agentStockMarketInfo.SetCapabilities(agentassemble.Capabilities{
+		Name:        "stockMarketInfoApp",
+		Description: "Make a request to the stock market info app. The app will process natural language requests for nasdaq stock market data and company quarterly results and return the result.",
+		Examples: []string{
+			"Get Apple's close price for all of November 2024, summarize the same years Q4 results and then generate a table for all quarters of 2024 financial results",
+		},
+	})
+
+	// replies from the data combine agent are free text from outside the app
+	agentStockMarketInfo.SetToolPolicy(stockMarketInfoTools.FunctionDeclarations[0].Name, agentassemble.ToolPolicy{Untrusted: true})
+
 	// always start a new session
 	agentStockMarketInfo.NewSession()
 
@@ -54,7 +62,7 @@ When you know the final answer, you must start the response with the words 'Fina
 }
 
 // tool call handler
-func callStockMarketInfoTool(funcall genai.FunctionCall) (string, error) {
+func callStockMarketInfoTool(ctx context.Context, funcall genai.FunctionCall) (string, error) {
 	result := ""
 	var err error
 	// find the function to call - all tool calls come here
@@ -66,9 +74,8 @@ func callStockMarketInfoTool(funcall genai.FunctionCall) (string, error) {
 			log.Println(err)
 			return err.Error(), err
 		}
-		// call the query database tool
-		datacombineagent.CallDataCombineAgent(message.(string))
-		result, err = datacombineagent.CallDataCombineAgent(message.(string))
+		// call the data combine agent
+		result, err = datacombineagent.CallDataCombineAgent(ctx, message.(string))
 		if err != nil {
 			log.Println("CallDataCombineAgent():", err)
 			return err.Error(), err
@@ -103,7 +110,7 @@ var CallStockMarketInfoAppTool = &genai.Tool{
 }
 
 // client tool for the stock market app agent
-func CallStockMarketInfoApp(message string) (string, error) {
+func CallStockMarketInfoApp(ctx context.Context, message string) (string, error) {
 	log.Println("running CallStockMarketInfoApp tool for :" + message)
 
 	// get the agent endpoint
@@ -120,40 +127,6 @@ func CallStockMarketInfoApp(message string) (string, error) {
 		return "", err
 	}
 
-	// build the payload
-	request := agentassemble.Request{
-		Input: message,
-	}
-	reqDat, err := json.Marshal(request)
-	if err != nil {
-		return "", err
-	}
-
-	// repare the request
-	req, err := http.NewRequest("POST", "http://"+hostname+":"+port+"/agent", bytes.NewBuffer(reqDat))
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	// send the post
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	// extract and decode the reply
-	response := agentassemble.Response{}
-	respDat, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	err = json.Unmarshal(respDat, &response)
-	if err != nil {
-		return "", err
-	}
-
-	return response.Content, nil
+	// send the request with the configured transport
+	return agentassemble.CallAgentEndpoint(ctx, "http://"+hostname+":"+port, message)
 }
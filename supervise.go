@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	agentconfig "stock-agent/agent-config"
+	agentregistry "stock-agent/agent-registry"
+	loaddatabase "stock-agent/load-database"
+)
+
+/////////
+// Supervisor for agent processes
+/////////
+
+// supervisor timings
+const (
+	restartBackoff    = time.Second
+	maxRestartBackoff = 30 * time.Second
+	// a process running this long is healthy again and its restart count is reset
+	stableRunTime       = time.Minute
+	healthInterval      = 10 * time.Second
+	maxHealthFailures   = 3
+	stopTimeout         = 10 * time.Second
+	readinessPollPeriod = 250 * time.Millisecond
+)
+
+// a service run as a child process
+type process struct {
+	name     string
+	endpoint string
+	// services that must be ready before this one starts
+	dependsOn []string
+	// registers with the registry, so restarts with it
+	registers bool
+
+	// state guarded by the supervisor mutex
+	cmd     *exec.Cmd
+	ready   bool
+	restart bool
+	stopped chan struct{}
+}
+
+// launches the services in dependency order and keeps them running
+type supervisor struct {
+	mu           sync.Mutex
+	processes    map[string]*process
+	executable   string
+	logLevel     string
+	readyTimeout time.Duration
+	maxRestarts  int
+	// serializes the child output lines
+	outMu sync.Mutex
+}
+
+// run each service in its own process, restarting them when they exit or stop answering
+func runSupervise(args []string) error {
+	flags := flag.NewFlagSet("supervise", flag.ContinueOnError)
+	selected := flags.String("agents", "", "comma separated services to run: registry, "+strings.Join(agentconfig.AgentNames(), ", ")+"\n(default the registry, unless AGENT_REGISTRY_FILE is set, and the enabled agents)")
+	load := flags.Bool("load", os.Getenv("LOAD_DB") == "true", "load the nasdaq database before starting, LOAD_DB by default")
+	readyTimeout := flags.Duration("ready-timeout", 2*time.Minute, "time for a service to answer /running after it starts")
+	maxRestarts := flags.Int("max-restarts", 5, "restarts of a failing service before giving up, 0 for no limit")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usageError{errors.New("unexpected supervise arguments: " + strings.Join(flags.Args(), " "))}
+	}
+
+	// pick the services
+	_, useRegistryFile := os.LookupEnv("AGENT_REGISTRY_FILE")
+	names := []string{}
+	if !useRegistryFile {
+		names = append(names, "registry")
+	}
+	for _, service := range agentServices {
+		if agentconfig.Enabled(agentServicePrefix(service.name)) {
+			names = append(names, service.name)
+		}
+	}
+	if *selected != "" {
+		names = strings.Split(*selected, ",")
+		for idx, name := range names {
+			names[idx] = strings.TrimSpace(name)
+			if _, known := agentconfig.Prefix(names[idx]); !known && names[idx] != "registry" {
+				return usageError{errors.New("unknown service: " + names[idx])}
+			}
+		}
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	supervisor := &supervisor{
+		processes:    map[string]*process{},
+		executable:   executable,
+		logLevel:     logLevel,
+		readyTimeout: *readyTimeout,
+		maxRestarts:  *maxRestarts,
+	}
+	err = supervisor.plan(names)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// load the database once, before the agents start
+	if *load {
+		err = loaddatabase.LoadNasdaqDatabase("nasdaq", loaddatabase.LoadOptions{})
+		if err != nil {
+			return err
+		}
+		// and the symbol metadata when there is a csv of it
+		if _, exists := os.LookupEnv("SYMBOLS_CSV"); exists {
+			err = loaddatabase.LoadSymbols("")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return supervisor.run(ctx)
+}
+
+// build the processes and their dependencies, failing on unknown addresses and cycles
+func (supervisor *supervisor) plan(names []string) error {
+	for _, name := range names {
+		proc := &process{name: name, stopped: make(chan struct{})}
+		if name == "registry" {
+			hostname, exists := os.LookupEnv("AGENT_REGISTRY_HOSTNAME")
+			if !exists {
+				return errors.New("missing AGENT_REGISTRY_HOSTNAME in .env")
+			}
+			port, exists := os.LookupEnv("AGENT_REGISTRY_PORT")
+			if !exists {
+				return errors.New("missing AGENT_REGISTRY_PORT in .env")
+			}
+			proc.endpoint = "http://" + hostname + ":" + port
+		} else {
+			hostname, port, err := agentAddress(name)
+			if err != nil {
+				return err
+			}
+			proc.endpoint = "http://" + hostname + ":" + port
+		}
+		supervisor.processes[name] = proc
+	}
+
+	for _, service := range agentServices {
+		proc, exists := supervisor.processes[service.name]
+		if !exists {
+			continue
+		}
+		// data layer agents register at startup and the data combine agent looks them up
+		if _, exists := supervisor.processes["registry"]; exists {
+			proc.registers = service.layer == agentregistry.DataLayer
+			if proc.registers || service.name == "dataCombine" {
+				proc.dependsOn = append(proc.dependsOn, "registry")
+			}
+		}
+		// downstream agents run elsewhere when they are not supervised here
+		for _, downstream := range agentconfig.Downstream(service.name) {
+			if _, supervised := supervisor.processes[downstream]; supervised {
+				proc.dependsOn = append(proc.dependsOn, downstream)
+			}
+		}
+	}
+
+	// walk the dependencies to reject cycles
+	visiting := map[string]bool{}
+	done := map[string]bool{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		if done[name] {
+			return nil
+		}
+		if visiting[name] {
+			return errors.New("downstream agents form a cycle: " + strings.Join(append(path, name), " -> "))
+		}
+		visiting[name] = true
+		for _, dependency := range supervisor.processes[name].dependsOn {
+			err := visit(dependency, append(path, name))
+			if err != nil {
+				return err
+			}
+		}
+		done[name] = true
+		return nil
+	}
+	for name := range supervisor.processes {
+		err := visit(name, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// supervise every process until interrupted, or until a process fails too often
+func (supervisor *supervisor) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	failures := make(chan error, len(supervisor.processes))
+	var wait sync.WaitGroup
+	for _, proc := range supervisor.processes {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			err := supervisor.supervise(ctx, proc)
+			if err != nil {
+				failures <- err
+				cancel()
+			}
+		}()
+	}
+	wait.Wait()
+
+	select {
+	case err := <-failures:
+		return err
+	default:
+		log.Println("supervisor stopped")
+		return nil
+	}
+}
+
+// start, watch and restart a process, stopping it after the processes that depend on it when done
+func (supervisor *supervisor) supervise(ctx context.Context, proc *process) error {
+	defer close(proc.stopped)
+
+	restarts := 0
+	backoff := restartBackoff
+	for starts := 0; ; starts++ {
+		// downstream services first
+		if !supervisor.waitDependencies(ctx, proc) {
+			return nil
+		}
+
+		started := time.Now()
+		exited, err := supervisor.start(proc)
+		if err != nil {
+			log.Println(proc.name + ": " + err.Error())
+		} else {
+			log.Println(proc.name + ": started, pid " + strconv.Itoa(proc.cmd.Process.Pid))
+			err = supervisor.watch(ctx, proc, exited, starts > 0)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		supervisor.mu.Lock()
+		requested := proc.restart
+		proc.restart = false
+		supervisor.mu.Unlock()
+		if requested {
+			log.Println(proc.name + ": restarting with the registry")
+			continue
+		}
+
+		// back off on repeated failures
+		if time.Since(started) > stableRunTime {
+			restarts = 0
+			backoff = restartBackoff
+		}
+		restarts++
+		if supervisor.maxRestarts > 0 && restarts > supervisor.maxRestarts {
+			return errors.New(proc.name + " failed " + strconv.Itoa(restarts) + " times, last error: " + err.Error())
+		}
+		log.Println(proc.name + ": " + err.Error() + ", restarting in " + backoff.String())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxRestartBackoff)
+	}
+}
+
+// wait until the dependencies of the process are ready, false when the supervisor stops
+func (supervisor *supervisor) waitDependencies(ctx context.Context, proc *process) bool {
+	logged := false
+	for {
+		var waiting []string
+		supervisor.mu.Lock()
+		for _, dependency := range proc.dependsOn {
+			if !supervisor.processes[dependency].ready {
+				waiting = append(waiting, dependency)
+			}
+		}
+		supervisor.mu.Unlock()
+		if len(waiting) == 0 {
+			return true
+		}
+		if !logged {
+			log.Println(proc.name + ": waiting for " + strings.Join(waiting, ", "))
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(readinessPollPeriod):
+		}
+	}
+}
+
+// start the process as a serve of its single service, returning the channel of its exit
+func (supervisor *supervisor) start(proc *process) (chan error, error) {
+	// the supervisor loads the database and owns stdio, so the children must not
+	cmd := exec.Command(supervisor.executable, "-log-level", supervisor.logLevel, "serve", "-agents", proc.name, "-load=false", "-mcp-stdio=")
+	output := &prefixWriter{prefix: proc.name + " | ", out: os.Stderr, mu: &supervisor.outMu}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	supervisor.mu.Lock()
+	proc.cmd = cmd
+	supervisor.mu.Unlock()
+
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		if err == nil {
+			err = errors.New("exited")
+		}
+		exited <- err
+	}()
+	return exited, nil
+}
+
+// follow the process until it exits, fails its health checks or the supervisor stops
+func (supervisor *supervisor) watch(ctx context.Context, proc *process, exited chan error, restarted bool) error {
+	defer func() {
+		supervisor.mu.Lock()
+		proc.ready = false
+		supervisor.mu.Unlock()
+	}()
+
+	// readiness
+	deadline := time.After(supervisor.readyTimeout)
+	for !checkRunning(ctx, proc.endpoint) {
+		select {
+		case <-ctx.Done():
+			return supervisor.stop(ctx, proc, exited)
+		case err := <-exited:
+			return err
+		case <-deadline:
+			supervisor.stop(ctx, proc, exited)
+			return errors.New("not ready after " + supervisor.readyTimeout.String())
+		case <-time.After(readinessPollPeriod):
+		}
+	}
+	supervisor.mu.Lock()
+	proc.ready = true
+	supervisor.mu.Unlock()
+	log.Println(proc.name + ": ready at " + proc.endpoint)
+
+	// a restarted registry has lost its registrations
+	if proc.name == "registry" && restarted {
+		supervisor.restartRegistered()
+	}
+
+	// liveness
+	failures := 0
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return supervisor.stop(ctx, proc, exited)
+		case err := <-exited:
+			return err
+		case <-ticker.C:
+			if checkRunning(ctx, proc.endpoint) {
+				failures = 0
+				continue
+			}
+			failures++
+			log.Println(proc.name + ": health check failed")
+			if failures >= maxHealthFailures {
+				supervisor.stop(ctx, proc, exited)
+				return errors.New("failed " + strconv.Itoa(failures) + " health checks")
+			}
+		}
+	}
+}
+
+// restart the agents that register with the registry
+func (supervisor *supervisor) restartRegistered() {
+	supervisor.mu.Lock()
+	defer supervisor.mu.Unlock()
+	for _, other := range supervisor.processes {
+		if other.registers && other.ready {
+			other.restart = true
+			other.cmd.Process.Signal(syscall.SIGTERM)
+		}
+	}
+}
+
+// stop the process, after the processes depending on it when the supervisor is stopping
+func (supervisor *supervisor) stop(ctx context.Context, proc *process, exited chan error) error {
+	for _, other := range supervisor.processes {
+		if ctx.Err() != nil && slices.Contains(other.dependsOn, proc.name) {
+			<-other.stopped
+		}
+	}
+	proc.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case err := <-exited:
+		return err
+	case <-time.After(stopTimeout):
+		log.Println(proc.name + ": not stopped after " + stopTimeout.String() + ", killing")
+		proc.cmd.Process.Kill()
+		return <-exited
+	}
+}
+
+// the registry and the agents answer GET /running when serving
+func checkRunning(ctx context.Context, endpoint string) bool {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"/running", nil)
+	if err != nil {
+		return false
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode == http.StatusOK
+}
+
+// writes the whole output lines of a child process with its name in front
+type prefixWriter struct {
+	prefix  string
+	out     io.Writer
+	mu      *sync.Mutex
+	partial []byte
+}
+
+func (writer *prefixWriter) Write(dat []byte) (int, error) {
+	writer.partial = append(writer.partial, dat...)
+	for {
+		idx := bytes.IndexByte(writer.partial, '\n')
+		if idx < 0 {
+			return len(dat), nil
+		}
+		writer.mu.Lock()
+		writer.out.Write(append([]byte(writer.prefix), writer.partial[:idx+1]...))
+		writer.mu.Unlock()
+		writer.partial = writer.partial[idx+1:]
+	}
+}
@@ -0,0 +1,193 @@
+package technicalindicators
+
+import (
+	"math"
+)
+
+/////////
+// Technical indicators over daily price series
+/////////
+
+// each indicator returns a value per input day, NaN until the window has filled
+
+// trading days in a year, for the annualised volatility
+const TradingDays = 252
+
+// a series of NaN
+func undefined(length int) []float64 {
+	series := make([]float64, length)
+	for idx := range series {
+		series[idx] = math.NaN()
+	}
+	return series
+}
+
+// simple moving average of the window
+func SMA(values []float64, window int) []float64 {
+	sma := undefined(len(values))
+	if window <= 0 {
+		return sma
+	}
+	sum := 0.0
+	for idx, value := range values {
+		sum += value
+		if idx >= window {
+			sum -= values[idx-window]
+		}
+		if idx >= window-1 {
+			sma[idx] = sum / float64(window)
+		}
+	}
+	return sma
+}
+
+// exponential moving average with a smoothing of 2 / (window + 1),
+// seeded with the simple average of the first window values
+// NaN values at the start of the input, as from another indicator, are skipped
+func EMA(values []float64, window int) []float64 {
+	ema := undefined(len(values))
+	if window <= 0 {
+		return ema
+	}
+	start := 0
+	for start < len(values) && math.IsNaN(values[start]) {
+		start++
+	}
+	if len(values)-start < window {
+		return ema
+	}
+	sum := 0.0
+	for _, value := range values[start : start+window] {
+		sum += value
+	}
+	seed := start + window - 1
+	ema[seed] = sum / float64(window)
+	alpha := 2 / float64(window+1)
+	for idx := seed + 1; idx < len(values); idx++ {
+		ema[idx] = alpha*values[idx] + (1-alpha)*ema[idx-1]
+	}
+	return ema
+}
+
+// relative strength index with Wilder's smoothing of the average gain and loss
+func RSI(values []float64, window int) []float64 {
+	rsi := undefined(len(values))
+	if window <= 0 || len(values) <= window {
+		return rsi
+	}
+	gain, loss := 0.0, 0.0
+	for idx := 1; idx <= window; idx++ {
+		change := values[idx] - values[idx-1]
+		if change > 0 {
+			gain += change
+		} else {
+			loss -= change
+		}
+	}
+	gain /= float64(window)
+	loss /= float64(window)
+	rsi[window] = rsiValue(gain, loss)
+	for idx := window + 1; idx < len(values); idx++ {
+		change := values[idx] - values[idx-1]
+		gain = (gain*float64(window-1) + math.Max(change, 0)) / float64(window)
+		loss = (loss*float64(window-1) + math.Max(-change, 0)) / float64(window)
+		rsi[idx] = rsiValue(gain, loss)
+	}
+	return rsi
+}
+
+func rsiValue(gain float64, loss float64) float64 {
+	if loss == 0 {
+		return 100
+	}
+	return 100 - 100/(1+gain/loss)
+}
+
+// moving average convergence divergence, the fast minus the slow ema, its signal ema
+// and the histogram of the difference between them
+func MACD(values []float64, fast int, slow int, signal int) (macd []float64, signalLine []float64, histogram []float64) {
+	fastEMA := EMA(values, fast)
+	slowEMA := EMA(values, slow)
+	macd = make([]float64, len(values))
+	for idx := range values {
+		macd[idx] = fastEMA[idx] - slowEMA[idx]
+	}
+	signalLine = EMA(macd, signal)
+	histogram = make([]float64, len(values))
+	for idx := range values {
+		histogram[idx] = macd[idx] - signalLine[idx]
+	}
+	return macd, signalLine, histogram
+}
+
+// bollinger bands, the simple moving average and the bands the given number of
+// population standard deviations above and below it
+func Bollinger(values []float64, window int, deviations float64) (middle []float64, upper []float64, lower []float64) {
+	middle = SMA(values, window)
+	upper = undefined(len(values))
+	lower = undefined(len(values))
+	for idx := range values {
+		if math.IsNaN(middle[idx]) {
+			continue
+		}
+		variance := 0.0
+		for _, value := range values[idx-window+1 : idx+1] {
+			variance += (value - middle[idx]) * (value - middle[idx])
+		}
+		deviation := math.Sqrt(variance / float64(window))
+		upper[idx] = middle[idx] + deviations*deviation
+		lower[idx] = middle[idx] - deviations*deviation
+	}
+	return middle, upper, lower
+}
+
+// average true range with Wilder's smoothing, the first day's true range is its high - low
+func ATR(high []float64, low []float64, close []float64, window int) []float64 {
+	atr := undefined(len(close))
+	if window <= 0 || len(close) < window || len(high) != len(close) || len(low) != len(close) {
+		return atr
+	}
+	trueRange := make([]float64, len(close))
+	for idx := range close {
+		trueRange[idx] = high[idx] - low[idx]
+		if idx > 0 {
+			trueRange[idx] = math.Max(trueRange[idx], math.Max(math.Abs(high[idx]-close[idx-1]), math.Abs(low[idx]-close[idx-1])))
+		}
+	}
+	sum := 0.0
+	for _, value := range trueRange[:window] {
+		sum += value
+	}
+	atr[window-1] = sum / float64(window)
+	for idx := window; idx < len(close); idx++ {
+		atr[idx] = (atr[idx-1]*float64(window-1) + trueRange[idx]) / float64(window)
+	}
+	return atr
+}
+
+// annualised rolling volatility, the sample standard deviation of the window's daily
+// log returns scaled by the square root of the trading days in a year
+func Volatility(values []float64, window int) []float64 {
+	volatility := undefined(len(values))
+	if window < 2 {
+		return volatility
+	}
+	returns := make([]float64, len(values))
+	for idx := 1; idx < len(values); idx++ {
+		returns[idx] = math.Log(values[idx] / values[idx-1])
+	}
+	for idx := window; idx < len(values); idx++ {
+		period := returns[idx-window+1 : idx+1]
+		mean := 0.0
+		for _, value := range period {
+			mean += value
+		}
+		mean /= float64(window)
+		variance := 0.0
+		for _, value := range period {
+			variance += (value - mean) * (value - mean)
+		}
+		volatility[idx] = math.Sqrt(variance/float64(window-1)) * math.Sqrt(TradingDays)
+	}
+	return volatility
+}
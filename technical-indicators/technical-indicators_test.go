@@ -0,0 +1,124 @@
+package technicalindicators
+
+import (
+	"math"
+	"testing"
+)
+
+// reference closes of the StockCharts ChartSchool EMA example
+var emaCloses = []float64{
+	22.27, 22.19, 22.08, 22.17, 22.18, 22.13, 22.23, 22.43, 22.24, 22.29,
+	22.15, 22.39, 22.38, 22.61, 23.36, 24.05, 23.75, 23.83, 23.95, 23.63,
+	23.82, 23.87, 23.65, 23.19, 23.10, 23.33, 22.68, 23.10, 22.40, 22.17,
+}
+
+// reference closes of the StockCharts ChartSchool RSI example
+var rsiCloses = []float64{
+	44.34, 44.09, 44.15, 43.61, 44.33, 44.83, 45.10, 45.42, 45.84, 46.08,
+	45.89, 46.03, 45.61, 46.28, 46.28, 46.00, 46.03, 46.41, 46.22, 45.64,
+	46.21, 46.25, 45.71, 46.45, 45.78, 45.35, 44.03, 44.18, 44.22, 44.57,
+	43.42, 42.66, 43.13,
+}
+
+// check a series against the expected values, NaN where the series is undefined
+func checkSeries(t *testing.T, name string, got []float64, want []float64, tolerance float64) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d values, want %d", name, len(got), len(want))
+	}
+	for idx := range want {
+		if math.IsNaN(want[idx]) {
+			if !math.IsNaN(got[idx]) {
+				t.Errorf("%s[%d] = %v, want undefined", name, idx, got[idx])
+			}
+			continue
+		}
+		if math.IsNaN(got[idx]) || math.Abs(got[idx]-want[idx]) > tolerance {
+			t.Errorf("%s[%d] = %v, want %v", name, idx, got[idx], want[idx])
+		}
+	}
+}
+
+// NaN for the warm up days followed by the values
+func warmUp(days int, values ...float64) []float64 {
+	return append(undefined(days), values...)
+}
+
+func TestSMA(t *testing.T) {
+	checkSeries(t, "sma", SMA([]float64{1, 2, 3, 4, 5, 6}, 3), warmUp(2, 2, 3, 4, 5), 1e-12)
+	checkSeries(t, "sma", SMA(emaCloses, 10)[9:12], []float64{22.22, 22.21, 22.23}, 0.005)
+	checkSeries(t, "short", SMA([]float64{1, 2}, 3), warmUp(2), 0)
+}
+
+func TestEMA(t *testing.T) {
+	want := warmUp(9,
+		22.22, 22.21, 22.24, 22.27, 22.33, 22.52, 22.80, 22.97, 23.13, 23.28,
+		23.34, 23.43, 23.51, 23.53, 23.47, 23.40, 23.39, 23.26, 23.23, 23.08,
+		22.92,
+	)
+	checkSeries(t, "ema", EMA(emaCloses, 10), want, 0.005)
+}
+
+func TestEMASkipsLeadingNaN(t *testing.T) {
+	checkSeries(t, "ema", EMA(warmUp(2, 2, 4, 6, 8), 2), warmUp(3, 3, 5, 7), 1e-12)
+}
+
+func TestRSI(t *testing.T) {
+	// the ChartSchool table works from averages rounded to 2 places (70.53 for the
+	// first day), these are the unrounded values, as from TA-Lib
+	want := warmUp(14,
+		70.46, 66.25, 66.48, 69.35, 66.29, 57.92, 62.88, 63.21, 56.01, 62.34,
+		54.67, 50.39, 40.02, 41.49, 41.90, 45.50, 37.32, 33.09, 37.79,
+	)
+	checkSeries(t, "rsi", RSI(rsiCloses, 14), want, 0.01)
+}
+
+func TestRSIWithoutLosses(t *testing.T) {
+	checkSeries(t, "rsi", RSI([]float64{1, 2, 3, 4}, 2), warmUp(2, 100, 100), 0)
+}
+
+func TestMACD(t *testing.T) {
+	// the emas of a straight line lag it by (window - 1) / 2, so the macd of a
+	// line rising by 1 a day is (26 - 12) / 2 = 7 once both are defined
+	line := make([]float64, 60)
+	for idx := range line {
+		line[idx] = float64(idx)
+	}
+	macd, signal, histogram := MACD(line, 12, 26, 9)
+	checkSeries(t, "macd", macd[25:], constant(35, 7), 1e-9)
+	checkSeries(t, "signal", signal, append(undefined(33), constant(27, 7)...), 1e-9)
+	checkSeries(t, "histogram", histogram[33:], constant(27, 0), 1e-9)
+	if !math.IsNaN(macd[24]) {
+		t.Errorf("macd[24] = %v, want undefined", macd[24])
+	}
+}
+
+func constant(length int, value float64) []float64 {
+	series := make([]float64, length)
+	for idx := range series {
+		series[idx] = value
+	}
+	return series
+}
+
+func TestBollinger(t *testing.T) {
+	middle, upper, lower := Bollinger([]float64{1, 2, 3, 4, 5, 6}, 5, 2)
+	checkSeries(t, "middle", middle, warmUp(4, 3, 4), 1e-12)
+	checkSeries(t, "upper", upper, warmUp(4, 5.82842712474619, 6.82842712474619), 1e-12)
+	checkSeries(t, "lower", lower, warmUp(4, 0.1715728752538097, 1.1715728752538097), 1e-12)
+}
+
+func TestATR(t *testing.T) {
+	high := []float64{10, 11, 12, 11.5}
+	low := []float64{9, 10, 10.5, 9}
+	close := []float64{9.5, 10.8, 11, 9.2}
+	// true ranges 1, 1.5 (high - previous close), 1.5 and 2.5
+	checkSeries(t, "atr", ATR(high, low, close, 2), warmUp(1, 1.25, 1.375, 1.9375), 1e-12)
+	checkSeries(t, "mismatched", ATR(high[:3], low, close, 2), warmUp(4), 0)
+}
+
+func TestVolatility(t *testing.T) {
+	// log returns of +10% and -10%, annualised
+	checkSeries(t, "volatility", Volatility([]float64{100, 110, 99}, 2), warmUp(2, 2.252522969955067), 1e-12)
+	checkSeries(t, "flat", Volatility([]float64{5, 5, 5, 5}, 3), warmUp(3, 0), 0)
+}
@@ -0,0 +1,473 @@
+package tickersymbols
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	agentcache "stock-agent/agent-cache"
+	agentassemble "stock-agent/gemini-agent-assemble"
+	stockdata "stock-agent/stock-data"
+
+	"github.com/google/generative-ai-go/genai"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/////////
+// Company name to ticker resolution
+/////////
+
+// candidates returned for a query and the lowest confidence kept
+const (
+	maxCandidates = 5
+	minConfidence = 0.5
+)
+
+// a resolved query is one candidate this confident, this far ahead of the next
+const (
+	resolvedConfidence = 0.85
+	resolvedMargin     = 0.1
+)
+
+// symbols are read again after this long, to pick up a reload by another process,
+// and cached resolutions expire with them
+const SymbolsTTL = 10 * time.Minute
+
+// an unknown query reads the symbols again when they are older than this, for a just loaded ticker
+const unknownRefresh = time.Minute
+
+// the source version is checked at most this often, a load by another process shows within it
+const versionCheck = 5 * time.Second
+
+// a possible symbol for a query
+type Candidate struct {
+	Ticker     string  `json:"ticker"`
+	Name       string  `json:"name"`
+	Exchange   string  `json:"exchange,omitempty"`
+	Sector     string  `json:"sector,omitempty"`
+	Listed     string  `json:"listed,omitempty"`
+	Delisted   string  `json:"delisted,omitempty"`
+	Confidence float64 `json:"confidence"`
+	// what the query matched, ticker, name or alias
+	Match string `json:"match"`
+}
+
+// the candidates of a query, Ticker is set when one of them is a clear match and
+// Ambiguous when several are close
+type Resolution struct {
+	Query      string      `json:"query"`
+	Ticker     string      `json:"ticker,omitempty"`
+	Ambiguous  bool        `json:"ambiguous,omitempty"`
+	Candidates []Candidate `json:"candidates"`
+}
+
+// resolves queries against the symbols of a source, read again after the ttl
+// or when the version of the source changes
+type Resolver struct {
+	source func(ctx context.Context) ([]Symbol, error)
+	// version of the source, nil when it has none
+	version        func(ctx context.Context) (string, error)
+	mu             sync.Mutex
+	symbols        []Symbol
+	read           time.Time
+	readVersion    string
+	versionChecked time.Time
+}
+
+func NewResolver(source func(ctx context.Context) ([]Symbol, error)) *Resolver {
+	return &Resolver{source: source}
+}
+
+// the resolver of the agents, reading the symbols collection or SYMBOLS_CSV
+// and again after a load bumps the data version
+var DefaultResolver = &Resolver{source: SymbolsFromEnv, version: dataVersionFromEnv}
+
+// client of the symbols reads, see SetMongoClient
+var (
+	clientMu     sync.Mutex
+	clientSource func() (*mongo.Client, error)
+	ownClient    *mongo.Client
+)
+
+// read the symbols with a shared client, e.g. the database agent pool
+func SetMongoClient(client func() (*mongo.Client, error)) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	clientSource = client
+}
+
+// the shared client, or one kept for the process and connected on first use
+func mongoClient(mongodbUri string) (*mongo.Client, error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	if clientSource != nil {
+		return clientSource()
+	}
+	if ownClient == nil {
+		client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(mongodbUri))
+		if err != nil {
+			return nil, err
+		}
+		ownClient = client
+	}
+	return ownClient, nil
+}
+
+// the data version bumped by the loaders, empty without MONGODB_URI
+func dataVersionFromEnv(ctx context.Context) (string, error) {
+	mongodbUri, exists := os.LookupEnv("MONGODB_URI")
+	if !exists {
+		return "", nil
+	}
+	client, err := mongoClient(mongodbUri)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return agentcache.DataVersion(ctx, client)
+}
+
+// the symbols of the MongoDB collection when MONGODB_URI is set and it is loaded,
+// else of the SYMBOLS_CSV file
+func SymbolsFromEnv(ctx context.Context) ([]Symbol, error) {
+	if mongodbUri, exists := os.LookupEnv("MONGODB_URI"); exists {
+		symbols, err := symbolsFromMongo(ctx, mongodbUri)
+		if err != nil {
+			log.Println("error reading the symbols collection:", err)
+		}
+		if len(symbols) > 0 {
+			return symbols, nil
+		}
+	}
+	path, exists := os.LookupEnv("SYMBOLS_CSV")
+	if !exists {
+		return nil, errors.New("no symbols loaded, run stock-agent load-symbols or set SYMBOLS_CSV")
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	symbols, rowErrors, err := ParseCSV(string(content))
+	if err != nil {
+		return nil, err
+	}
+	if len(rowErrors) > 0 {
+		log.Println(path + ": skipped " + strconv.Itoa(len(rowErrors)) + " rows, first: " + rowErrors[0].Error())
+	}
+	return symbols, nil
+}
+
+func symbolsFromMongo(ctx context.Context, mongodbUri string) ([]Symbol, error) {
+	client, err := mongoClient(mongodbUri)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return FindSymbols(ctx, client.Database(Database).Collection(Collection))
+}
+
+// the symbols, read from the source when missing, stale or of an old version
+func (resolver *Resolver) Symbols(ctx context.Context) ([]Symbol, error) {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	if resolver.symbols != nil && time.Since(resolver.read) < SymbolsTTL && !resolver.versionChanged(ctx) {
+		return resolver.symbols, nil
+	}
+	// the version before the read, so a load during it is seen on the next check
+	version := resolver.readVersion
+	if resolver.version != nil {
+		current, err := resolver.version(ctx)
+		if err != nil {
+			log.Println("error reading the symbols version:", err)
+		} else {
+			version = current
+		}
+		resolver.versionChecked = time.Now()
+	}
+	symbols, err := resolver.source(ctx)
+	if err != nil {
+		// keep answering from the stale symbols
+		if resolver.symbols != nil {
+			log.Println("error reading the symbols, keeping the previous ones:", err)
+			return resolver.symbols, nil
+		}
+		return nil, err
+	}
+	resolver.symbols = symbols
+	resolver.read = time.Now()
+	resolver.readVersion = version
+	return symbols, nil
+}
+
+// true when the source version moved on since the symbols were read
+// must be called with mu held
+func (resolver *Resolver) versionChanged(ctx context.Context) bool {
+	if resolver.version == nil || time.Since(resolver.versionChecked) < versionCheck {
+		return false
+	}
+	resolver.versionChecked = time.Now()
+	version, err := resolver.version(ctx)
+	if err != nil {
+		log.Println("error reading the symbols version:", err)
+		return false
+	}
+	return version != resolver.readVersion
+}
+
+// expire the symbols so the next query reads them again, e.g. for an unknown query,
+// the old ones are kept when the read fails
+func (resolver *Resolver) Reset() {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	resolver.read = time.Time{}
+}
+
+// the candidates for a ticker or company name, best first
+func (resolver *Resolver) Resolve(ctx context.Context, query string) (*Resolution, error) {
+	symbols, err := resolver.Symbols(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resolution := resolve(symbols, query)
+	if len(resolution.Candidates) == 0 && resolver.readBefore(time.Now().Add(-unknownRefresh)) {
+		// the symbols may have been loaded since they were read
+		resolver.Reset()
+		symbols, err = resolver.Symbols(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resolution = resolve(symbols, query)
+	}
+	return resolution, nil
+}
+
+// true when the symbols were read before the time
+func (resolver *Resolver) readBefore(before time.Time) bool {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	return resolver.read.Before(before)
+}
+
+func resolve(symbols []Symbol, query string) *Resolution {
+	resolution := &Resolution{Query: query, Candidates: []Candidate{}}
+	for _, symbol := range symbols {
+		confidence, match := score(symbol, query)
+		if confidence < minConfidence {
+			continue
+		}
+		candidate := Candidate{
+			Ticker:     symbol.Ticker,
+			Name:       symbol.Name,
+			Exchange:   symbol.Exchange,
+			Sector:     symbol.Sector,
+			Confidence: math.Round(confidence*100) / 100,
+			Match:      match,
+		}
+		if !symbol.Listed.IsZero() {
+			candidate.Listed = symbol.Listed.UTC().Format(stockdata.DateLayout)
+		}
+		if !symbol.Delisted.IsZero() {
+			candidate.Delisted = symbol.Delisted.UTC().Format(stockdata.DateLayout)
+		}
+		resolution.Candidates = append(resolution.Candidates, candidate)
+	}
+	sort.SliceStable(resolution.Candidates, func(i, j int) bool {
+		if resolution.Candidates[i].Confidence != resolution.Candidates[j].Confidence {
+			return resolution.Candidates[i].Confidence > resolution.Candidates[j].Confidence
+		}
+		return resolution.Candidates[i].Ticker < resolution.Candidates[j].Ticker
+	})
+	if len(resolution.Candidates) > maxCandidates {
+		resolution.Candidates = resolution.Candidates[:maxCandidates]
+	}
+
+	// a single weak candidate is left for the model to confirm
+	candidates := resolution.Candidates
+	switch {
+	case len(candidates) == 0:
+	case candidates[0].Confidence >= resolvedConfidence && (len(candidates) == 1 || candidates[0].Confidence-candidates[1].Confidence >= resolvedMargin):
+		resolution.Ticker = candidates[0].Ticker
+	case len(candidates) > 1:
+		resolution.Ambiguous = true
+	}
+	return resolution
+}
+
+// words of company names that do not tell them apart
+var nameSuffixes = map[string]bool{
+	"inc": true, "incorporated": true, "corp": true, "corporation": true, "co": true, "company": true,
+	"ltd": true, "limited": true, "plc": true, "the": true, "com": true, "sa": true, "nv": true, "ag": true,
+}
+
+// lower case words of a name without punctuation and the company suffixes
+func normalize(name string) []string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	kept := words[:0]
+	for _, word := range words {
+		if !nameSuffixes[word] {
+			kept = append(kept, word)
+		}
+	}
+	return kept
+}
+
+// confidence that the query names the symbol, and what it matched
+func score(symbol Symbol, query string) (float64, string) {
+	ticker := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(query), "$"))
+	if ticker == symbol.Ticker {
+		return penalty(symbol, 1), "ticker"
+	}
+	best, match := 0.0, ""
+	queryWords := normalize(query)
+	if len(queryWords) == 0 {
+		return 0, ""
+	}
+	queryName := strings.Join(queryWords, " ")
+	for idx, name := range append([]string{symbol.Name}, symbol.Aliases...) {
+		nameWords := normalize(name)
+		if len(nameWords) == 0 {
+			continue
+		}
+		confidence := nameScore(queryWords, queryName, nameWords)
+		if confidence > best {
+			best, match = confidence, "name"
+			if idx > 0 {
+				match = "alias"
+			}
+		}
+	}
+	// a mistyped ticker
+	if best < 0.5 && len(ticker) >= 3 && levenshtein(ticker, symbol.Ticker) == 1 {
+		best, match = 0.5, "ticker"
+	}
+	return penalty(symbol, best), match
+}
+
+// confidence that the query words name the company
+func nameScore(queryWords []string, queryName string, nameWords []string) float64 {
+	name := strings.Join(nameWords, " ")
+	switch {
+	case queryName == name:
+		return 0.95
+	case strings.HasPrefix(name, queryName+" "), strings.HasPrefix(queryName, name+" "):
+		return 0.8
+	case containsWords(nameWords, queryWords):
+		return 0.7
+	}
+	// close spellings of the whole name
+	distance := levenshtein(queryName, name)
+	similarity := 1 - float64(distance)/float64(max(len([]rune(queryName)), len([]rune(name))))
+	if similarity >= 0.7 {
+		return 0.85 * similarity
+	}
+	return 0
+}
+
+// delisted symbols rank below listed ones on the same match
+func penalty(symbol Symbol, confidence float64) float64 {
+	if !symbol.Delisted.IsZero() && confidence > 0 {
+		return confidence - 0.05
+	}
+	return confidence
+}
+
+// true when every query word is one of the name words
+func containsWords(nameWords []string, queryWords []string) bool {
+	for _, queryWord := range queryWords {
+		found := false
+		for _, nameWord := range nameWords {
+			if nameWord == queryWord {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// edit distance between two strings
+func levenshtein(a string, b string) int {
+	first, second := []rune(a), []rune(b)
+	previous := make([]int, len(second)+1)
+	current := make([]int, len(second)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(first); i++ {
+		current[0] = i
+		for j := 1; j <= len(second); j++ {
+			cost := 1
+			if first[i-1] == second[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(second)]
+}
+
+/////////
+// resolveTicker tool, shared by the agents
+
+// resolve ticker tool description
+var ResolveTickerDeclaration = &genai.FunctionDeclaration{
+	Name:        "resolveTicker",
+	Description: "Find the lower case ticker of a company from its name, an alias or a ticker, e.g. Apple or Google. Returns the ticker when the match is clear, otherwise the candidates with a confidence from 0 to 1 to choose from or to ask about",
+	Parameters: &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"query": {
+				Type:        genai.TypeString,
+				Description: "The company name, alias or ticker",
+			},
+		},
+		Required: []string{"query"},
+	},
+}
+
+// tool call handler of resolveTicker
+func CallResolveTicker(ctx context.Context, funcall genai.FunctionCall) (string, error) {
+	query, exists := funcall.Args["query"].(string)
+	if !exists {
+		err := errors.New("missing arg: query")
+		log.Println(err)
+		return err.Error(), err
+	}
+	log.Println("running resolveTicker tool for " + query)
+
+	resolution, err := DefaultResolver.Resolve(ctx, query)
+	if err != nil {
+		// the symbols may be loaded later
+		log.Println("resolve ticker error:", err)
+		agentassemble.SkipCache(ctx)
+		return "resolve ticker error: " + err.Error(), nil
+	}
+	if len(resolution.Candidates) == 0 {
+		agentassemble.SkipCache(ctx)
+	}
+	resolutionDat, err := json.Marshal(resolution)
+	if err != nil {
+		log.Println("json.Marshal() error:", err)
+		return "", err
+	}
+	log.Println("resolve ticker result: " + string(resolutionDat))
+	return string(resolutionDat), nil
+}
@@ -0,0 +1,216 @@
+package tickersymbols
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// symbols of the resolution tests
+var testSymbols = []Symbol{
+	{Ticker: "aapl", Name: "Apple Inc.", Aliases: []string{"iPhone maker"}},
+	{Ticker: "aple", Name: "Apple Hospitality REIT, Inc."},
+	{Ticker: "goog", Name: "Alphabet Inc. Class C", Aliases: []string{"Google"}},
+	{Ticker: "googl", Name: "Alphabet Inc. Class A"},
+	{Ticker: "twtr", Name: "Twitter, Inc.", Delisted: time.Date(2022, 11, 8, 0, 0, 0, 0, time.UTC)},
+	{Ticker: "x", Name: "X Corp.", Aliases: []string{"Twitter"}},
+	{Ticker: "ibm", Name: "International Business Machines Corporation"},
+	{Ticker: "zion", Name: "Bank of Zion"},
+	{Ticker: "bns", Name: "Bank of Nova Scotia"},
+	{Ticker: "ozk", Name: "Bank OZK"},
+	{Ticker: "bac", Name: "Bank of America Corporation"},
+	{Ticker: "bmo", Name: "Bank of Montreal"},
+	{Ticker: "bfc", Name: "Bank First Corporation"},
+}
+
+// the test symbol of a ticker
+func testSymbol(t *testing.T, ticker string) Symbol {
+	t.Helper()
+	for _, symbol := range testSymbols {
+		if symbol.Ticker == ticker {
+			return symbol
+		}
+	}
+	t.Fatalf("no test symbol %s", ticker)
+	return Symbol{}
+}
+
+func TestScore(t *testing.T) {
+	for _, test := range []struct {
+		ticker     string
+		query      string
+		confidence float64
+		match      string
+	}{
+		{"aapl", "AAPL", 1, "ticker"},
+		{"aapl", " $aapl ", 1, "ticker"},
+		{"aapl", "Apple", 0.95, "name"},
+		{"aapl", "apple inc", 0.95, "name"},
+		{"aapl", "iPhone maker", 0.95, "alias"},
+		{"goog", "google", 0.95, "alias"},
+		{"aapl", "aapk", 0.5, "ticker"},
+		// too short to be a mistyped ticker
+		{"ibm", "ib", 0, ""},
+		{"aapl", "microsoft", 0, ""},
+		// delisted
+		{"twtr", "twitter", 0.9, "name"},
+		{"twtr", "TWTR", 0.95, "ticker"},
+	} {
+		confidence, match := score(testSymbol(t, test.ticker), test.query)
+		if math.Abs(confidence-test.confidence) > 1e-9 || match != test.match {
+			t.Errorf("score(%s, %q) = %v %q, want %v %q", test.ticker, test.query, confidence, match, test.confidence, test.match)
+		}
+	}
+}
+
+func TestNameScore(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		name  string
+		want  float64
+	}{
+		{"Apple", "Apple Inc.", 0.95},
+		{"the coca-cola co", "Coca-Cola Company", 0.95},
+		{"bank of", "Bank of America Corp", 0.8},
+		{"apple computer", "Apple Inc.", 0.8},
+		{"america bank", "Bank of America Corp", 0.7},
+		{"microsft", "Microsoft Corporation", 0.85 * (1 - 1.0/9)},
+		{"tesla", "Apple Inc.", 0},
+		// similarity below 0.7
+		{"mcrsft", "Microsoft Corporation", 0},
+	} {
+		queryWords := normalize(test.query)
+		got := nameScore(queryWords, strings.Join(queryWords, " "), normalize(test.name))
+		if math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("nameScore(%q, %q) = %v, want %v", test.query, test.name, got, test.want)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	for _, test := range []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"", "abc", 3},
+		{"aapl", "aapl", 0},
+		{"aapl", "aapk", 1},
+		{"kitten", "sitting", 3},
+		{"flaw", "lawn", 2},
+		// runes, not bytes
+		{"café", "cafe", 1},
+		{"日本", "日本語", 1},
+	} {
+		if got := levenshtein(test.a, test.b); got != test.want {
+			t.Errorf("levenshtein(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	for _, test := range []struct {
+		query       string
+		ticker      string
+		ambiguous   bool
+		candidates  []string
+		confidences []float64
+	}{
+		// clear lead over a weaker name
+		{"apple", "aapl", false, []string{"aapl", "aple"}, []float64{0.95, 0.8}},
+		{"$AAPL", "aapl", false, []string{"aapl"}, []float64{1}},
+		// ties by ticker, below the resolved confidence
+		{"alphabet", "", true, []string{"goog", "googl"}, []float64{0.8, 0.8}},
+		// ties by ticker, at most 5
+		{"bank", "", true, []string{"bac", "bfc", "bmo", "bns", "ozk"}, []float64{0.8, 0.8, 0.8, 0.8, 0.8}},
+		// a margin under 0.1, the delisted symbol second
+		{"twitter", "", true, []string{"x", "twtr"}, []float64{0.95, 0.9}},
+		// a single weak candidate is neither resolved nor ambiguous
+		{"aapk", "", false, []string{"aapl"}, []float64{0.5}},
+		{"microsoft", "", false, nil, nil},
+	} {
+		resolution := resolve(testSymbols, test.query)
+		var tickers []string
+		var confidences []float64
+		for _, candidate := range resolution.Candidates {
+			tickers = append(tickers, candidate.Ticker)
+			confidences = append(confidences, candidate.Confidence)
+		}
+		if resolution.Ticker != test.ticker || resolution.Ambiguous != test.ambiguous {
+			t.Errorf("resolve(%q) = ticker %q ambiguous %v, want %q %v", test.query, resolution.Ticker, resolution.Ambiguous, test.ticker, test.ambiguous)
+		}
+		if strings.Join(tickers, ",") != strings.Join(test.candidates, ",") {
+			t.Errorf("resolve(%q) candidates = %v, want %v", test.query, tickers, test.candidates)
+			continue
+		}
+		for idx := range confidences {
+			if confidences[idx] != test.confidences[idx] {
+				t.Errorf("resolve(%q) confidences = %v, want %v", test.query, confidences, test.confidences)
+				break
+			}
+		}
+	}
+}
+
+// a source of symbols and a version changed by the test
+type testSource struct {
+	symbols []Symbol
+	err     error
+	version string
+	reads   int
+}
+
+func (source *testSource) read(ctx context.Context) ([]Symbol, error) {
+	source.reads++
+	return source.symbols, source.err
+}
+
+func (source *testSource) currentVersion(ctx context.Context) (string, error) {
+	return source.version, nil
+}
+
+func TestResolverSymbols(t *testing.T) {
+	ctx := context.Background()
+	source := &testSource{symbols: testSymbols[:1], version: "1"}
+	resolver := &Resolver{source: source.read, version: source.currentVersion}
+
+	for _, step := range []struct {
+		name    string
+		prepare func()
+		reads   int
+		tickers string
+	}{
+		{"first read", func() {}, 1, "aapl"},
+		{"cached", func() {}, 1, "aapl"},
+		{"version checked too early", func() { source.version = "2"; source.symbols = testSymbols[:2] }, 1, "aapl"},
+		{"version changed", func() { resolver.versionChecked = time.Time{} }, 2, "aapl,aple"},
+		{"version unchanged", func() { resolver.versionChecked = time.Time{} }, 2, "aapl,aple"},
+		{"stale kept on error", func() { source.err = errors.New("down"); resolver.Reset() }, 3, "aapl,aple"},
+		{"read after the error", func() { source.err = nil; source.symbols = testSymbols[:3]; resolver.Reset() }, 4, "aapl,aple,goog"},
+	} {
+		step.prepare()
+		symbols, err := resolver.Symbols(ctx)
+		if err != nil {
+			t.Fatalf("%s: Symbols error %v", step.name, err)
+		}
+		var tickers []string
+		for _, symbol := range symbols {
+			tickers = append(tickers, symbol.Ticker)
+		}
+		if source.reads != step.reads || strings.Join(tickers, ",") != step.tickers {
+			t.Errorf("%s: %d reads of %s, want %d of %s", step.name, source.reads, strings.Join(tickers, ","), step.reads, step.tickers)
+		}
+	}
+}
+
+func TestResolverFirstReadError(t *testing.T) {
+	source := &testSource{err: errors.New("down")}
+	if _, err := NewResolver(source.read).Resolve(context.Background(), "apple"); err == nil {
+		t.Errorf("Resolve with a failing source gave no error")
+	}
+}
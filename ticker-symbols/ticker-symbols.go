@@ -0,0 +1,130 @@
+package tickersymbols
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	stockdata "stock-agent/stock-data"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/////////
+// Symbol metadata of the tickers
+/////////
+
+// database and collection of the symbol metadata, apart from the ticker collections
+const (
+	Database   = "symbols"
+	Collection = "symbols"
+)
+
+// a listed company, the ticker is lower case as the collections and the results directories
+type Symbol struct {
+	Ticker   string    `bson:"ticker"`
+	Name     string    `bson:"name"`
+	Aliases  []string  `bson:"aliases,omitempty"`
+	Exchange string    `bson:"exchange,omitempty"`
+	Sector   string    `bson:"sector,omitempty"`
+	Listed   time.Time `bson:"listed,omitempty"`
+	// zero while still listed
+	Delisted time.Time `bson:"delisted,omitempty"`
+}
+
+// csv columns, ticker and name are needed, the others may be left out
+var csvColumns = []string{"ticker", "name", "aliases", "exchange", "sector", "listed", "delisted"}
+
+// parse the symbols csv, with a header naming the columns and the aliases separated by ;
+// the rows that cannot be parsed are returned as errors
+func ParseCSV(content string) ([]Symbol, []error, error) {
+	reader := csv.NewReader(strings.NewReader(content))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil, errors.New("the symbols csv is empty")
+	}
+	columns := map[string]int{}
+	for idx, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = idx
+	}
+	for _, name := range csvColumns[:2] {
+		if _, exists := columns[name]; !exists {
+			return nil, nil, errors.New("the symbols csv header has no " + name + " column, expected " + strings.Join(csvColumns, ","))
+		}
+	}
+
+	var symbols []Symbol
+	var rowErrors []error
+	seen := map[string]bool{}
+	for idx, record := range records[1:] {
+		value := func(name string) string {
+			column, exists := columns[name]
+			if !exists || column >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[column])
+		}
+		// line numbers from 1 with the header
+		line := "line " + strconv.Itoa(idx+2) + ": "
+		symbol := Symbol{
+			Ticker:   strings.ToLower(value("ticker")),
+			Name:     value("name"),
+			Exchange: value("exchange"),
+			Sector:   value("sector"),
+		}
+		if symbol.Ticker == "" || symbol.Name == "" {
+			rowErrors = append(rowErrors, errors.New(line+"missing ticker or name"))
+			continue
+		}
+		if seen[symbol.Ticker] {
+			rowErrors = append(rowErrors, errors.New(line+"duplicate ticker "+symbol.Ticker))
+			continue
+		}
+		for _, alias := range strings.Split(value("aliases"), ";") {
+			if alias = strings.TrimSpace(alias); alias != "" {
+				symbol.Aliases = append(symbol.Aliases, alias)
+			}
+		}
+		var err error
+		if listed := value("listed"); listed != "" {
+			symbol.Listed, err = stockdata.ParseDate(listed)
+		}
+		if delisted := value("delisted"); err == nil && delisted != "" {
+			symbol.Delisted, err = stockdata.ParseDate(delisted)
+		}
+		if err != nil {
+			rowErrors = append(rowErrors, errors.New(line+err.Error()))
+			continue
+		}
+		seen[symbol.Ticker] = true
+		symbols = append(symbols, symbol)
+	}
+	return symbols, rowErrors, nil
+}
+
+// all the symbols of the collection
+func FindSymbols(ctx context.Context, coll *mongo.Collection) ([]Symbol, error) {
+	cursor, err := coll.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "ticker", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var symbols []Symbol
+	err = cursor.All(ctx, &symbols)
+	return symbols, err
+}
+
+// index the tickers of the symbols collection, one document per ticker
+func EnsureIndexes(ctx context.Context, coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "ticker", Value: 1}}, Options: options.Index().SetUnique(true)})
+	return err
+}
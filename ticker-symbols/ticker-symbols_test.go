@@ -0,0 +1,102 @@
+package tickersymbols
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	stockdata "stock-agent/stock-data"
+)
+
+// fields of a symbol in one line, the dates as yyyy-mm-dd
+func describe(symbol Symbol) string {
+	date := func(day time.Time) string {
+		if day.IsZero() {
+			return ""
+		}
+		return day.UTC().Format(stockdata.DateLayout)
+	}
+	return strings.Join([]string{symbol.Ticker, symbol.Name, strings.Join(symbol.Aliases, ";"), symbol.Exchange, symbol.Sector, date(symbol.Listed), date(symbol.Delisted)}, "|")
+}
+
+func TestParseCSV(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		content string
+		symbols []string
+		errors  []string
+	}{
+		{
+			"all columns",
+			"Ticker, Name, Aliases, Exchange, Sector, Listed, Delisted\n" +
+				"AAPL,Apple Inc.,Apple; iPhone maker,NASDAQ,Technology,1980-12-12,\n" +
+				"TWTR,\"Twitter, Inc.\",,NYSE,,2013-11-07,2022-11-08\n",
+			[]string{
+				"aapl|Apple Inc.|Apple;iPhone maker|NASDAQ|Technology|1980-12-12|",
+				"twtr|Twitter, Inc.||NYSE||2013-11-07|2022-11-08",
+			},
+			nil,
+		},
+		{
+			"columns in any order",
+			"name,ticker\nMicrosoft Corporation,msft\n",
+			[]string{"msft|Microsoft Corporation|||||"},
+			nil,
+		},
+		{
+			"row errors",
+			"ticker,name,aliases,exchange,sector,listed\n" +
+				",No Ticker\n" +
+				"msft,Microsoft\n" +
+				"MSFT,Microsoft again\n" +
+				"ibm,IBM,,,,12/31/1962\n" +
+				"goog\n" +
+				"nvda,NVIDIA,;;,,,1999-01-22\n",
+			[]string{"msft|Microsoft|||||", "nvda|NVIDIA||||1999-01-22|"},
+			[]string{
+				"line 2: missing ticker or name",
+				"line 4: duplicate ticker msft",
+				"line 5: invalid date",
+				"line 6: missing ticker or name",
+			},
+		},
+	} {
+		symbols, rowErrors, err := ParseCSV(test.content)
+		if err != nil {
+			t.Errorf("%s: ParseCSV error %v", test.name, err)
+			continue
+		}
+		var got []string
+		for _, symbol := range symbols {
+			got = append(got, describe(symbol))
+		}
+		if strings.Join(got, "\n") != strings.Join(test.symbols, "\n") {
+			t.Errorf("%s: ParseCSV symbols = %q, want %q", test.name, got, test.symbols)
+		}
+		if len(rowErrors) != len(test.errors) {
+			t.Errorf("%s: ParseCSV row errors = %v, want %q", test.name, rowErrors, test.errors)
+			continue
+		}
+		for idx, rowError := range rowErrors {
+			if !strings.HasPrefix(rowError.Error(), test.errors[idx]) {
+				t.Errorf("%s: ParseCSV row error %d = %q, want %q", test.name, idx, rowError, test.errors[idx])
+			}
+		}
+	}
+}
+
+func TestParseCSVRejects(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		content string
+	}{
+		{"empty", ""},
+		{"no name column", "ticker,exchange\naapl,NASDAQ\n"},
+		{"no ticker column", "name\nApple Inc.\n"},
+		{"bad quoting", "ticker,name\naapl,\"Apple\n"},
+	} {
+		if _, _, err := ParseCSV(test.content); err == nil {
+			t.Errorf("%s: ParseCSV(%q) gave no error", test.name, test.content)
+		}
+	}
+}